@@ -0,0 +1,60 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import "strings"
+
+// Affinity is the type affinity of a column, which SQLite determines from the
+// column's declared type.
+//
+// https://www.sqlite.org/datatype3.html#determination_of_column_affinity
+type Affinity string
+
+// The column affinities supported by SQLite.
+const (
+	AffinityInteger Affinity = "INTEGER"
+	AffinityText    Affinity = "TEXT"
+	AffinityBlob    Affinity = "BLOB"
+	AffinityReal    Affinity = "REAL"
+	AffinityNumeric Affinity = "NUMERIC"
+)
+
+// TypeAffinity returns the affinity of a column with the declared type
+// declType, following the rules SQLite applies in order.
+func TypeAffinity(declType string) Affinity {
+	t := strings.ToUpper(declType)
+	switch {
+	case strings.Contains(t, "INT"):
+		return AffinityInteger
+	case strings.Contains(t, "CHAR"),
+		strings.Contains(t, "CLOB"),
+		strings.Contains(t, "TEXT"):
+		return AffinityText
+	case strings.Contains(t, "BLOB"), t == "":
+		return AffinityBlob
+	case strings.Contains(t, "REAL"),
+		strings.Contains(t, "FLOA"),
+		strings.Contains(t, "DOUB"):
+		return AffinityReal
+	default:
+		return AffinityNumeric
+	}
+}
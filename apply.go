@@ -0,0 +1,74 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"io"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// ConvertAndApply converts changeset into SQL using the default Options and
+// applies the SQL to conn, returning it so that it may be logged.
+func ConvertAndApply(conn *sqlite.Conn, changeset io.Reader) (string, error) {
+	return Options{}.ConvertAndApply(conn, changeset)
+}
+
+// ConvertAndApply converts changeset into SQL and applies the SQL to conn in
+// a single transaction, returning it so that it may be logged. If the SQL
+// fails to apply, all of its changes are rolled back and the error returned
+// along with the SQL.
+//
+// The SQL is applied within a SAVEPOINT, so ConvertAndApply may be called
+// within a transaction which is already open on conn. Note that some pragmas,
+// such as foreign_keys, have no effect within a transaction, so a Prologue
+// setting them does not take effect.
+//
+// With ContinueOnError, the changes which could be converted are applied and
+// the ChangeErrors of the others are returned.
+func (opts Options) ConvertAndApply(conn *sqlite.Conn,
+	changeset io.Reader) (sql string, err error) {
+	sql, err = opts.ToSQL(conn, changeset)
+	if fatal(err) != nil {
+		return "", err
+	}
+	convErr := err
+
+	const SAVEPOINT = `"sqlitechangeset.ConvertAndApply"`
+	if err := sqlitex.Exec(conn, `SAVEPOINT `+SAVEPOINT+`;`, nil); err != nil {
+		return sql, err
+	}
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		rbErr := sqlitex.Exec(conn, `ROLLBACK TO `+SAVEPOINT+`;`, nil)
+		if rbErr == nil {
+			rbErr = sqlitex.Exec(conn, `RELEASE `+SAVEPOINT+`;`, nil)
+		}
+		if rbErr != nil {
+			opts.logf("rolling back failed apply: %v", rbErr)
+		}
+		return sql, err
+	}
+	if err := sqlitex.Exec(conn, `RELEASE `+SAVEPOINT+`;`, nil); err != nil {
+		return sql, err
+	}
+	return sql, convErr
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"fmt"
+	"strings"
+
+	"crawshaw.io/sqlite"
+)
+
+// updateBatch collects UPDATEs of the same columns of rows of a table, for
+// BatchUpdates.
+type updateBatch struct {
+	// pk is the PK column, and cols the updated columns.
+	pk   string
+	cols []string
+	// keys are the PK values of the rows, vals the values set for each
+	// row, and sqls the statements of the UPDATEs.
+	keys []string
+	vals [][]string
+	sqls []string
+}
+
+// batchKey returns the key of the batches of c, naming the columns it updates,
+// and whether c may be batched: an UPDATE of a table with a single PK column
+// which it does not change.
+func (conn _Conn) batchKey(c change) (string, bool) {
+	opts := conn.Options
+	if opts.BatchUpdates < 2 || c.Op != sqlite.SQLITE_UPDATE ||
+		c.Conflict != nil || conn.params != nil || opts.UpdateAsUpsert ||
+		opts.GuardWithOldValues || opts.GuardWithOldRow || opts.LimitOne ||
+		opts.History != nil || opts.RewriteStatement != nil {
+		return "", false
+	}
+	var key string
+	var nPK int
+	for i, col := range c.Columns {
+		if c.PK[i] {
+			nPK++
+			if c.Old[i].IsNil() || isNull(c.Old[i]) || !c.New[i].IsNil() {
+				return "", false
+			}
+			continue
+		}
+		if !c.New[i].IsNil() {
+			key += col.Name + "\x00"
+		}
+	}
+	return key, nPK == 1
+}
+
+// add adds c, whose statement is sql, to the batch.
+func (batch *updateBatch) add(conn _Conn, c change, sql string) {
+	var vals []string
+	for i, col := range c.Columns {
+		switch {
+		case c.PK[i]:
+			batch.pk = col.Name
+			batch.keys = append(batch.keys, conn.param(col, c.Old[i]))
+		case !c.New[i].IsNil():
+			if len(batch.keys) == 1 {
+				batch.cols = append(batch.cols, col.Name)
+			}
+			vals = append(vals, conn.setParam(col, c.New[i]))
+		}
+	}
+	batch.vals = append(batch.vals, vals)
+	batch.sqls = append(batch.sqls, sql)
+}
+
+// removeLast removes the last UPDATE added to the batch, which must not be
+// its only UPDATE.
+func (batch *updateBatch) removeLast() {
+	n := len(batch.sqls) - 1
+	batch.keys = batch.keys[:n]
+	batch.vals = batch.vals[:n]
+	batch.sqls = batch.sqls[:n]
+}
+
+// sql returns the UPDATE of the rows of the batch of table tbl, or the
+// statement of its only UPDATE.
+func (batch *updateBatch) sql(conn _Conn, tbl string) string {
+	const UPDATEF = `UPDATE %s SET %s WHERE %s IN %s`
+	if len(batch.sqls) == 1 {
+		return batch.sqls[0]
+	}
+	f := conn.layout()
+	pk := quoteIdentifier(batch.pk)
+	sets := make([]string, len(batch.cols))
+	for j, col := range batch.cols {
+		var cases strings.Builder
+		fmt.Fprintf(&cases, "%s = CASE %s", quoteIdentifier(col), pk)
+		for i, key := range batch.keys {
+			fmt.Fprintf(&cases, " WHEN %s THEN %s", key, batch.vals[i][j])
+		}
+		cases.WriteString(" END")
+		sets[j] = cases.String()
+	}
+	return f.statement(fmt.Sprintf(UPDATEF, quoteIdentifier(tbl),
+		strings.Join(sets, f.Comma), pk,
+		f.list(strings.Join(batch.keys, f.Comma))))
+}
@@ -22,8 +22,11 @@ package sqlitechangeset
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"strconv"
 	"strings"
 
 	"crawshaw.io/sqlite"
@@ -41,242 +44,1930 @@ var opIndex = map[sqlite.OpType]int{
 	sqlite.SQLITE_DELETE: 2,
 }
 
+// opSections names the statements of each op, indexed by opIndex.
+var opSections = []string{"inserts", "updates", "deletes"}
+
+// SessionToSQL converts the current changeset of sess into the equivalent SQL
+// statements using the default Options.
 func SessionToSQL(conn *sqlite.Conn, sess *sqlite.Session) (sql string, err error) {
+	return Options{}.SessionToSQL(conn, sess)
+}
+
+// SessionToSQL converts the current changeset of sess into the equivalent SQL
+// statements.
+func (opts Options) SessionToSQL(conn *sqlite.Conn,
+	sess *sqlite.Session) (sql string, err error) {
 	changeset := &bytes.Buffer{}
 	if err = sess.Changeset(changeset); err != nil {
 		return
 	}
-	return ToSQL(conn, changeset)
+	return opts.ToSQL(conn, changeset)
+}
+
+// SessionToSQLStream is like SessionToSQL but streams the SQL to w using the
+// default Options. See Options.SessionToSQLStream.
+func SessionToSQLStream(conn *sqlite.Conn, sess *sqlite.Session,
+	w io.Writer) (Report, error) {
+	return Options{}.SessionToSQLStream(conn, sess, w)
+}
+
+// SessionToSQLStream is like SessionToSQL but converts the changeset of sess
+// as it is generated, rather than first buffering all of it, and writes the
+// SQL to w as WriteSQL does. With NoGrouping, memory use is then bounded
+// regardless of the size of the changeset.
+//
+// The session uses conn while generating the changeset, so the columns of
+// every table in the main and temp schemas are loaded beforehand. With
+// ReadTransaction, the session generates the changeset within the same
+// transaction.
+func (opts Options) SessionToSQLStream(conn *sqlite.Conn, sess *sqlite.Session,
+	w io.Writer) (report Report, err error) {
+	if opts.ReadTransaction {
+		var end func(*error)
+		if end, err = beginRead(conn); err != nil {
+			return report, err
+		}
+		defer end(&err)
+		opts.ReadTransaction = false
+	}
+	opts.columns = make(map[string][]ColumnInfo)
+	opts.foreignKeys = make(map[string][]ForeignKey)
+	opts.generated = make(map[string][]GeneratedColumn)
+	Conn := opts.newConn(conn)
+	for _, schema := range []string{"main", "temp"} {
+		tables, err := tableNames(conn, schema)
+		if err != nil {
+			return Report{}, err
+		}
+		for _, tbl := range tables {
+			if opts.usesForeignKeys() {
+				if _, err := Conn.GetForeignKeys(tbl); err != nil {
+					return Report{}, err
+				}
+			}
+			if opts.GeneratedColumnComments {
+				if _, err := Conn.GetGeneratedColumns(tbl); err != nil {
+					return Report{}, err
+				}
+			}
+			if _, err := Conn.GetColumns(tbl); err != nil {
+				return Report{}, err
+			}
+		}
+	}
+	if opts.DisableTriggers {
+		if opts.triggers, err = triggers(conn); err != nil {
+			return report, err
+		}
+	}
+	opts.cachedOnly = true
+
+	pr, pw := io.Pipe()
+	// The error of the session is sent before the pipe is closed, so that
+	// it is available once the conversion has read to the end.
+	sessErr := make(chan error, 1)
+	go func() {
+		err := sess.Changeset(pw)
+		sessErr <- err
+		pw.CloseWithError(err)
+	}()
+	report, err = opts.WriteSQL(w, conn, pr)
+	select {
+	case sErr := <-sessErr:
+		if sErr != nil {
+			return report, sErr
+		}
+		return report, err
+	default:
+	}
+	// The conversion stopped before the end of the changeset, so the
+	// session must be unblocked and finish before conn may be used again.
+	pr.CloseWithError(err)
+	<-sessErr
+	return report, err
+}
+
+// ToSQL converts changeset, which may also be a patchset, into the equivalent
+// SQL statements using the default Options. The column names are queried from
+// the database connected to by sqliteConn.
+func ToSQL(conn *sqlite.Conn, changeset io.Reader) (sql string, err error) {
+	return Options{}.ToSQL(conn, changeset)
+}
+
+// ToSQL converts changeset, which may also be a patchset, into the equivalent
+// SQL statements. The column names are queried from the database connected to
+// by sqliteConn.
+//
+// A patchset holds only the primary key of a deleted row, and only the
+// primary key and new values of an updated row. As for a changeset, an UPDATE
+// only sets the columns defined by the change, so columns which the patchset
+// leaves undefined keep their current value in the target, while a column
+// explicitly set to NULL is set to NULL. The comments of the statements omit
+// the old values which the patchset does not hold.
+func (opts Options) ToSQL(conn *sqlite.Conn, changeset io.Reader) (sql string, err error) {
+	sql, _, err = opts.ToSQLWithReport(conn, changeset)
+	return
+}
+
+func ConflictChangesetIterToSQL(conn *sqlite.Conn, iter sqlite.ChangesetIter) (string, error) {
+	return Options{}.ConflictChangesetIterToSQL(conn, iter)
+}
+
+func (opts Options) ConflictChangesetIterToSQL(conn *sqlite.Conn,
+	iter sqlite.ChangesetIter) (string, error) {
+	Conn := opts.newConn(conn)
+	c, err := Conn.ReadChange(iter, true)
+	if err != nil {
+		return "", err
+	}
+	return Conn.BuildSQL(c)
+}
+
+func ChangesetIterToSQL(conn *sqlite.Conn, iter sqlite.ChangesetIter) (sql string, err error) {
+	return Options{}.ChangesetIterToSQL(conn, iter)
+}
+
+func (opts Options) ChangesetIterToSQL(conn *sqlite.Conn,
+	iter sqlite.ChangesetIter) (sql string, err error) {
+	sql, _, err = opts.ChangesetIterToSQLWithReport(conn, iter)
+	return
+}
+
+// Report describes the SQL generated from a changeset.
+type Report struct {
+	// Bytes is the length of the generated SQL.
+	Bytes int
+	// Statements is the number of statements generated for the changes
+	// in the changeset.
+	Statements int
+	// Tables is the number of tables with generated statements.
+	Tables int
+	// ChangesetBytes is the number of bytes read from the changeset. It
+	// is zero when converting from a ChangesetIter.
+	ChangesetBytes int64
+}
+
+// ToSQLFromBytes is like ToSQL but converts a changeset held in memory, such
+// as one produced by another SQLite binding or the C API.
+func ToSQLFromBytes(conn *sqlite.Conn, changeset []byte) (string, error) {
+	return Options{}.ToSQLFromBytes(conn, changeset)
+}
+
+// ToSQLFromBytes is like ToSQL but converts a changeset held in memory, such
+// as one produced by another SQLite binding or the C API.
+func (opts Options) ToSQLFromBytes(conn *sqlite.Conn,
+	changeset []byte) (string, error) {
+	return opts.ToSQL(conn, bytes.NewReader(changeset))
+}
+
+// ToSQLWithReport is like ToSQL but also returns a Report describing the
+// generated SQL.
+func ToSQLWithReport(conn *sqlite.Conn,
+	changeset io.Reader) (sql string, report Report, err error) {
+	return Options{}.ToSQLWithReport(conn, changeset)
+}
+
+// ToSQLWithReport is like ToSQL but also returns a Report describing the
+// generated SQL.
+func (opts Options) ToSQLWithReport(conn *sqlite.Conn,
+	changeset io.Reader) (sql string, report Report, err error) {
+	var buf strings.Builder
+	report, err = opts.WriteSQL(&buf, conn, changeset)
+	return buf.String(), report, err
+}
+
+// ChangesetIterToSQLWithReport is like ChangesetIterToSQL but also returns a
+// Report describing the generated SQL.
+func (opts Options) ChangesetIterToSQLWithReport(conn *sqlite.Conn,
+	iter sqlite.ChangesetIter) (sql string, report Report, err error) {
+	var buf strings.Builder
+	report, err = opts.ChangesetIterWriteSQL(&buf, conn, iter)
+	return buf.String(), report, err
+}
+
+// WriteSQL is like ToSQL but writes the SQL statements to w.
+func WriteSQL(w io.Writer, conn *sqlite.Conn,
+	changeset io.Reader) (report Report, err error) {
+	return Options{}.WriteSQL(w, conn, changeset)
+}
+
+// WriteSQL is like ToSQL but writes the SQL statements to w. With NoGrouping
+// each statement is written as soon as it is generated.
+func (opts Options) WriteSQL(w io.Writer, conn *sqlite.Conn,
+	changeset io.Reader) (report Report, err error) {
+	if opts.ReadTransaction {
+		var end func(*error)
+		if end, err = beginRead(conn); err != nil {
+			return report, err
+		}
+		defer end(&err)
+		opts.ReadTransaction = false
+	}
+	if opts.readsAhead() {
+		data, err := ioutil.ReadAll(changeset)
+		if err != nil {
+			return report, err
+		}
+		if opts, err = opts.readAhead(conn, data); err != nil {
+			return report, err
+		}
+		changeset = bytes.NewReader(data)
+	}
+	n, err := withChangesetIter(changeset, func(iter sqlite.ChangesetIter) error {
+		var err error
+		report, err = opts.ChangesetIterWriteSQL(w, conn, iter)
+		return err
+	})
+	report.ChangesetBytes = n
+	return
+}
+
+// readsAhead returns true if any of the Options which read the whole
+// changeset before it is converted are set.
+func (opts Options) readsAhead() bool {
+	return opts.UniformInsertColumns || opts.StrictSchema || opts.HashComment
+}
+
+// readAhead returns opts prepared to convert changeset for the Options which
+// read the whole changeset first: HashComment, StrictSchema and
+// UniformInsertColumns.
+func (opts Options) readAhead(conn *sqlite.Conn,
+	changeset []byte) (Options, error) {
+	if opts.HashComment {
+		opts.header = fmt.Sprintf("-- changeset sha256:%s\n",
+			changesetHash(changeset))
+	}
+	if opts.columns == nil {
+		// Share the columns between the passes.
+		opts.columns = make(map[string][]ColumnInfo)
+	}
+	if opts.StrictSchema {
+		err := opts.ValidateSchema(conn, bytes.NewReader(changeset))
+		if err != nil {
+			return opts, err
+		}
+	}
+	if opts.UniformInsertColumns {
+		return opts.withInsertColumns(conn, changeset)
+	}
+	return opts, nil
+}
+
+// beginRead begins a read transaction on conn for ReadTransaction, unless a
+// transaction is already open, and returns the func which ends it, setting
+// *err if ending it fails.
+func beginRead(conn *sqlite.Conn) (end func(err *error), err error) {
+	if !conn.GetAutocommit() {
+		return func(*error) {}, nil
+	}
+	if err := sqlitex.Exec(conn, `BEGIN;`, nil); err != nil {
+		return nil, err
+	}
+	end = func(err *error) {
+		cErr := sqlitex.Exec(conn, `COMMIT;`, nil)
+		if cErr != nil {
+			if rbErr := sqlitex.Exec(conn, `ROLLBACK;`, nil); rbErr != nil {
+				cErr = fmt.Errorf("%v; rollback: %v", cErr, rbErr)
+			}
+		}
+		if *err == nil {
+			*err = cErr
+		}
+	}
+	// A transaction takes its read lock on its first read, so the schema
+	// is read at once.
+	if err := sqlitex.Exec(conn, `SELECT count(*) FROM sqlite_master;`,
+		nil); err != nil {
+		end(&err)
+		return nil, err
+	}
+	return end, nil
+}
+
+// withInsertColumns returns opts with the insertColumns of each table: the
+// union of the columns defined by its INSERTs in changeset. Changes which
+// cannot be read are left for the conversion to report.
+func (opts Options) withInsertColumns(conn *sqlite.Conn,
+	changeset []byte) (Options, error) {
+	scan := opts
+	scan.Logger = nil // The conversion logs the same changes.
+	Conn := scan.newConn(conn)
+	columns := make(map[string][]bool)
+	_, err := withChangesetIter(bytes.NewReader(changeset),
+		func(iter sqlite.ChangesetIter) error {
+			for {
+				hasRow, err := iter.Next()
+				if err != nil || !hasRow {
+					return err
+				}
+				c, err := Conn.ReadChange(iter, false)
+				if err != nil || c.Op != sqlite.SQLITE_INSERT {
+					continue
+				}
+				defined, ok := columns[c.Table]
+				if !ok {
+					defined = make([]bool, len(c.Columns))
+					columns[c.Table] = defined
+				}
+				for i, v := range c.New {
+					if i < len(defined) && !v.IsNil() {
+						defined[i] = true
+					}
+				}
+			}
+		})
+	opts.insertColumns = columns
+	return opts, err
+}
+
+// ErrUnconsumedChangeset is returned if the changeset iterator finished before
+// reading all of the changeset, which may indicate a corrupt changeset.
+var ErrUnconsumedChangeset = fmt.Errorf(
+	"sqlitechangeset: changeset was not fully consumed")
+
+// CountingReader counts the bytes read from R.
+type CountingReader struct {
+	R io.Reader
+	N int64
+}
+
+func (cr *CountingReader) Read(p []byte) (int, error) {
+	n, err := cr.R.Read(p)
+	cr.N += int64(n)
+	return n, err
+}
+
+// withChangesetIter calls fn with an iterator over changeset, and returns the
+// number of bytes of changeset read. ErrUnconsumedChangeset is returned if
+// changeset still has data once the iterator is finalized.
+func withChangesetIter(changeset io.Reader,
+	fn func(iter sqlite.ChangesetIter) error) (n int64, err error) {
+	cr := &CountingReader{R: changeset}
+	iter, err := sqlite.ChangesetIterStart(cr)
+	if err != nil {
+		return cr.N, formatError(err)
+	}
+	err = fn(iter)
+	if fErr := iter.Finalize(); err == nil {
+		err = fErr
+	}
+	if fatal(err) == nil {
+		var b [1]byte
+		if n, _ := io.ReadFull(changeset, b[:]); n > 0 {
+			err = ErrUnconsumedChangeset
+		}
+	}
+	return cr.N, formatError(err)
+}
+
+// ErrUnsupportedChangesetFormat is returned when SQLite cannot parse a
+// changeset, as it is truncated, corrupt, or not a changeset or patchset of
+// a format this version of SQLite supports. The error of SQLite follows it.
+var ErrUnsupportedChangesetFormat = fmt.Errorf(
+	"sqlitechangeset: unsupported or corrupt changeset format")
+
+// formatError returns err as ErrUnsupportedChangesetFormat if SQLite
+// reported it as SQLITE_CORRUPT, the error of the changeset iterator for
+// changesets it cannot parse.
+func formatError(err error) error {
+	var sqliteErr sqlite.Error
+	if errors.As(err, &sqliteErr) &&
+		sqliteErr.Code&0xff == sqlite.SQLITE_CORRUPT {
+		return fmt.Errorf("%w: %v", ErrUnsupportedChangesetFormat, err)
+	}
+	return err
+}
+
+// ChangesetIterWriteSQL is like ChangesetIterToSQL but writes the SQL
+// statements to w.
+func (opts Options) ChangesetIterWriteSQL(w io.Writer, conn *sqlite.Conn,
+	iter sqlite.ChangesetIter) (report Report, err error) {
+	if opts.ReadTransaction {
+		var end func(*error)
+		if end, err = beginRead(conn); err != nil {
+			return report, err
+		}
+		defer end(&err)
+	}
+	sw := newScriptWriter(w, opts.newConn(conn))
+	if err := sw.begin(); err != nil {
+		return sw.report(), err
+	}
+	// convErr holds any ChangeErrors, which are returned once all of the
+	// SQL has been written.
+	convErr := opts.forEachStatement(conn, iter, sw.add)
+	if err := fatal(convErr); err != nil {
+		return sw.report(), err
+	}
+	if err := sw.end(); err != nil {
+		return sw.report(), err
+	}
+	return sw.report(), convErr
+}
+
+// scriptWriter writes statements as an SQL script, either as they are added
+// or, unless NoGrouping or PreserveOrder is set, grouped by table and
+// operation once all have been added.
+type scriptWriter struct {
+	Options
+	cw         *countWriter
+	tables     map[string]bool
+	statements int
+	runs       orderedRuns
+	groups     tableGroups
+	savepoints *savepointBatches
+}
+
+func newScriptWriter(w io.Writer, conn _Conn) *scriptWriter {
+	opts := conn.Options
+	savepoints := &savepointBatches{}
+	if !opts.TransactionPerTable || opts.NoGrouping {
+		savepoints.every = opts.SavepointEvery
+	}
+	return &scriptWriter{Options: opts, cw: &countWriter{w: w},
+		tables:     make(map[string]bool),
+		runs:       orderedRuns{Options: opts},
+		groups:     tableGroups{Options: opts, conn: conn, savepoints: savepoints},
+		savepoints: savepoints}
+}
+
+// streaming returns true if statements are written as they are added.
+func (sw *scriptWriter) streaming() bool {
+	return sw.NoGrouping || sw.PreserveOrder
+}
+
+// begin writes the Prologue, preceded by any ATTACH DATABASE statements and
+// followed by the DROP TRIGGER statements of DisableTriggers and the
+// SAVEPOINT of DeferForeignKeys.
+func (sw *scriptWriter) begin() error {
+	sql := sw.prologue()
+	if sw.DisableTriggers {
+		if sw.triggers == nil {
+			var err error
+			if sw.triggers, err = triggers(sw.groups.conn.Conn); err != nil {
+				return err
+			}
+		}
+		sql += sw.triggers.drop
+	}
+	if sw.DeferForeignKeys {
+		sql += fmt.Sprintf(_SAVEPOINTF, quoteIdentifier(_DEFER_SAVEPOINT)) +
+			"PRAGMA defer_foreign_keys=ON;\n"
+	}
+	_, err := io.WriteString(sw.cw, sql)
+	return err
+}
+
+// add adds sql, the statement of c.
+func (sw *scriptWriter) add(c change, sql string) error {
+	sw.tables[c.Table] = true
+	sw.statements++
+	if !sw.streaming() {
+		return sw.groups.add(c, sql)
+	}
+	_, err := io.WriteString(sw.cw,
+		sw.runs.next(c)+sw.savepoints.begin()+sql+sw.savepoints.next())
+	return err
+}
+
+// end writes any grouped statements and the RELEASE of their last
+// SavepointEvery batch, followed by the ANALYZE statements, the
+// RELEASE of DeferForeignKeys, the CREATE TRIGGER statements of
+// DisableTriggers, and the Epilogue.
+func (sw *scriptWriter) end() error {
+	sql := sw.runs.end()
+	if !sw.streaming() {
+		var blocks []string
+		if sw.OrderByDependencies {
+			var err error
+			if blocks, err = sw.groups.dependencyBlocks(); err != nil {
+				return err
+			}
+		} else {
+			blocks = sw.groups.blocks()
+		}
+		sql = strings.Join(blocks, "\n")
+	}
+	sql += sw.savepoints.end()
+	if sw.AnalyzeThreshold > 0 && sw.statements >= sw.AnalyzeThreshold {
+		sql += "ANALYZE;\n"
+		if sw.AnalyzeOptimize {
+			sql += "PRAGMA optimize;\n"
+		}
+	}
+	if sw.DeferForeignKeys {
+		sql += fmt.Sprintf(_RELEASEF, quoteIdentifier(_DEFER_SAVEPOINT))
+	}
+	if sw.DisableTriggers {
+		sql += sw.triggers.create
+	}
+	_, err := io.WriteString(sw.cw, sql+sw.epilogue())
+	return err
+}
+
+// report returns the Report of the SQL written so far.
+func (sw *scriptWriter) report() Report {
+	return Report{Bytes: sw.cw.n, Statements: sw.statements,
+		Tables: len(sw.tables)}
+}
+
+// savepointBatches delimits batches of SavepointEvery statements with
+// savepoints. A nil *savepointBatches delimits none.
+type savepointBatches struct {
+	// every is the number of statements per batch, or 0 if the statements
+	// are not batched.
+	every int
+	// n is the number of statements in the current batch, and batch its
+	// number.
+	n, batch int
+}
+
+// begin returns the SQL which precedes the next statement: the SAVEPOINT of
+// a new batch, if the last was released.
+func (b *savepointBatches) begin() string {
+	if b == nil || b.every <= 0 || b.n > 0 {
+		return ""
+	}
+	b.batch++
+	return fmt.Sprintf(_SAVEPOINTF,
+		quoteIdentifier(fmt.Sprintf("batch_%d", b.batch)))
+}
+
+// next returns the SQL which follows a statement: the RELEASE of its batch,
+// if it is full.
+func (b *savepointBatches) next() string {
+	if b == nil || b.every <= 0 {
+		return ""
+	}
+	if b.n++; b.n < b.every {
+		return ""
+	}
+	return b.end()
+}
+
+// end returns the RELEASE of the current batch, if any.
+func (b *savepointBatches) end() string {
+	if b == nil || b.n == 0 {
+		return ""
+	}
+	b.n = 0
+	return fmt.Sprintf(_RELEASEF,
+		quoteIdentifier(fmt.Sprintf("batch_%d", b.batch)))
+}
+
+// orderedRuns delimits the runs of consecutive changes to the same table when
+// PreserveOrder is set, as tableGroups delimits the SQL of each table.
+type orderedRuns struct {
+	Options
+	table string
+	op    sqlite.OpType
+}
+
+// next returns the SQL which precedes the statement of c.
+func (runs *orderedRuns) next(c change) (sql string) {
+	if !runs.PreserveOrder {
+		return ""
+	}
+	if runs.op == 0 || c.Table != runs.table {
+		if runs.op != 0 {
+			sql += runs.end() + "\n"
+		}
+		if runs.TransactionPerTable {
+			sql += fmt.Sprintf(_SAVEPOINTF, quoteIdentifier(c.Table))
+		}
+		runs.table, runs.op = c.Table, 0
+	}
+	if runs.AnnotateSections && c.Op != runs.op {
+		sql += fmt.Sprintf(_SECTIONF, c.Table, opSections[opIndex[c.Op]])
+	}
+	runs.op = c.Op
+	return sql
+}
+
+// end returns the SQL which follows the statements of the current run.
+func (runs *orderedRuns) end() string {
+	if runs.PreserveOrder && runs.TransactionPerTable && runs.op != 0 {
+		return fmt.Sprintf(_RELEASEF, quoteIdentifier(runs.table))
+	}
+	return ""
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
+}
+
+// forEachStatement converts each change in iter and calls fn with the change
+// and its SQL statement, as rewritten by the RewriteStatement. Changes
+// excluded by the RowFilter or skipped by the RewriteStatement are skipped.
+func (opts Options) forEachStatement(conn *sqlite.Conn, iter sqlite.ChangesetIter,
+	fn func(c change, sql string) error) error {
+	return opts.forEachChange(conn, iter, _Conn.BuildSQL,
+		func(c change, sql string) error {
+			sql, err := opts.rewrite(c, sql)
+			if err != nil || sql == "" {
+				return err
+			}
+			return fn(c, sql)
+		})
+}
+
+// rewrite returns sql, the SQL of c, as rewritten by the RewriteStatement, if
+// any. The SQL is empty if the statement is to be skipped.
+func (opts Options) rewrite(c change, sql string) (string, error) {
+	if opts.RewriteStatement == nil {
+		return sql, nil
+	}
+	rewritten, err := opts.RewriteStatement(c.Table, c.Op, sql)
+	if err != nil {
+		return "", fmt.Errorf("sqlitechangeset: rewriting %v on %q: %w",
+			c.Op, c.Table, err)
+	}
+	if rewritten == "" {
+		opts.logf("skipped %v on %q: removed by RewriteStatement",
+			c.Op, c.Table)
+	}
+	return rewritten, nil
+}
+
+// forEachChange calls build with each change in iter and then calls fn with
+// the change and the output of build. Changes excluded by the RowFilter are
+// skipped. Errors from build are per change, and so may be collected with
+// ContinueOnError, while errors from fn always abort.
+func (opts Options) forEachChange(conn *sqlite.Conn, iter sqlite.ChangesetIter,
+	build func(conn _Conn, c change) (string, error),
+	fn func(c change, out string) error) error {
+	Conn := opts.newConn(conn)
+	var n int
+	var errs ChangeErrors
+	for {
+		hasRow, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		if !hasRow {
+			break
+		}
+		n++
+		opts.progress(n, false)
+		c, out, ok, err := Conn.convert(iter, n-1, build, &errs)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := fn(c, out); err != nil {
+			return err
+		}
+	}
+	opts.progress(n, true)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// progress calls the Progress callback, if any, after every ProgressInterval
+// changes, and once more with the total n when done unless it was just called
+// with n. It is always called when done with an empty changeset.
+func (opts Options) progress(n int, done bool) {
+	if opts.Progress == nil {
+		return
+	}
+	// Progress was last called with n only if n is a positive multiple of
+	// the interval.
+	reported := n > 0 && n%opts.progressInterval() == 0
+	if done != reported {
+		opts.Progress(n)
+	}
+}
+
+// convert reads the current change of iter, the change at index in the
+// changeset, and calls build with it. ok is false if the change is excluded
+// by the RowFilter, or if it could not be converted and the error has been
+// appended to errs because ContinueOnError is set.
+func (conn _Conn) convert(iter sqlite.ChangesetIter, index int,
+	build func(conn _Conn, c change) (string, error),
+	errs *ChangeErrors) (c change, out string, ok bool, err error) {
+	opts := conn.Options
+	c, err = conn.ReadChange(iter, false)
+	if err == nil && opts.RowFilter != nil &&
+		!opts.RowFilter(c.Table, c.PKValues()) {
+		opts.logf("skipped change %d (%v on %q): excluded by RowFilter",
+			index, c.Op, c.Table)
+		return c, "", false, nil
+	}
+	if err == nil {
+		var after bool
+		if after, err = conn.afterWatermark(c); err == nil && !after {
+			opts.logf("skipped change %d (%v on %q): "+
+				"not after PKWatermark", index, c.Op, c.Table)
+			return c, "", false, nil
+		}
+	}
+	if err == nil && !c.updatesAny() {
+		opts.logf("skipped change %d (%v on %q): no columns to update",
+			index, c.Op, c.Table)
+		return c, "", false, nil
+	}
+	if err == nil {
+		var transformErr error
+		conn.transformErr = &transformErr
+		if out, err = build(conn, c); err == nil {
+			err = transformErr
+		}
+	}
+	if err != nil {
+		if !opts.ContinueOnError {
+			return c, "", false, err
+		}
+		*errs = append(*errs, &ChangeError{
+			Index: index, Table: c.Table, Op: c.Op, Err: err})
+		opts.logf("skipped %v", (*errs)[len(*errs)-1])
+		return c, "", false, nil
+	}
+	return c, out, true, nil
+}
+
+// ChangeError is the error converting a single change.
+type ChangeError struct {
+	// Index is the 0-based position of the change in the changeset.
+	Index int
+	// Table and Op are the table and operation of the change, if known.
+	Table string
+	Op    sqlite.OpType
+	Err   error
+}
+
+func (err *ChangeError) Error() string {
+	return fmt.Sprintf("change %d (%v on %q): %v",
+		err.Index, err.Op, err.Table, err.Err)
+}
+
+func (err *ChangeError) Unwrap() error { return err.Err }
+
+// ChangeErrors holds the errors of all changes which could not be converted
+// when Options.ContinueOnError is set.
+type ChangeErrors []*ChangeError
+
+func (errs ChangeErrors) Error() string {
+	if len(errs) == 1 {
+		return "sqlitechangeset: " + errs[0].Error()
+	}
+	return fmt.Sprintf("sqlitechangeset: %d changes could not be converted; first: %v",
+		len(errs), errs[0])
+}
+
+// fatal returns err unless it is ChangeErrors, which do not stop a
+// conversion.
+func fatal(err error) error {
+	if _, ok := err.(ChangeErrors); ok {
+		return nil
+	}
+	return err
+}
+
+// tableGroups groups statements by table, in the order that the tables first
+// appear, and then by operation.
+type tableGroups struct {
+	Options
+	conn     _Conn
+	tables   []string
+	tableIDs map[string]int
+	tableOps [][][]string
+
+	// selfRefs holds the self references of each table, and recursive
+	// the DELETE of each table which replaces its DELETEs, with
+	// RecursiveDeletes.
+	selfRefs  map[string][]selfReference
+	recursive map[int]*recursiveDelete
+
+	// batches holds the batch of UPDATEs in place of each line of each
+	// table, and openBatches the batch still being filled for each table
+	// and set of columns, with BatchUpdates.
+	batches     map[int]map[int]*updateBatch
+	openBatches map[string]*updateBatch
+
+	// savepoints delimits the batches of SavepointEvery.
+	savepoints *savepointBatches
+}
+
+// add adds sql, the statement of c.
+func (groups *tableGroups) add(c change, sql string) error {
+	if groups.tableIDs == nil {
+		groups.tableIDs = make(map[string]int)
+		groups.selfRefs = make(map[string][]selfReference)
+		groups.recursive = make(map[int]*recursiveDelete)
+		groups.batches = make(map[int]map[int]*updateBatch)
+		groups.openBatches = make(map[string]*updateBatch)
+	}
+	tblID, ok := groups.tableIDs[c.Table]
+	if !ok {
+		tblID = len(groups.tableOps)
+		groups.tableIDs[c.Table] = tblID
+		groups.tables = append(groups.tables, c.Table)
+		groups.tableOps = append(groups.tableOps, make([][]string, 3))
+	}
+	opID := opIndex[c.Op]
+	if key, ok := groups.conn.batchKey(c); ok {
+		groups.addToBatch(tblID, c.Table+"\x00"+key, c, sql)
+		return nil
+	}
+	if groups.conn.recursiveDeletes(c) {
+		refs, ok := groups.selfRefs[c.Table]
+		if !ok {
+			var err error
+			refs, err = selfReferences(groups.conn, c.Table, c.Columns)
+			if err != nil {
+				return err
+			}
+			groups.selfRefs[c.Table] = refs
+		}
+		if len(refs) > 0 {
+			del := groups.recursive[tblID]
+			if del == nil {
+				del = &recursiveDelete{refs: refs}
+				groups.recursive[tblID] = del
+			}
+			if del.add(groups.conn, c) {
+				return nil
+			}
+		}
+	}
+	groups.tableOps[tblID][opID] = append(groups.tableOps[tblID][opID], sql)
+	return nil
+}
+
+// addToBatch adds sql, the statement of c, an UPDATE of table tblID, to the
+// open batch with key, or to a new batch in place of a new line if there is
+// none, it is full, or c would make its statement longer than
+// MaxStatementLength.
+func (groups *tableGroups) addToBatch(tblID int, key string, c change,
+	sql string) {
+	conn := groups.conn
+	conn.table = c.Table
+	batch := groups.openBatches[key]
+	if batch != nil && len(batch.sqls) < groups.BatchUpdates {
+		batch.add(conn, c, sql)
+		max := groups.MaxStatementLength
+		if max <= 0 || len(batch.sql(conn, c.Table)) <= max {
+			return
+		}
+		batch.removeLast()
+	}
+	batch = new(updateBatch)
+	groups.openBatches[key] = batch
+	opID := opIndex[sqlite.SQLITE_UPDATE]
+	if groups.batches[tblID] == nil {
+		groups.batches[tblID] = make(map[int]*updateBatch)
+	}
+	groups.batches[tblID][len(groups.tableOps[tblID][opID])] = batch
+	groups.tableOps[tblID][opID] = append(groups.tableOps[tblID][opID], "")
+	batch.add(conn, c, sql)
+}
+
+// blocks returns the SQL for each table.
+func (groups *tableGroups) blocks() []string {
+	blocks := make([]string, len(groups.tableOps))
+	for tblID := range groups.tableOps {
+		blocks[tblID] = groups.block(tblID, 0, 1, 2)
+	}
+	return blocks
+}
+
+// dependencyBlocks returns the SQL for each table with OrderByDependencies:
+// the INSERTs and UPDATEs of each table after those of the tables it
+// references, followed by the DELETEs of each table before those of the
+// tables it references. A table referencing itself is left to
+// RecursiveDeletes, and with DeferForeignKeys a cycle of references is not
+// an error, as their checks are deferred.
+func (groups *tableGroups) dependencyBlocks() ([]string, error) {
+	order, err := dependencyOrder(groups.tables, groups.conn.GetForeignKeys,
+		groups.DeferForeignKeys)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []string
+	for _, tblID := range order {
+		if block := groups.block(tblID, opIndex[sqlite.SQLITE_INSERT],
+			opIndex[sqlite.SQLITE_UPDATE]); block != "" {
+			blocks = append(blocks, block)
+		}
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		if block := groups.block(order[i],
+			opIndex[sqlite.SQLITE_DELETE]); block != "" {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks, nil
+}
+
+// block returns the SQL of the statements of table tblID with the given ops,
+// or "" if there are none.
+func (groups *tableGroups) block(tblID int, opIDs ...int) string {
+	tbl, ops := groups.tables[tblID], groups.tableOps[tblID]
+	var n int
+	for _, opID := range opIDs {
+		n += len(ops[opID])
+		if opID == opIndex[sqlite.SQLITE_DELETE] &&
+			groups.recursive[tblID] != nil {
+			n++
+		}
+	}
+	if n == 0 {
+		return ""
+	}
+	var sql strings.Builder
+	if groups.TransactionPerTable {
+		fmt.Fprintf(&sql, _SAVEPOINTF, quoteIdentifier(tbl))
+	}
+	// For each op...
+	for _, opID := range opIDs {
+		op := ops[opID]
+		if del := groups.recursive[tblID]; del != nil &&
+			opID == opIndex[sqlite.SQLITE_DELETE] {
+			op = append(op[:len(op):len(op)],
+				del.sql(groups.conn, tbl)...)
+		}
+		if groups.AnnotateSections && len(op) > 0 {
+			fmt.Fprintf(&sql, _SECTIONF, tbl, opSections[opID])
+		}
+		// Append each line.
+		for i, line := range op {
+			if opID == opIndex[sqlite.SQLITE_UPDATE] &&
+				groups.batches[tblID][i] != nil {
+				line = groups.batches[tblID][i].sql(groups.conn, tbl)
+			}
+			sql.WriteString(groups.savepoints.begin() + line +
+				groups.savepoints.next())
+		}
+	}
+	if groups.TransactionPerTable {
+		fmt.Fprintf(&sql, _RELEASEF, quoteIdentifier(tbl))
+	}
+	return sql.String()
+}
+
+// newConn returns a _Conn for conn which uses the column cache of a Converter,
+// if any, or else a new cache.
+func (opts Options) newConn(conn *sqlite.Conn) _Conn {
+	columns, fks, gen, pks := opts.columns, opts.foreignKeys, opts.generated,
+		opts.pks
+	if columns == nil {
+		columns = make(map[string][]ColumnInfo)
+	}
+	if fks == nil {
+		fks = make(map[string][]ForeignKey)
+	}
+	if gen == nil {
+		gen = make(map[string][]GeneratedColumn)
+	}
+	if pks == nil {
+		pks = make(map[string][]bool)
+	}
+	return _Conn{Conn: conn, Columns: columns, ForeignKeys: fks,
+		Generated: gen, PKs: pks, Options: opts}
+}
+
+type _Conn struct {
+	*sqlite.Conn
+	Columns     map[string][]ColumnInfo
+	ForeignKeys map[string][]ForeignKey
+	Generated   map[string][]GeneratedColumn
+	// PKs holds the PK flags of each table, as declared by the changeset.
+	PKs     map[string][]bool
+	Options Options
+
+	// params collects the values of statement parameters, if not nil.
+	params *[]interface{}
+	// table is the table of the change being rendered.
+	table string
+	// transformErr receives the first error of the ValueTransforms while
+	// a change is built, if not nil.
+	transformErr *error
+}
+
+// change holds the values of the current change of a ChangesetIter. Values
+// which are undefined by the change are nil. The values are only valid until
+// the iterator is advanced.
+type change struct {
+	Table              string
+	Op                 sqlite.OpType
+	Columns            []ColumnInfo
+	PK                 []bool
+	Old, New, Conflict []sqlite.Value
+	// Rowid is true if the first column is the rowid of a table without a
+	// PRIMARY KEY, which the changeset uses as the key of the row.
+	Rowid bool
+}
+
+// ReadChange reads the current change of iter. The conflicting values are
+// only read if conflict is true, as they are only available within a
+// ChangesetApply conflict handler.
+func (conn _Conn) ReadChange(iter sqlite.ChangesetIter,
+	conflict bool) (c change, err error) {
+	var nCol int
+	c.Table, nCol, c.Op, _, err = iter.Op()
+	if err != nil {
+		return
+	}
+	if c.Columns, err = conn.GetColumns(c.Table); err != nil {
+		return
+	}
+	// The cached columns, such as those of a Converter which was not
+	// Reset, may predate a CREATE TABLE or an ALTER TABLE ADD COLUMN, so
+	// they are queried again if the table was not found or the change has
+	// more columns than the table, besides the rowid of a table without a
+	// PRIMARY KEY.
+	if !conn.Options.cachedOnly && (len(c.Columns) == 0 ||
+		nCol > len(c.Columns)+1 ||
+		nCol == len(c.Columns)+1 && hasPK(c.Columns)) {
+		delete(conn.Columns, tableKey(c.Table))
+		if c.Columns, err = conn.GetColumns(c.Table); err != nil {
+			return
+		}
+	}
+	// Every table has a column, so a table without any does not exist,
+	// and a change with a single column is not taken to be keyed by its
+	// rowid.
+	if len(c.Columns) == 0 {
+		err = fmt.Errorf("%w: %q", ErrNoSuchTable, c.Table)
+		return
+	}
+	if c.PK, err = conn.GetPK(iter, c.Table, nCol, c.Columns); err != nil {
+		return
+	}
+	if nCol == len(c.Columns)+1 && c.PK[0] && !hasPK(c.Columns) {
+		c.Columns = append([]ColumnInfo{rowidColumn}, c.Columns...)
+		c.Rowid = true
+	}
+	if nCol > len(c.Columns) {
+		err = fmt.Errorf("%w: table %q has %d columns "+
+			"but the changeset has %d", ErrExtraColumns,
+			c.Table, len(c.Columns), nCol)
+		return
+	}
+	if nCol < len(c.Columns) {
+		conn.Options.logf("changeset has %d columns for table %q "+
+			"which has %d columns", nCol, c.Table, len(c.Columns))
+		if !conn.Options.AllowMissingColumns {
+			err = fmt.Errorf("%w: table %q has %d columns "+
+				"but the changeset has %d", ErrMissingColumns,
+				c.Table, len(c.Columns), nCol)
+			return
+		}
+		// The missing columns are undefined and not part of the PK.
+		c.PK = append(c.PK, make([]bool, len(c.Columns)-nCol)...)
+	}
+	c.Old = make([]sqlite.Value, len(c.Columns))
+	c.New = make([]sqlite.Value, len(c.Columns))
+	if conflict {
+		c.Conflict = make([]sqlite.Value, len(c.Columns))
+	}
+	for i := range c.Columns {
+		if i >= nCol {
+			break
+		}
+		if c.Op != sqlite.SQLITE_INSERT {
+			if c.Old[i], err = iter.Old(i); err != nil {
+				return
+			}
+		}
+		if c.Op != sqlite.SQLITE_DELETE {
+			if c.New[i], err = iter.New(i); err != nil {
+				return
+			}
+		}
+		if conflict {
+			if c.Conflict[i], err = iter.Conflict(i); err != nil {
+				return
+			}
+		}
+		for _, val := range []sqlite.Value{c.Old[i], c.New[i]} {
+			if !val.IsNil() && !knownType(val.Type()) {
+				err = fmt.Errorf("%w: %v in column %q of table %q",
+					ErrUnsupportedValueType, val.Type(),
+					c.Columns[i].Name, c.Table)
+				return
+			}
+		}
+	}
+	if err = conn.excludeColumns(&c); err != nil {
+		return
+	}
+	if conn.Options.Invert {
+		c.invert()
+	}
+	return
 }
 
-// ToSQL converts changeset, which may also be a patchset, into the equivalent
-// SQL statements. The column names are queried from the database connected to
-// by sqliteConn.
-func ToSQL(conn *sqlite.Conn, changeset io.Reader) (sql string, err error) {
-	iter, err := sqlite.ChangesetIterStart(changeset)
-	if err != nil {
-		return
+// excludeColumns makes the values of the columns of c which are excluded by
+// IncludeColumns or ExcludeColumns undefined.
+func (conn _Conn) excludeColumns(c *change) error {
+	include, hasInclude := conn.Options.IncludeColumns[c.Table]
+	exclude := conn.Options.ExcludeColumns[c.Table]
+	if !hasInclude && len(exclude) == 0 {
+		return nil
 	}
-	defer iter.Finalize()
-	return ChangesetIterToSQL(conn, iter)
+	for i, col := range c.Columns {
+		excluded := containsFold(exclude, col.Name)
+		if c.PK[i] {
+			if excluded {
+				return fmt.Errorf("sqlitechangeset: %q: cannot "+
+					"exclude PRIMARY KEY column %q",
+					c.Table, col.Name)
+			}
+			continue
+		}
+		if !excluded && (!hasInclude || containsFold(include, col.Name)) {
+			continue
+		}
+		c.Old[i], c.New[i] = sqlite.Value{}, sqlite.Value{}
+		if c.Conflict != nil {
+			c.Conflict[i] = sqlite.Value{}
+		}
+	}
+	return nil
 }
 
-func ConflictChangesetIterToSQL(conn *sqlite.Conn, iter sqlite.ChangesetIter) (string, error) {
-	Conn := _Conn{Conn: conn, ColumnNames: make(map[string][]string)}
-	var tbl string
-	var op sqlite.OpType
-	tbl, _, op, _, err := iter.Op()
+// containsFold returns true if names contains name, ignoring case as SQLite
+// does for identifiers.
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// updatesAny returns true unless c is an UPDATE which leaves every column
+// undefined, such as one which only changes excluded columns.
+func (c change) updatesAny() bool {
+	if c.Op != sqlite.SQLITE_UPDATE {
+		return true
+	}
+	for _, v := range c.New {
+		if !v.IsNil() {
+			return true
+		}
+	}
+	return false
+}
+
+// rowidColumn is the column of the rowid of a table without a PRIMARY KEY,
+// which a changeset may record as its first column.
+var rowidColumn = ColumnInfo{Name: "_rowid_", Type: "INTEGER", PK: 1}
+
+// maxIterPKColumns is the most columns for which sqlite.ChangesetIter.PK may
+// be called, as it panics for wider tables.
+const maxIterPKColumns = 127
+
+// changesetPK returns the PK flag of each of the nCol columns of the current
+// change of iter, where cols are the columns of its table. The flags of a
+// table wider than maxIterPKColumns are instead taken from cols: the rowid of
+// a rowid-keyed changeset, or else the PRIMARY KEY of the table.
+func changesetPK(iter sqlite.ChangesetIter, nCol int,
+	cols []ColumnInfo) ([]bool, error) {
+	if nCol <= maxIterPKColumns {
+		return iter.PK()
+	}
+	pk := make([]bool, nCol)
+	if nCol == len(cols)+1 && !hasPK(cols) {
+		pk[0] = true
+		return pk, nil
+	}
+	for i := 0; i < nCol && i < len(cols); i++ {
+		pk[i] = cols[i].PK > 0
+	}
+	return pk, nil
+}
+
+// GetPK returns the PK flags of the current change of iter, a change to tbl
+// with nCol columns, caching them for subsequent changes to tbl. Each table
+// header of a changeset declares its own PK, and two headers for the same
+// table need not agree, such as in changesets concatenated across a schema
+// change, so the flags of each change are checked against the cache, which
+// is replaced if they differ.
+func (conn _Conn) GetPK(iter sqlite.ChangesetIter, tbl string, nCol int,
+	cols []ColumnInfo) ([]bool, error) {
+	pk, err := changesetPK(iter, nCol, cols)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	cached, ok := conn.PKs[tableKey(tbl)]
+	if ok && equalPK(cached, pk) {
+		return cached, nil
+	}
+	if ok {
+		conn.Options.logf("changeset PK of table %q changed", tbl)
 	}
-	return Conn.BuildSQL(iter, tbl, op, true)
+	// Limit the capacity, so that appending to the flags of a change
+	// copies them rather than extending those of the cache.
+	pk = pk[:len(pk):len(pk)]
+	conn.PKs[tableKey(tbl)] = pk
+	return pk, nil
 }
 
-func ChangesetIterToSQL(conn *sqlite.Conn, iter sqlite.ChangesetIter) (sql string, err error) {
-	Conn := _Conn{Conn: conn, ColumnNames: make(map[string][]string)}
-	// We later group all statements by table and operation.
-	tableIDs := map[string]int{}
-	tableOps := [][][]string{}
-	for {
-		var hasRow bool
-		hasRow, err = iter.Next()
-		if err != nil {
-			return
+// equalPK returns true if a and b flag the same columns.
+func equalPK(a, b []bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
-		if !hasRow {
-			break
+	}
+	return true
+}
+
+// hasPK returns true if any of cols is part of the PRIMARY KEY.
+func hasPK(cols []ColumnInfo) bool {
+	for _, col := range cols {
+		if col.PK > 0 {
+			return true
 		}
-		var tbl string
-		var op sqlite.OpType
-		tbl, _, op, _, err = iter.Op()
-		if err != nil {
-			return
+	}
+	return false
+}
+
+// ErrMissingColumns is returned when a changeset has fewer columns than its
+// table, such as one recorded before an ALTER TABLE ADD COLUMN, unless
+// Options.AllowMissingColumns is set.
+var ErrMissingColumns = fmt.Errorf(
+	"sqlitechangeset: changeset is missing columns of its table")
+
+// ErrExtraColumns is returned when a changeset has more columns than its
+// table, even once they are queried again, such as one recorded after an
+// ALTER TABLE ADD COLUMN which the database has not had, rather than
+// dropping the values of the extra columns.
+var ErrExtraColumns = fmt.Errorf(
+	"sqlitechangeset: changeset has more columns than its table")
+
+// ErrNoSuchTable is returned when the table of a change does not exist in the
+// database, such as when it is misnamed or has not been created.
+var ErrNoSuchTable = fmt.Errorf("sqlitechangeset: changeset table does not exist")
+
+// ErrUnsupportedValueType is returned for a value of a changeset whose type
+// is not one of SQLite's fundamental types, or a value returned by the
+// Options.ValueTransforms whose Go type has no SQLite equivalent, rather than
+// rendering it wrongly.
+var ErrUnsupportedValueType = fmt.Errorf(
+	"sqlitechangeset: unsupported value type")
+
+// knownType returns true if typ is one of SQLite's fundamental types, which
+// valueString renders. An INTEGER is always read with Int64, so its full
+// range is rendered.
+func knownType(typ sqlite.ColumnType) bool {
+	switch typ {
+	case sqlite.SQLITE_INTEGER, sqlite.SQLITE_FLOAT, sqlite.SQLITE_TEXT,
+		sqlite.SQLITE_BLOB, sqlite.SQLITE_NULL:
+		return true
+	}
+	return false
+}
+
+// invert turns c into the change which undoes it, as sqlite.ChangesetInvert
+// would.
+func (c *change) invert() {
+	switch c.Op {
+	case sqlite.SQLITE_INSERT:
+		c.Op = sqlite.SQLITE_DELETE
+		c.Old, c.New = c.New, c.Old
+	case sqlite.SQLITE_DELETE:
+		c.Op = sqlite.SQLITE_INSERT
+		c.Old, c.New = c.New, c.Old
+	case sqlite.SQLITE_UPDATE:
+		// An unchanged PK still identifies the row by its old values,
+		// but a changed PK identifies it by its new values, and is
+		// set back to its old values.
+		for i := range c.Columns {
+			if !c.PK[i] || !c.New[i].IsNil() {
+				c.Old[i], c.New[i] = c.New[i], c.Old[i]
+			}
+		}
+	}
+}
+
+// PKValues returns the primary key values of c keyed by column name. The
+// values identify the row prior to the change, so the new values are used
+// only for an INSERT.
+func (c change) PKValues() map[string]interface{} {
+	vals := c.Old
+	if c.Op == sqlite.SQLITE_INSERT {
+		vals = c.New
+	}
+	pk := make(map[string]interface{})
+	for i, col := range c.Columns {
+		if c.PK[i] {
+			pk[col.Name] = goValue(vals[i])
 		}
-		var sqlLine string
-		sqlLine, err = Conn.BuildSQL(iter, tbl, op, false)
+	}
+	return pk
+}
+
+func (conn _Conn) BuildSQL(c change) (string, error) {
+	var transformErr error
+	if conn.transformErr == nil {
+		conn.transformErr = &transformErr
+	}
+	sql, err := conn.buildWrapped(c)
+	if err != nil {
+		return "", err
+	}
+	if transformErr != nil {
+		return "", transformErr
+	}
+	max := conn.Options.MaxStatementLength
+	if max > 0 && len(sql) > max {
+		split, ok, err := conn.splitStatement(c)
 		if err != nil {
-			return
+			return "", err
 		}
-		tblID, ok := tableIDs[tbl]
 		if !ok {
-			tblID = len(tableOps)
-			tableIDs[tbl] = tblID
-			tableOps = append(tableOps, make([][]string, 3))
+			return "", fmt.Errorf("%w: %v on %q is %d bytes, exceeding %d",
+				ErrStatementTooLong, c.Op, c.Table, len(sql), max)
 		}
-		opID := opIndex[op]
-		tableOps[tblID][opID] = append(tableOps[tblID][opID], sqlLine)
+		sql = split
 	}
+	return sql, nil
+}
 
-	// For each table...
-	for _, ops := range tableOps {
-		// For each op...
-		for _, op := range ops {
-			// Append each line.
-			for _, line := range op {
-				sql += line
-			}
+// buildWrapped is like buildSQL, but builds the statement again with its
+// lists wrapped if it has a line longer than MaxLineWidth.
+func (conn _Conn) buildWrapped(c change) (string, error) {
+	var nParams int
+	if conn.params != nil {
+		nParams = len(*conn.params)
+	}
+	sql, err := conn.buildSQL(c)
+	if err != nil {
+		return "", err
+	}
+	if width := conn.Options.MaxLineWidth; width > 0 &&
+		!conn.Options.PrettyPrint && longestLine(sql) > width {
+		// Build the statement again with its lists wrapped, collecting
+		// its parameters afresh.
+		conn.Options.PrettyPrint = true
+		if conn.params != nil {
+			*conn.params = (*conn.params)[:nParams]
 		}
-		sql += "\n"
+		return conn.buildSQL(c)
 	}
-	sql = strings.TrimSuffix(sql, "\n")
-	return
+	return sql, nil
 }
 
-type _Conn struct {
-	*sqlite.Conn
-	ColumnNames map[string][]string
+// longestLine returns the length of the longest line of s.
+func longestLine(s string) int {
+	var longest int
+	for _, line := range strings.Split(s, "\n") {
+		if len(line) > longest {
+			longest = len(line)
+		}
+	}
+	return longest
 }
 
-func (conn _Conn) BuildSQL(iter sqlite.ChangesetIter,
-	tbl string, op sqlite.OpType, conflict bool) (string, error) {
-	names, err := conn.GetColNames(tbl)
-	if err != nil {
-		return "", err
+// ErrStatementTooLong is returned for a change whose SQL is longer than
+// Options.MaxStatementLength.
+var ErrStatementTooLong = fmt.Errorf(
+	"sqlitechangeset: statement is too long")
+
+func (conn _Conn) buildSQL(c change) (string, error) {
+	conn.table = c.Table
+	if conn.Options.History != nil {
+		return conn.buildHistory(c)
 	}
-	switch op {
+	if c.Conflict != nil && conn.Options.ConflictSourceWins {
+		return conn.buildSourceWins(c)
+	}
+	switch c.Op {
 	case sqlite.SQLITE_INSERT:
-		return buildInsert(iter, tbl, names, conflict)
+		return conn.buildInsert(c)
 	case sqlite.SQLITE_UPDATE:
-		return buildUpdate(iter, tbl, names, conflict)
+		return conn.buildUpdate(c)
 	case sqlite.SQLITE_DELETE:
-		return buildDelete(iter, tbl, names, conflict)
+		return conn.buildDelete(c)
 	default:
-		panic(fmt.Sprintf("unsupported OpType: %v", op))
+		panic(fmt.Sprintf("unsupported OpType: %v", c.Op))
 	}
-	return "", nil
 }
 
 const (
-	_COLUMNF = `%q`
-	_COMMA   = ", "
+	_COMMA      = ", "
+	_SAVEPOINTF = "SAVEPOINT %s;\n"
+	_RELEASEF   = "RELEASE %s;\n"
+	_SECTIONF   = "-- Table: %s (%s)\n"
+
+	_DEFER_SAVEPOINT   = "sqlitechangeset.DeferForeignKeys"
+	_PK_UPDATE_TABLE   = "sqlitechangeset.PKUpdateAsDeleteInsert"
+	_RECURSIVE_DELETES = "sqlitechangeset.RecursiveDeletes"
 )
 
-func buildInsert(iter sqlite.ChangesetIter,
-	tbl string, names []string, conflict bool) (string, error) {
-	const INSERTF = `INSERT INTO %q (%s) VALUES (%s)%s;
-`
-	var cols, vals, conf string
-	for i, name := range names {
-		v, err := iter.New(i)
-		if err != nil {
-			return "", err
+// layout holds the punctuation used to lay out statements.
+type layout struct {
+	// Comma separates the items of a list.
+	Comma string
+	// Open and Close enclose a list of columns or values.
+	Open, Close string
+	// CommentOpen and CommentClose enclose a comment.
+	CommentOpen, CommentClose string
+	// CommentComma separates the items of a list within a comment.
+	CommentComma string
+	// LineComments places comments on the line before the statement,
+	// where CommentOpen begins a comment which runs to the end of the
+	// line.
+	LineComments bool
+	// Terminator ends each statement, before its line break.
+	Terminator string
+}
+
+// layout returns the layout of statements selected by the Options.
+func (conn _Conn) layout() layout {
+	f := layout{Comma: _COMMA, Open: "(", Close: ")",
+		CommentOpen: " /* ", CommentClose: " */", CommentComma: _COMMA,
+		Terminator: ";"}
+	if conn.Options.OmitSemicolons {
+		f.Terminator = ""
+	}
+	if conn.Options.CompactWhitespace {
+		f.Comma, f.CommentComma = ",", ","
+		f.CommentOpen, f.CommentClose = " /*", "*/"
+	}
+	if conn.Options.LineComments {
+		f.CommentOpen, f.CommentClose = "-- ", ""
+		f.LineComments = true
+	}
+	if conn.Options.PrettyPrint {
+		f.Comma = ",\n\t"
+		f.Open, f.Close = "(\n\t", "\n)"
+	}
+	return f
+}
+
+// list returns items separated and enclosed according to f.
+func (f layout) list(items string) string {
+	return f.Open + strings.TrimSuffix(items, f.Comma) + f.Close
+}
+
+// appendItem appends item to the list being built in b, separated from any
+// previous item as by list.
+func (f layout) appendItem(b *strings.Builder, item string) {
+	if b.Len() > 0 {
+		b.WriteString(f.Comma)
+	}
+	b.WriteString(item)
+}
+
+// commentList returns items separated and enclosed for use in a comment.
+func (f layout) commentList(items string) string {
+	return "(" + strings.TrimSuffix(items, f.CommentComma) + ")"
+}
+
+// lineCommentReplacer escapes line breaks, which would otherwise end a line
+// comment early.
+var lineCommentReplacer = strings.NewReplacer("\r", `\r`, "\n", `\n`)
+
+// statement returns stmt terminated and followed by a newline, with any
+// comments joined and placed according to f.
+func (f layout) statement(stmt string, comments ...string) string {
+	if len(comments) == 0 {
+		return stmt + f.Terminator + "\n"
+	}
+	comment := strings.Join(comments, "; ")
+	if f.LineComments {
+		return f.CommentOpen + lineCommentReplacer.Replace(comment) +
+			"\n" + stmt + f.Terminator + "\n"
+	}
+	return stmt + f.CommentOpen + comment + f.CommentClose +
+		f.Terminator + "\n"
+}
+
+func (conn _Conn) buildInsert(c change) (string, error) {
+	const INSERTF = `INSERT INTO %s %s VALUES %s`
+	const DEFAULTF = `INSERT INTO %s DEFAULT VALUES`
+	f := conn.layout()
+	// INSERTs are the most common change, so their lists are built
+	// without the intermediate strings of concatenation.
+	var cols, vals strings.Builder
+	var conf string
+	for i, col := range c.Columns {
+		if i == 0 && c.Rowid && !conn.Options.IncludeRowid {
+			continue
 		}
+		v := c.New[i]
+		// A column defined as NULL is inserted as NULL, rather than
+		// left to its default.
 		if v.IsNil() {
+			if c.PK[i] {
+				// Never skip a PK column, as the inserted row
+				// would not have a valid key.
+				return "", fmt.Errorf("sqlitechangeset: "+
+					"INSERT INTO %q: undefined value for "+
+					"PRIMARY KEY column %q", c.Table, col.Name)
+			}
+			defined := conn.Options.insertColumns[c.Table]
+			if i < len(defined) && defined[i] {
+				// Another INSERT into the table defines the column.
+				f.appendItem(&cols, quoteIdentifier(col.Name))
+				f.appendItem(&vals, conn.nullString(col))
+			}
 			continue
 		}
-		cols += fmt.Sprintf(_COLUMNF+_COMMA, name)
-		vals += valueString(v) + _COMMA
-		if !conflict {
+		f.appendItem(&cols, quoteIdentifier(col.Name))
+		f.appendItem(&vals, conn.setParam(col, v))
+		if c.Conflict == nil {
 			continue
 		}
-		v, err = iter.Conflict(i)
+		conf += conn.valueString(col, c.Conflict[i]) + f.CommentComma
+	}
+	var comments []string
+	if conn.undoComments() {
+		comments = append(comments, "undo of DELETE")
+	}
+	if conn.Options.GeneratedColumnComments {
+		gen, err := conn.generatedComment(c.Table)
 		if err != nil {
 			return "", err
 		}
-		conf += valueString(v) + _COMMA
+		if gen != "" {
+			comments = append(comments, gen)
+		}
 	}
-	cols = strings.TrimSuffix(cols, _COMMA)
-	vals = strings.TrimSuffix(vals, _COMMA)
-	if conflict {
-		conf = strings.TrimSuffix(conf, _COMMA)
-		conf = fmt.Sprintf(` /* conflict: (%s) */`, conf)
+	if c.Conflict != nil {
+		comments = append(comments, "conflict: "+f.commentList(conf))
 	}
-	return fmt.Sprintf(INSERTF, tbl, cols, vals, conf), nil
+	if cols.Len() == 0 {
+		// "INSERT INTO t () VALUES ()" is invalid.
+		return f.statement(fmt.Sprintf(DEFAULTF, quoteIdentifier(c.Table)),
+			comments...), nil
+	}
+	return f.statement(fmt.Sprintf(INSERTF, quoteIdentifier(c.Table),
+		f.Open+cols.String()+f.Close, f.Open+vals.String()+f.Close),
+		comments...), nil
 }
 
-func buildUpdate(iter sqlite.ChangesetIter,
-	tbl string, names []string, conflict bool) (string, error) {
-	const UPDATEF = `UPDATE %q SET (%s) = (%s) WHERE (%s) = (%s) /* old: (%s) %s*/;
-`
-	pk, err := iter.PK()
-	if err != nil {
-		return "", err
-	}
+func (conn _Conn) buildUpdate(c change) (string, error) {
+	const UPDATEF = `UPDATE %s SET %s = %s WHERE %s = %s%s`
+	const UPSERTF = `INSERT INTO %s %s VALUES %s ON CONFLICT %s DO UPDATE SET %s = %s%s`
+	f := conn.layout()
 	var setCols, setVals, oldVals, pkCols, pkVals, conf string
-	for i, name := range names {
-		vOld, err := iter.Old(i)
-		if err != nil {
-			return "", err
+	var guardCols, guardVals, excluded, transitions string
+	var pkChanged, oldDefined bool
+	for i, col := range c.Columns {
+		vOld := c.Old[i]
+		if c.PK[i] {
+			pkCols += quoteIdentifier(col.Name) + f.Comma
+			pkVals += conn.param(col, vOld) + f.Comma
+			// The row is identified by its old PK values, but a new
+			// PK value must still be set.
+			if c.New[i].IsNil() || sameValue(vOld, c.New[i]) {
+				continue
+			}
+			pkChanged = true
 		}
-		if pk[i] {
-			pkCols += fmt.Sprintf(_COLUMNF, name) + _COMMA
-			pkVals += valueString(vOld) + _COMMA
+		// An undefined value is left unchanged, while a value
+		// defined as NULL is set.
+		vNew := c.New[i]
+		guarded := !c.PK[i] && !vOld.IsNil() &&
+			(conn.Options.GuardWithOldRow ||
+				conn.Options.GuardWithOldValues && !vNew.IsNil())
+		if vNew.IsNil() {
+			if guarded {
+				guardCols += quoteIdentifier(col.Name) + f.Comma
+				guardVals += conn.param(col, vOld) + f.Comma
+			}
 			continue
 		}
-		vNew, err := iter.New(i)
-		if err != nil {
-			return "", err
+		setCols += quoteIdentifier(col.Name) + f.Comma
+		setVals += conn.setParam(col, vNew) + f.Comma
+		oldVals += conn.valueString(col, vOld) + f.CommentComma
+		transitions += quoteIdentifier(col.Name) + ": "
+		if !vOld.IsNil() {
+			transitions += conn.valueString(col, vOld) + " -> "
 		}
-		if vNew.IsNil() {
-			continue
+		transitions += conn.valueString(col, vNew) + f.CommentComma
+		oldDefined = oldDefined || !vOld.IsNil()
+		excluded += "excluded." + quoteIdentifier(col.Name) + f.Comma
+		if guarded {
+			guardCols += quoteIdentifier(col.Name) + f.Comma
+			guardVals += conn.param(col, vOld) + f.Comma
 		}
-		setCols += fmt.Sprintf(_COLUMNF, name) + _COMMA
-		setVals += valueString(vNew) + _COMMA
-		oldVals += valueString(vOld) + _COMMA
-		if !conflict {
+		if c.Conflict == nil {
 			continue
 		}
-		v, err := iter.Conflict(i)
-		if err != nil {
-			return "", err
-		}
-		conf += valueString(v) + _COMMA
+		conf += conn.valueString(col, c.Conflict[i]) + f.CommentComma
 
 	}
-	setCols = strings.TrimSuffix(setCols, _COMMA)
-	setVals = strings.TrimSuffix(setVals, _COMMA)
-	oldVals = strings.TrimSuffix(oldVals, _COMMA)
-	pkCols = strings.TrimSuffix(pkCols, _COMMA)
-	pkVals = strings.TrimSuffix(pkVals, _COMMA)
-	if conflict {
-		conf = strings.TrimSuffix(conf, _COMMA)
-		conf = fmt.Sprintf(`conflict: (%s) `, conf)
+	label := "old"
+	if conn.undoComments() {
+		label = "undo of UPDATE to"
+	}
+	var comments []string
+	switch {
+	case conn.Options.ColumnTransitions:
+		if conn.undoComments() {
+			transitions = "undo of UPDATE: " + transitions
+		}
+		comments = append(comments,
+			strings.TrimSuffix(transitions, f.CommentComma))
+	case oldDefined:
+		// A patchset does not hold old values.
+		comments = append(comments,
+			fmt.Sprintf("%s: %s", label, f.commentList(oldVals)))
+	}
+	if c.Conflict != nil {
+		comments = append(comments, "conflict: "+f.commentList(conf))
 	}
-	return fmt.Sprintf(UPDATEF, tbl, setCols, setVals, pkCols, pkVals, oldVals, conf), nil
+	guardOp := " AND"
+	if conn.Options.UpdateAsUpsert {
+		guardOp = " WHERE"
+	}
+	var guard string
+	if guardCols != "" {
+		guard = fmt.Sprintf(`%s %s IS %s`, guardOp,
+			f.list(guardCols), f.list(guardVals))
+	}
+	if pkChanged && conn.Options.PKUpdateAsDeleteInsert {
+		return conn.buildPKUpdateAsDeleteInsert(c,
+			f.list(pkCols), f.list(pkVals)), nil
+	}
+	if conn.Options.UpdateAsUpsert && !pkChanged {
+		return f.statement(fmt.Sprintf(UPSERTF, quoteIdentifier(c.Table),
+			f.list(pkCols+setCols), f.list(pkVals+setVals),
+			f.list(pkCols), f.list(setCols), f.list(excluded),
+			guard), comments...), nil
+	}
+	return f.statement(fmt.Sprintf(UPDATEF, quoteIdentifier(c.Table),
+		f.list(setCols), f.list(setVals),
+		f.list(pkCols), f.list(pkVals), guard+conn.limit()), comments...), nil
 }
 
-func buildDelete(iter sqlite.ChangesetIter,
-	tbl string, names []string, conflict bool) (string, error) {
-	const DELETEF = `DELETE FROM %q WHERE (%s) = (%s) /* (%s) = (%s) %s*/;
-`
-	pk, err := iter.PK()
-	if err != nil {
-		return "", err
+// buildPKUpdateAsDeleteInsert renders an UPDATE which changes the PK of a row
+// as a DELETE of the old row followed by an INSERT of the new row, so that
+// the two rows never exist at once. The new row is rebuilt from the new
+// values of the change, or else its old values. A changeset does not hold
+// the values of unchanged columns, so if any are undefined, the old row is
+// first copied into a temporary table, from which they are inserted.
+func (conn _Conn) buildPKUpdateAsDeleteInsert(c change,
+	pkCols, pkVals string) string {
+	const COPYF = `CREATE TEMP TABLE %s AS SELECT * FROM %s WHERE %s = %s`
+	const DELETEF = `DELETE FROM %s WHERE %s = %s`
+	const INSERTF = `INSERT INTO %s %s VALUES %s`
+	const INSERT_COPYF = `INSERT INTO %s %s SELECT %s FROM %s`
+	const DROPF = `DROP TABLE %s`
+	f := conn.layout()
+	var cols, vals string
+	var copied bool
+	for i, col := range c.Columns {
+		cols += quoteIdentifier(col.Name) + f.Comma
+		v := c.New[i]
+		if v.IsNil() {
+			v = c.Old[i]
+		}
+		if v.IsNil() {
+			vals += quoteIdentifier(col.Name) + f.Comma
+			copied = true
+			continue
+		}
+		vals += conn.setParam(col, v) + f.Comma
+	}
+	tbl := quoteIdentifier(c.Table)
+	del := f.statement(fmt.Sprintf(DELETEF, tbl, pkCols, pkVals) +
+		conn.limit())
+	if !copied {
+		return del + f.statement(fmt.Sprintf(INSERTF, tbl,
+			f.list(cols), f.list(vals)))
 	}
+	tmp := "temp." + quoteIdentifier(_PK_UPDATE_TABLE)
+	return f.statement(fmt.Sprintf(COPYF, tmp, tbl, pkCols, pkVals)) + del +
+		f.statement(fmt.Sprintf(INSERT_COPYF, tbl, f.list(cols),
+			strings.TrimSuffix(vals, f.Comma), tmp)) +
+		f.statement(fmt.Sprintf(DROPF, tmp))
+}
+
+func (conn _Conn) buildDelete(c change) (string, error) {
+	const DELETEF = `DELETE FROM %s WHERE %s = %s`
+	f := conn.layout()
 	var pkCols, pkVals string
 	var oldCols, oldVals string
+	var guardCols, guardVals string
 	var conf string
-	for i, name := range names {
-		v, err := iter.Old(i)
-		if err != nil {
-			return "", err
-		}
-		if pk[i] {
-			pkCols += fmt.Sprintf(_COLUMNF, name) + _COMMA
-			pkVals += valueString(v) + _COMMA
+	for i, col := range c.Columns {
+		v := c.Old[i]
+		if c.PK[i] {
+			pkCols += quoteIdentifier(col.Name) + f.Comma
+			pkVals += conn.param(col, v) + f.Comma
 			continue
 		}
-		oldCols += fmt.Sprintf(_COLUMNF, name) + _COMMA
-		oldVals += valueString(v) + _COMMA
-		if !conflict {
+		if c.Conflict != nil {
+			conf += conn.valueString(col, c.Conflict[i]) + f.CommentComma
+		}
+		// A patchset does not hold old values.
+		if v.IsNil() {
 			continue
 		}
-		v, err = iter.Conflict(i)
+		oldCols += quoteIdentifier(col.Name) + f.CommentComma
+		oldVals += conn.valueString(col, v) + f.CommentComma
+		if conn.Options.GuardWithOldRow {
+			guardCols += quoteIdentifier(col.Name) + f.Comma
+			guardVals += conn.param(col, v) + f.Comma
+		}
+
+	}
+	var label string
+	if conn.undoComments() {
+		label = "undo of INSERT: "
+	}
+	var comments []string
+	if oldCols != "" {
+		comments = append(comments, fmt.Sprintf("%s%s = %s", label,
+			f.commentList(oldCols), f.commentList(oldVals)))
+	} else if label != "" {
+		comments = append(comments, strings.TrimSuffix(label, ": "))
+	}
+	if c.Conflict != nil {
+		comments = append(comments, "conflict: "+f.commentList(conf))
+	}
+	var guard string
+	if guardCols != "" {
+		guard = fmt.Sprintf(` AND %s IS %s`,
+			f.list(guardCols), f.list(guardVals))
+	}
+	return f.statement(fmt.Sprintf(DELETEF, quoteIdentifier(c.Table),
+		f.list(pkCols), f.list(pkVals))+guard+conn.limit(), comments...), nil
+}
+
+// limit returns the LIMIT clause of UPDATE and DELETE statements, if any.
+func (conn _Conn) limit() string {
+	if conn.Options.LimitOne {
+		return " LIMIT 1"
+	}
+	return ""
+}
+
+// buildSourceWins resolves a conflict in favor of c by deleting the
+// conflicting row and then, unless c is a DELETE, inserting the row as c
+// leaves it. The columns not set by an UPDATE keep their conflicting values.
+func (conn _Conn) buildSourceWins(c change) (string, error) {
+	del := c
+	del.Op, del.Old, del.New, del.Conflict =
+		sqlite.SQLITE_DELETE, c.Conflict, nil, nil
+	sql, err := conn.buildDelete(del)
+	if err != nil || c.Op == sqlite.SQLITE_DELETE {
+		return sql, err
+	}
+	ins := c
+	ins.Op, ins.Old, ins.Conflict = sqlite.SQLITE_INSERT, nil, nil
+	if c.Op == sqlite.SQLITE_UPDATE {
+		ins.New = make([]sqlite.Value, len(c.New))
+		for i, v := range c.New {
+			if v.IsNil() {
+				v = c.Conflict[i]
+			}
+			ins.New[i] = v
+		}
+	}
+	insert, err := conn.buildInsert(ins)
+	if err != nil {
+		return "", err
+	}
+	return sql + insert, nil
+}
+
+// undoComments returns true if comments should describe statements as undoing
+// the original change.
+func (conn _Conn) undoComments() bool {
+	return conn.Options.Invert || conn.Options.UndoComments
+}
+
+// valueString returns the SQL literal of val, a value of col.
+func (conn _Conn) valueString(col ColumnInfo, val sqlite.Value) string {
+	if masked, ok := conn.mask(col, val); ok {
+		return masked
+	}
+	lit := conn.literal(col, val)
+	if conn.Options.CastValues && !val.IsNil() && !isNull(val) {
+		if affinity := TypeAffinity(col.Type); affinity != AffinityBlob {
+			return fmt.Sprintf("CAST(%s AS %s)", lit, affinity)
+		}
+	}
+	return lit
+}
+
+// param returns the SQL for val, a value of col, within a statement. If
+// parameters are being collected, val is appended to them and a numbered
+// parameter is returned in place of its literal. Numbered parameters allow
+// a value to appear in a statement out of the order it was collected.
+//
+// BLOBs are always rendered as literals, which need no escaping, because
+// sqlite.Stmt.BindBytes binds them as TEXT.
+func (conn _Conn) param(col ColumnInfo, val sqlite.Value) string {
+	if _, masked := conn.mask(col, val); masked ||
+		conn.params == nil || !val.IsNil() &&
+		(val.Type() == sqlite.SQLITE_BLOB ||
+			val.Type() == sqlite.SQLITE_TEXT && AlwaysUseBlob) {
+		return conn.valueString(col, val)
+	}
+	*conn.params = append(*conn.params, goValue(val))
+	return fmt.Sprintf("?%d", len(*conn.params))
+}
+
+// setParam is like param, for a value which is set by an INSERT or UPDATE,
+// which is wrapped in json() if col is a JSONColumns column.
+func (conn _Conn) setParam(col ColumnInfo, val sqlite.Value) string {
+	sql := conn.param(col, val)
+	if conn.Options.JSONColumns != nil && !val.IsNil() &&
+		val.Type() == sqlite.SQLITE_TEXT &&
+		conn.Options.JSONColumns(conn.table, col) {
+		if _, masked := conn.mask(col, val); !masked {
+			return "json(" + sql + ")"
+		}
+	}
+	return sql
+}
+
+// mask returns the SQL which replaces val, a value of col, if it is changed
+// by the ValueTransforms or masked by the MaskValue hook.
+func (conn _Conn) mask(col ColumnInfo, val sqlite.Value) (string, bool) {
+	if val.IsNil() {
+		return "", false
+	}
+	if len(conn.Options.ValueTransforms) > 0 {
+		v, changed, err := conn.transform(col, val)
 		if err != nil {
-			return "", err
+			// The error is returned once the change is built.
+			if conn.transformErr != nil && *conn.transformErr == nil {
+				*conn.transformErr = err
+			}
+			return "NULL", true
+		}
+		if changed {
+			return conn.transformedLiteral(col, v), true
 		}
-		conf += valueString(v) + _COMMA
+	}
+	if conn.Options.MaskValue == nil {
+		return "", false
+	}
+	return conn.Options.MaskValue(conn.table, col.Name, val)
+}
 
+// literal returns the SQL literal of val, a value of col.
+func (conn _Conn) literal(col ColumnInfo, val sqlite.Value) string {
+	if conn.Options.FormatNull != nil && isNull(val) {
+		return conn.Options.FormatNull(TypeAffinity(col.Type))
 	}
-	pkCols = strings.TrimSuffix(pkCols, _COMMA)
-	pkVals = strings.TrimSuffix(pkVals, _COMMA)
-	oldCols = strings.TrimSuffix(oldCols, _COMMA)
-	oldVals = strings.TrimSuffix(oldVals, _COMMA)
-	if conflict {
-		conf = strings.TrimSuffix(conf, _COMMA)
-		conf = fmt.Sprintf(`conflict: (%s) `, conf)
+	if conn.Options.BooleanLiterals && col.IsBoolean() &&
+		!val.IsNil() && val.Type() == sqlite.SQLITE_INTEGER {
+		switch val.Int64() {
+		case 0:
+			return "FALSE"
+		case 1:
+			return "TRUE"
+		}
+	}
+	if (conn.Options.WholeFloatsAsReal || conn.Options.FloatPrecision > 0) &&
+		!val.IsNil() && val.Type() == sqlite.SQLITE_FLOAT {
+		return conn.formatFloat(val.Float())
+	}
+	if conn.Options.EscapeText != nil && !AlwaysUseBlob &&
+		!val.IsNil() && val.Type() == sqlite.SQLITE_TEXT {
+		return conn.Options.EscapeText(val.Text())
+	}
+	return valueString(val)
+}
+
+// formatFloat returns the SQL literal of f with the FloatPrecision and
+// WholeFloatsAsReal Options.
+func (conn _Conn) formatFloat(f float64) string {
+	prec := -1
+	if conn.Options.FloatPrecision > 0 {
+		prec = conn.Options.FloatPrecision
+	}
+	s := strconv.FormatFloat(f, 'g', prec, 64)
+	if conn.Options.WholeFloatsAsReal && !strings.ContainsAny(s, ".eIN") {
+		// The float has no fractional part or exponent.
+		s += ".0"
+	}
+	return s
+}
+
+// nullString returns the SQL for a NULL value of col.
+func (conn _Conn) nullString(col ColumnInfo) string {
+	if conn.Options.FormatNull != nil {
+		return conn.Options.FormatNull(TypeAffinity(col.Type))
 	}
-	return fmt.Sprintf(DELETEF, tbl, pkCols, pkVals, oldCols, oldVals, conf), nil
+	return "NULL"
 }
 
 func valueString(val sqlite.Value) string {
@@ -286,12 +1977,13 @@ func valueString(val sqlite.Value) string {
 	valType := val.Type()
 	switch valType {
 	case sqlite.SQLITE_INTEGER:
-		return fmt.Sprintf("%v", val.Int64())
+		return strconv.FormatInt(val.Int64(), 10)
 	case sqlite.SQLITE_FLOAT:
-		return fmt.Sprintf("%v", val.Float())
+		// The same as fmt's %v, without its allocations.
+		return strconv.FormatFloat(val.Float(), 'g', -1, 64)
 	case sqlite.SQLITE_TEXT:
 		if !AlwaysUseBlob {
-			return fmt.Sprintf("'%v'", strings.ReplaceAll(val.Text(), "'", "''"))
+			return QuoteText(val.Text())
 		}
 		fallthrough
 	case sqlite.SQLITE_BLOB:
@@ -303,20 +1995,145 @@ func valueString(val sqlite.Value) string {
 	}
 }
 
-func (conn _Conn) GetColNames(tbl string) ([]string, error) {
-	const TABLE_INFOF = `PRAGMA TABLE_INFO("%s");`
-	colNames, ok := conn.ColumnNames[tbl]
-	if ok {
-		return colNames, nil
+// isNull returns true if val is defined as NULL. A value which a change leaves
+// undefined, such as an unchanged column of an UPDATE or any column but the
+// primary key of a DELETE in a patchset, IsNil instead, and must not be
+// rendered as NULL: an UPDATE leaves it unchanged, and an INSERT leaves it to
+// the default of the column.
+func isNull(val sqlite.Value) bool {
+	return !val.IsNil() && val.Type() == sqlite.SQLITE_NULL
+}
+
+// sameValue returns true if a and b have the same type and value.
+func sameValue(a, b sqlite.Value) bool {
+	return a.Type() == b.Type() && valueString(a) == valueString(b)
+}
+
+// QuoteText returns s as an SQL string literal, enclosed in single quotes with
+// any single quotes within s doubled.
+func QuoteText(s string) string {
+	return fmt.Sprintf("'%v'", strings.ReplaceAll(s, "'", "''"))
+}
+
+// quoteIdentifier returns s as an SQL identifier, enclosed in double quotes
+// with any double quotes within s doubled.
+func quoteIdentifier(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// goValue returns the Go equivalent of val: an int64, float64, string,
+// []byte, or nil for NULL and undefined values.
+func goValue(val sqlite.Value) interface{} {
+	if val.IsNil() {
+		return nil
+	}
+	switch val.Type() {
+	case sqlite.SQLITE_INTEGER:
+		return val.Int64()
+	case sqlite.SQLITE_FLOAT:
+		return val.Float()
+	case sqlite.SQLITE_TEXT:
+		return val.Text()
+	case sqlite.SQLITE_BLOB:
+		return val.Blob()
+	default:
+		return nil
 	}
-	err := sqlitex.Exec(conn.Conn, fmt.Sprintf(TABLE_INFOF, tbl),
+}
+
+// ColumnInfo describes a column of a table as reported by PRAGMA
+// TABLE_INFO.
+type ColumnInfo struct {
+	Name string
+	// Type is the declared type of the column, which may be empty.
+	Type string
+	// PK is the 1-based position of the column within the primary key,
+	// or 0 if the column is not part of the primary key.
+	PK int
+	// NotNull is true if the column has a NOT NULL constraint.
+	NotNull bool
+}
+
+// IsBoolean returns true if the declared type of col is BOOL or BOOLEAN.
+func (col ColumnInfo) IsBoolean() bool {
+	return strings.HasPrefix(strings.ToUpper(col.Type), "BOOL")
+}
+
+// TableColumns returns the columns of tbl in the database connected to by
+// conn.
+func TableColumns(conn *sqlite.Conn, tbl string) ([]ColumnInfo, error) {
+	// conn caches the statement prepared for each table, which
+	// BenchmarkTableColumns shows is faster than binding the table name
+	// to a single pragma_table_info statement.
+	const TABLE_INFOF = `PRAGMA TABLE_INFO(%s);`
+	var cols []ColumnInfo
+	err := sqlitex.Exec(conn, fmt.Sprintf(TABLE_INFOF, quoteIdentifier(tbl)),
 		func(stmt *sqlite.Stmt) error {
-			colNames = append(colNames, stmt.ColumnText(1))
+			cols = append(cols, ColumnInfo{
+				Name:    stmt.ColumnText(1),
+				Type:    stmt.ColumnText(2),
+				NotNull: stmt.ColumnInt(3) != 0,
+				PK:      stmt.ColumnInt(5),
+			})
 			return nil
 		})
+	if err == nil {
+		err = checkNotView(conn, tbl)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying columns for table %q: %w", tbl, err)
+	}
+	return cols, nil
+}
+
+// ErrView is returned when a changeset references a view. PRAGMA TABLE_INFO
+// reports the columns of a view like those of a table, but statements against
+// a view only succeed through INSTEAD OF triggers, whose effects cannot be
+// known from the changeset.
+var ErrView = fmt.Errorf("sqlitechangeset: changeset table is a view")
+
+// checkNotView returns ErrView if tbl is a view in the main or temp schema.
+func checkNotView(conn *sqlite.Conn, tbl string) error {
+	const TYPEQ = `SELECT type FROM sqlite_master WHERE name = ?1 COLLATE NOCASE
+UNION ALL
+SELECT type FROM sqlite_temp_master WHERE name = ?1 COLLATE NOCASE;`
+	var isView bool
+	err := sqlitex.Exec(conn, TYPEQ, func(stmt *sqlite.Stmt) error {
+		isView = isView || stmt.ColumnText(0) == "view"
+		return nil
+	}, tbl)
+	if err != nil {
+		return err
+	}
+	if isView {
+		return ErrView
+	}
+	return nil
+}
+
+// GetColumns returns the columns of tbl, caching the result for subsequent
+// calls.
+func (conn _Conn) GetColumns(tbl string) ([]ColumnInfo, error) {
+	cols, ok := conn.Columns[tableKey(tbl)]
+	if ok {
+		return cols, nil
+	}
+	if conn.Options.cachedOnly {
+		return nil, fmt.Errorf("sqlitechangeset: "+
+			"columns of table %q were not loaded", tbl)
+	}
+	cols, err := TableColumns(conn.Conn, tbl)
 	if err != nil {
 		return nil, err
 	}
-	conn.ColumnNames[tbl] = colNames
-	return colNames, nil
+	conn.Options.logf("loaded %d columns of table %q", len(cols), tbl)
+	conn.Columns[tableKey(tbl)] = cols
+	return cols, nil
+}
+
+// tableKey returns the key of tbl in the caches of columns and foreign keys.
+// Table names are case-insensitive, so a table is cached once however a
+// changeset or caller spells its name.
+func tableKey(tbl string) string {
+	return strings.ToLower(tbl)
 }
@@ -22,9 +22,22 @@ package sqlitechangeset
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"go/format"
 	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
@@ -134,3 +147,3697 @@ func createChangeset(t *testing.T) (*sqlite.Conn, *sqlite.Session, io.Reader) {
 
 	return conn, inverseSess, &changesetRet
 }
+
+func TestOptionsPrologueEpilogue(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	opts := Options{
+		Prologue: "PRAGMA foreign_keys=OFF;\n",
+		Epilogue: "PRAGMA foreign_keys=ON;\n",
+	}
+	sql, err := opts.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.True(strings.HasPrefix(sql, opts.Prologue))
+	require.True(strings.HasSuffix(sql, opts.Epilogue))
+	require.NoError(sqlitex.ExecScript(conn, sql))
+}
+
+func TestOptionsRowFilter(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	opts := Options{RowFilter: func(tbl string, pk map[string]interface{}) bool {
+		return tbl == "t" && pk["a"].(int64) >= 3
+	}}
+	sql, err := opts.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "t" ("a", "b", "c", "d") VALUES (3, 3, 'goodbye world', NULL);
+INSERT INTO "t" ("a", "b", "c", "d") VALUES (4, 4, 'goodbye world''', NULL);
+DELETE FROM "t" WHERE ("a", "b") = (5, 5) /* ("c", "d") = ('world', 1.5) */;
+`, sql)
+}
+
+func TestOptionsTransactionPerTable(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	sql, err := Options{TransactionPerTable: true}.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.True(strings.HasPrefix(sql, "SAVEPOINT \"t\";\n"))
+	require.Contains(sql, "RELEASE \"t\";\n\nSAVEPOINT \"t2\";\n")
+	require.True(strings.HasSuffix(sql, "RELEASE \"t2\";\n"))
+	require.NoError(sqlitex.ExecScript(conn, sql))
+
+	empty := &bytes.Buffer{}
+	require.NoError(sess.Changeset(empty))
+	require.Empty(empty.Bytes())
+}
+
+func TestOptionsProgress(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var progress []int
+	opts := Options{
+		Progress:         func(n int) { progress = append(progress, n) },
+		ProgressInterval: 3,
+	}
+	_, err := opts.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Equal([]int{3, 6, 8}, progress)
+
+	// Completion is reported even when no change was read.
+	progress = nil
+	_, err = opts.ToSQL(conn, &bytes.Buffer{})
+	require.NoError(err, "Options.ToSQL")
+	require.Equal([]int{0}, progress)
+}
+
+func TestTextQuoting(t *testing.T) {
+	texts := []string{
+		`'`,
+		``,
+		`''`,
+		`'hello`,
+		`hello'`,
+		`'hello'`,
+		`it's a 'test'`,
+	}
+	testTextRoundTrip(t, texts)
+}
+
+// testTextRoundTrip inserts each text into a fresh table, converts the
+// resulting changeset to SQL, applies the SQL to another fresh table and
+// ensures the texts read back are identical.
+func testTextRoundTrip(t *testing.T, texts []string) {
+	require := require.New(t)
+	const schema = `CREATE TABLE q (id INTEGER PRIMARY KEY, s TEXT);`
+
+	src, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer src.Close()
+	require.NoError(sqlitex.ExecScript(src, schema))
+	sess, err := src.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	for i, text := range texts {
+		require.NoError(sqlitex.Exec(src,
+			`INSERT INTO q (id, s) VALUES (?, ?);`, nil, i, text))
+	}
+
+	sql, err := SessionToSQL(src, sess)
+	require.NoError(err, "SessionToSQL")
+
+	dst, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer dst.Close()
+	require.NoError(sqlitex.ExecScript(dst, schema))
+	require.NoError(sqlitex.ExecScript(dst, sql), sql)
+
+	var got []string
+	require.NoError(sqlitex.Exec(dst, `SELECT s FROM q ORDER BY id;`,
+		func(stmt *sqlite.Stmt) error {
+			got = append(got, stmt.ColumnText(0))
+			return nil
+		}))
+	require.Equal(texts, got)
+}
+
+func TestOptionsGuardWithOldValues(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	sql, err := Options{GuardWithOldValues: true}.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, `UPDATE "t" SET ("c", "d") = ('world hello', 5.25) WHERE ("a", "b") = (2, 2) AND ("c", "d") IS ('world', 1.5) /* old: ('world', 1.5) */;`)
+
+	// Diverge the target row so that the guarded UPDATE does not apply.
+	require.NoError(sqlitex.ExecScript(conn,
+		`UPDATE t SET d = 2.5 WHERE a = 2 AND b = 2;`))
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	var c string
+	require.NoError(sqlitex.Exec(conn, `SELECT c FROM t WHERE a = 2;`,
+		func(stmt *sqlite.Stmt) error {
+			c = stmt.ColumnText(0)
+			return nil
+		}))
+	require.Equal("world", c)
+}
+
+func TestOptionsGuardWithOldRow(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	sql, err := Options{GuardWithOldRow: true}.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, `UPDATE "t" SET ("c", "d") = ('world hello', 5.25) WHERE ("a", "b") = (2, 2) AND ("c", "d") IS ('world', 1.5) /* old: ('world', 1.5) */;`)
+	require.Contains(sql, `DELETE FROM "t" WHERE ("a", "b") = (5, 5) AND ("c", "d") IS ('world', 1.5) /* ("c", "d") = ('world', 1.5) */;`)
+	require.Contains(sql, `DELETE FROM "t2" WHERE ("a") = (1) AND ("b") IS (X'01FF') /* ("b") = (X'01FF') */;`)
+
+	// Diverge the target rows so that the guarded UPDATE and DELETE do
+	// not apply.
+	require.NoError(sqlitex.ExecScript(conn,
+		`UPDATE t SET d = 2.5 WHERE a IN (2, 5);`))
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	var c string
+	require.NoError(sqlitex.Exec(conn, `SELECT c FROM t WHERE a = 2;`,
+		func(stmt *sqlite.Stmt) error {
+			c = stmt.ColumnText(0)
+			return nil
+		}))
+	require.Equal("world", c)
+	var n int64
+	require.NoError(sqlitex.Exec(conn, `SELECT count(*) FROM t WHERE a = 5;`,
+		func(stmt *sqlite.Stmt) error {
+			n = stmt.ColumnInt64(0)
+			return nil
+		}))
+	require.Equal(int64(1), n)
+	require.NoError(sqlitex.Exec(conn, `SELECT count(*) FROM t2 WHERE a > 0;`,
+		func(stmt *sqlite.Stmt) error {
+			n = stmt.ColumnInt64(0)
+			return nil
+		}))
+	require.Equal(int64(0), n)
+
+	// An old value is guarded even if its column is not set.
+	var cs testChangeset
+	cs.Table("t", true, true, false, false)
+	cs.Change(sqlite.SQLITE_UPDATE,
+		[]interface{}{int64(1), int64(1), "hello", 1.5},
+		[]interface{}{nil, nil, "bye", nil})
+	sql, err = Options{GuardWithOldRow: true}.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`UPDATE "t" SET ("c") = ('bye') WHERE ("a", "b") = (1, 1) AND ("c", "d") IS ('hello', 1.5) /* old: ('hello') */;
+`, sql)
+	sql, err = Options{GuardWithOldValues: true}.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`UPDATE "t" SET ("c") = ('bye') WHERE ("a", "b") = (1, 1) AND ("c") IS ('hello') /* old: ('hello') */;
+`, sql)
+}
+
+func TestOptionsAnnotateSections(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	sql, err := Options{AnnotateSections: true}.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.True(strings.HasPrefix(sql, "-- Table: t (inserts)\n"))
+	require.Contains(sql, "-- Table: t (updates)\n")
+	require.Contains(sql, "-- Table: t (deletes)\n")
+	require.Contains(sql, "\n\n-- Table: t2 (inserts)\n")
+	require.NotContains(sql, "-- Table: t2 (updates)\n")
+	require.NoError(sqlitex.ExecScript(conn, sql))
+}
+
+func TestEmptyBlobAndNull(t *testing.T) {
+	require := require.New(t)
+	const schema = `CREATE TABLE q (id INTEGER PRIMARY KEY, b BLOB);`
+
+	src, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer src.Close()
+	require.NoError(sqlitex.ExecScript(src, schema))
+	sess, err := src.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(src, `
+                INSERT INTO q (id, b) VALUES (1, x'');
+                INSERT INTO q (id, b) VALUES (2, NULL);`))
+
+	sql, err := SessionToSQL(src, sess)
+	require.NoError(err, "SessionToSQL")
+	require.Contains(sql, `VALUES (1, X'')`)
+	require.Contains(sql, `VALUES (2, NULL)`)
+
+	dst, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer dst.Close()
+	require.NoError(sqlitex.ExecScript(dst, schema))
+	require.NoError(sqlitex.ExecScript(dst, sql))
+	var types []string
+	require.NoError(sqlitex.Exec(dst, `SELECT typeof(b) FROM q ORDER BY id;`,
+		func(stmt *sqlite.Stmt) error {
+			types = append(types, stmt.ColumnText(0))
+			return nil
+		}))
+	require.Equal([]string{"blob", "null"}, types)
+}
+
+func TestToSQLWithReport(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var buf bytes.Buffer
+	tee := io.TeeReader(changeset, &buf)
+	sql, report, err := ToSQLWithReport(conn, tee)
+	require.NoError(err, "ToSQLWithReport")
+	require.Equal(Report{Bytes: len(sql), Statements: 8, Tables: 2,
+		ChangesetBytes: int64(buf.Len())}, report)
+}
+
+func TestOptionsFormatNull(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	opts := Options{FormatNull: func(affinity Affinity) string {
+		return fmt.Sprintf("CAST(NULL AS %s)", affinity)
+	}}
+	sql, err := opts.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, `VALUES (3, 3, 'goodbye world', CAST(NULL AS REAL));`)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+}
+
+func TestTableColumns(t *testing.T) {
+	require := require.New(t)
+	conn, sess, _ := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	cols, err := TableColumns(conn, "t")
+	require.NoError(err, "TableColumns")
+	require.Equal([]ColumnInfo{
+		{Name: "a", Type: "INTEGER", PK: 1},
+		{Name: "b", Type: "INTEGER", PK: 2},
+		{Name: "c", Type: "TEXT"},
+		{Name: "d", Type: "DOUBLE"},
+	}, cols)
+}
+
+func TestOptionsBooleanLiterals(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn,
+		`CREATE TABLE f (id INTEGER PRIMARY KEY, ok BOOLEAN, n INTEGER);`))
+	sess, err := conn.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(conn, `
+                INSERT INTO f (id, ok, n) VALUES (1, 1, 1);
+                INSERT INTO f (id, ok, n) VALUES (2, 0, 0);`))
+
+	sql, err := Options{BooleanLiterals: true}.SessionToSQL(conn, sess)
+	require.NoError(err, "Options.SessionToSQL")
+	require.Contains(sql, `VALUES (1, TRUE, 1);`)
+	require.Contains(sql, `VALUES (2, FALSE, 0);`)
+}
+
+func TestDeleteIdempotent(t *testing.T) {
+	for _, opts := range []Options{{}, {GuardWithOldValues: true}} {
+		require := require.New(t)
+		conn, sess, changeset := createChangeset(t)
+		defer conn.Close()
+		defer sess.Delete()
+
+		sql, err := opts.ToSQL(conn, changeset)
+		require.NoError(err, "Options.ToSQL")
+
+		// Remove the rows before applying the DELETEs.
+		require.NoError(sqlitex.ExecScript(conn, `
+                        DELETE FROM t WHERE a = 5;
+                        DELETE FROM t2;`))
+		require.NoError(sqlitex.ExecScript(conn, sql))
+	}
+}
+
+func TestInsertWithoutRowIDCompositePK(t *testing.T) {
+	require := require.New(t)
+	const schema = `CREATE TABLE w (
+                        x TEXT,
+                        y INTEGER,
+                        z TEXT,
+                        PRIMARY KEY (x, y)
+                ) WITHOUT ROWID;`
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn, schema))
+	sess, err := conn.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(conn,
+		`INSERT INTO w (x, y) VALUES ('k', 1);`))
+
+	sql, err := SessionToSQL(conn, sess)
+	require.NoError(err, "SessionToSQL")
+	require.Equal(`INSERT INTO "w" ("x", "y", "z") VALUES ('k', 1, NULL);
+`, sql)
+}
+
+func TestCompositePKDeclarationOrder(t *testing.T) {
+	require := require.New(t)
+	// The PK is declared in the reverse of the column order, but columns
+	// and values are both listed in column order.
+	const schema = `CREATE TABLE r (
+                        a INTEGER,
+                        b TEXT,
+                        c TEXT,
+                        PRIMARY KEY (b, a)
+                );
+INSERT INTO r (a, b, c) VALUES (1, 'x', 'one'), (2, 'y', 'two');`
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn, schema))
+
+	cols, err := TableColumns(conn, "r")
+	require.NoError(err)
+	require.Equal(2, cols[0].PK)
+	require.Equal(1, cols[1].PK)
+
+	sess, err := conn.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(conn, `
+UPDATE r SET c = 'uno' WHERE a = 1;
+DELETE FROM r WHERE a = 2;`))
+
+	var changeset bytes.Buffer
+	require.NoError(sess.Changeset(&changeset))
+	sql, err := ToSQL(conn, bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "ToSQL")
+	require.Equal(`UPDATE "r" SET ("c") = ('uno') WHERE ("a", "b") = (1, 'x') /* old: ('one') */;
+DELETE FROM "r" WHERE ("a", "b") = (2, 'y') /* ("c") = ('two') */;
+`, sql)
+
+	// Undo the changes so that the changeset may be verified against the
+	// prior state.
+	undo, err := Options{Invert: true}.ToSQL(conn,
+		bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.NoError(sqlitex.ExecScript(conn, undo))
+	require.NoError(VerifyRoundTrip(conn, bytes.NewReader(changeset.Bytes())))
+}
+
+func TestOptionsInvert(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var forward bytes.Buffer
+	tee := io.TeeReader(changeset, &forward)
+	undo, err := Options{Invert: true}.ToSQL(conn, tee)
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(undo, `DELETE FROM "t" WHERE ("a", "b") = (3, 3) /* undo of INSERT: ("c", "d") = ('goodbye world', NULL) */;`)
+	require.Contains(undo, `UPDATE "t" SET ("c") = ('hello') WHERE ("a", "b") = (1, 1) /* undo of UPDATE to: ('hello world') */;`)
+	require.Contains(undo, `INSERT INTO "t" ("a", "b", "c", "d") VALUES (5, 5, 'world', 1.5) /* undo of DELETE */;`)
+
+	// The undo SQL must return the database to the state prior to the
+	// forward SQL, so that the forward SQL may be applied again.
+	sql, err := ToSQL(conn, &forward)
+	require.NoError(err, "ToSQL")
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	require.NoError(sqlitex.ExecScript(conn, undo))
+	require.NoError(sqlitex.ExecScript(conn, sql))
+
+	empty := &bytes.Buffer{}
+	require.NoError(sess.Changeset(empty))
+	require.Empty(empty.Bytes())
+}
+
+func TestOptionsNoGrouping(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var buf bytes.Buffer
+	report, err := Options{NoGrouping: true}.WriteSQL(&buf, conn, changeset)
+	require.NoError(err, "Options.WriteSQL")
+	sql := buf.String()
+	require.Equal(Report{Bytes: len(sql), Statements: 8, Tables: 2,
+		ChangesetBytes: report.ChangesetBytes}, report)
+	require.NotContains(sql, "\n\n")
+	require.NoError(sqlitex.ExecScript(conn, sql))
+
+	empty := &bytes.Buffer{}
+	require.NoError(sess.Changeset(empty))
+	require.Empty(empty.Bytes())
+}
+
+func TestOptionsAnalyzeThreshold(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var buf bytes.Buffer
+	tee := io.TeeReader(changeset, &buf)
+	opts := Options{AnalyzeThreshold: 8, AnalyzeOptimize: true}
+	sql, err := opts.ToSQL(conn, tee)
+	require.NoError(err, "Options.ToSQL")
+	require.True(strings.HasSuffix(sql, ";\nANALYZE;\nPRAGMA optimize;\n"))
+	require.NoError(sqlitex.ExecScript(conn, sql))
+
+	opts.AnalyzeThreshold = 9
+	sql, err = opts.ToSQL(conn, &buf)
+	require.NoError(err, "Options.ToSQL")
+	require.NotContains(sql, "ANALYZE;")
+}
+
+func TestOptionsUpdateAsUpsert(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	sql, err := Options{UpdateAsUpsert: true}.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, `INSERT INTO "t" ("a", "b", "c") VALUES (1, 1, 'hello world') ON CONFLICT ("a", "b") DO UPDATE SET ("c") = (excluded."c") /* old: ('hello') */;`)
+
+	// The UPDATE of a missing row creates it.
+	require.NoError(sqlitex.ExecScript(conn, `DELETE FROM t WHERE a = 1;`))
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	var c string
+	require.NoError(sqlitex.Exec(conn, `SELECT c FROM t WHERE a = 1;`,
+		func(stmt *sqlite.Stmt) error {
+			c = stmt.ColumnText(0)
+			return nil
+		}))
+	require.Equal("hello world", c)
+}
+
+func TestTableColumnsError(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+
+	done := make(chan struct{})
+	close(done)
+	conn.SetInterrupt(done)
+	_, err = TableColumns(conn, "t")
+	require.Error(err)
+	require.Contains(err.Error(), `querying columns for table "t": `)
+	require.Equal(sqlite.SQLITE_INTERRUPT, sqlite.ErrCode(errors.Unwrap(err)))
+}
+
+func TestOptionsEscapeText(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	opts := Options{EscapeText: func(s string) string {
+		return QuoteText(strings.ToUpper(s))
+	}}
+	sql, err := opts.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, `VALUES (4, 4, 'GOODBYE WORLD''', NULL);`)
+}
+
+func TestBlobTableRoundTrip(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	sql, err := Options{RowFilter: func(tbl string, _ map[string]interface{}) bool {
+		return tbl == "t2"
+	}}.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	// A session records an UPDATE of a PRIMARY KEY column as a DELETE of
+	// the old row and an INSERT of the new row.
+	require.Equal(`INSERT INTO "t2" ("a", "b") VALUES (0, X'FFFFFF');
+DELETE FROM "t2" WHERE ("a") = (1) /* ("b") = (X'01FF') */;
+DELETE FROM "t2" WHERE ("a") = (2) /* ("b") = (X'02FF') */;
+`, sql)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+
+	type row struct {
+		a int64
+		b []byte
+	}
+	var rows []row
+	require.NoError(sqlitex.Exec(conn, `SELECT a, b FROM t2 ORDER BY a;`,
+		func(stmt *sqlite.Stmt) error {
+			b := make([]byte, stmt.ColumnLen(1))
+			stmt.ColumnBytes(1, b)
+			rows = append(rows, row{stmt.ColumnInt64(0), b})
+			return nil
+		}))
+	require.Equal([]row{{0, []byte{0xff, 0xff, 0xff}}}, rows)
+}
+
+func TestUpdatePrimaryKey(t *testing.T) {
+	require := require.New(t)
+	conn, sess, _ := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	// A session never records an UPDATE of a PRIMARY KEY column, but a
+	// changeset may still contain one.
+	var cs testChangeset
+	cs.Table("t2", true, false)
+	cs.Change(sqlite.SQLITE_UPDATE,
+		[]interface{}{int64(1), []byte{0x01, 0xff}},
+		[]interface{}{int64(3), nil})
+
+	sql, err := ToSQL(conn, &cs.Buffer)
+	require.NoError(err, "ToSQL")
+	require.Equal(`UPDATE "t2" SET ("a") = (3) WHERE ("a") = (1) /* old: (1) */;
+`, sql)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	n, err := sqlitex.ResultInt(conn.Prep(`SELECT count(*) FROM t2 WHERE a = 3;`))
+	require.NoError(err)
+	require.Equal(1, n)
+}
+
+// testNull is a NULL value in a testChangeset, as opposed to nil which is an
+// undefined value.
+type testNull struct{}
+
+// testChangeset is a hand built changeset, for testing changes which a
+// session would never record.
+//
+// https://www.sqlite.org/src/file/ext/session/sqlite3session.h
+type testChangeset struct {
+	bytes.Buffer
+}
+
+// Table starts the changes for tbl, with the given PK flag for each column.
+func (cs *testChangeset) Table(tbl string, pk ...bool) {
+	cs.WriteByte('T')
+	cs.writeVarint(uint64(len(pk)))
+	for _, isPK := range pk {
+		if isPK {
+			cs.WriteByte(1)
+		} else {
+			cs.WriteByte(0)
+		}
+	}
+	cs.WriteString(tbl)
+	cs.WriteByte(0)
+}
+
+// Change adds a change to the current table. An INSERT takes only the new
+// record, a DELETE only the old record, and an UPDATE the old and new
+// records.
+func (cs *testChangeset) Change(op sqlite.OpType, records ...[]interface{}) {
+	cs.WriteByte(byte(op))
+	cs.WriteByte(0) // not indirect
+	for _, record := range records {
+		for _, v := range record {
+			cs.writeValue(v)
+		}
+	}
+}
+
+func (cs *testChangeset) writeValue(v interface{}) {
+	var buf [8]byte
+	switch v := v.(type) {
+	case nil:
+		cs.WriteByte(0)
+	case int64:
+		cs.WriteByte(1)
+		binary.BigEndian.PutUint64(buf[:], uint64(v))
+		cs.Write(buf[:])
+	case float64:
+		cs.WriteByte(2)
+		binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
+		cs.Write(buf[:])
+	case string:
+		cs.WriteByte(3)
+		cs.writeVarint(uint64(len(v)))
+		cs.WriteString(v)
+	case []byte:
+		cs.WriteByte(4)
+		cs.writeVarint(uint64(len(v)))
+		cs.Write(v)
+	case testNull:
+		cs.WriteByte(5)
+	default:
+		panic(fmt.Sprintf("unsupported test value: %#v", v))
+	}
+}
+
+// writeVarint writes v as an SQLite varint, which is big-endian with 7 bits
+// per byte and the high bit set on all but the last byte. Values needing
+// more than 8 bytes are not supported.
+func (cs *testChangeset) writeVarint(v uint64) {
+	var buf [8]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		buf[i] = byte(v&0x7f) | 0x80
+	}
+	cs.Write(buf[i:])
+}
+
+func TestOptionsPKUpdateAsDeleteInsert(t *testing.T) {
+	require := require.New(t)
+	conn, sess, _ := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var cs testChangeset
+	cs.Table("t2", true, false)
+	cs.Change(sqlite.SQLITE_UPDATE,
+		[]interface{}{int64(1), nil},
+		[]interface{}{int64(3), nil})
+
+	sql, err := Options{PKUpdateAsDeleteInsert: true}.ToSQL(conn, &cs.Buffer)
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`CREATE TEMP TABLE temp."sqlitechangeset.PKUpdateAsDeleteInsert" AS SELECT * FROM "t2" WHERE ("a") = (1);
+DELETE FROM "t2" WHERE ("a") = (1);
+INSERT INTO "t2" ("a", "b") SELECT 3, "b" FROM temp."sqlitechangeset.PKUpdateAsDeleteInsert";
+DROP TABLE temp."sqlitechangeset.PKUpdateAsDeleteInsert";
+`, sql)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	n, err := sqlitex.ResultInt(conn.Prep(
+		`SELECT count(*) FROM t2 WHERE a = 3 AND b = x'01ff';`))
+	require.NoError(err)
+	require.Equal(1, n)
+
+	// The old row is deleted before the new row is inserted, so another
+	// UNIQUE column does not conflict.
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE u (id INTEGER PRIMARY KEY, email TEXT UNIQUE, n INTEGER);
+INSERT INTO u (id, email, n) VALUES (1, 'a@b', 5);`))
+	cs = testChangeset{}
+	cs.Table("u", true, false, false)
+	cs.Change(sqlite.SQLITE_UPDATE,
+		[]interface{}{int64(1), nil, int64(5)},
+		[]interface{}{int64(2), nil, int64(6)})
+	// If every value is defined, the row is rebuilt from them.
+	cs.Change(sqlite.SQLITE_UPDATE,
+		[]interface{}{int64(2), "a@b", int64(6)},
+		[]interface{}{int64(3), nil, nil})
+	sql, err = Options{PKUpdateAsDeleteInsert: true, NoGrouping: true}.
+		ToSQL(conn, &cs.Buffer)
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, `DELETE FROM "u" WHERE ("id") = (2);
+INSERT INTO "u" ("id", "email", "n") VALUES (3, 'a@b', 6);
+`)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	row, err := sqlitex.ResultText(conn.Prep(
+		`SELECT id || ',' || email || ',' || n FROM u;`))
+	require.NoError(err)
+	require.Equal("3,a@b,6", row)
+}
+
+// pausingReader returns io.EOF once after A is exhausted, before returning B.
+type pausingReader struct {
+	A, B io.Reader
+}
+
+func (r *pausingReader) Read(p []byte) (int, error) {
+	if r.A != nil {
+		n, err := r.A.Read(p)
+		if err == io.EOF {
+			r.A = nil
+			if n == 0 {
+				return 0, io.EOF
+			}
+			err = nil
+		}
+		return n, err
+	}
+	return r.B.Read(p)
+}
+
+func TestUnconsumedChangeset(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	r := &pausingReader{A: changeset, B: strings.NewReader("trailing")}
+	_, err := ToSQL(conn, r)
+	require.Equal(ErrUnconsumedChangeset, err)
+}
+
+func TestOptionsContinueOnError(t *testing.T) {
+	require := require.New(t)
+	conn, sess, _ := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var cs testChangeset
+	cs.Table("t2", true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(3), []byte{0x03}})
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{nil, []byte{0x04}})
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(5), []byte{0x05}})
+	changeset := cs.Bytes()
+
+	_, err := ToSQL(conn, bytes.NewReader(changeset))
+	require.Error(err)
+
+	sql, err := Options{ContinueOnError: true}.ToSQL(conn,
+		bytes.NewReader(changeset))
+	require.Equal(`INSERT INTO "t2" ("a", "b") VALUES (3, X'03');
+INSERT INTO "t2" ("a", "b") VALUES (5, X'05');
+`, sql)
+	require.IsType(ChangeErrors{}, err)
+	errs := err.(ChangeErrors)
+	require.Len(errs, 1)
+	require.Equal(1, errs[0].Index)
+	require.Equal("t2", errs[0].Table)
+	require.Equal(sqlite.SQLITE_INSERT, errs[0].Op)
+}
+
+func TestToDiff(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	diff, err := ToDiff(conn, changeset)
+	require.NoError(err, "ToDiff")
+	require.Equal(`--- "t"
++++ "t"
+@@ UPDATE ("a", "b") = (1, 1) @@
+-"c" = 'hello'
++"c" = 'hello world'
+@@ INSERT ("a", "b") = (3, 3) @@
++"a" = 3
++"b" = 3
++"c" = 'goodbye world'
++"d" = NULL
+@@ UPDATE ("a", "b") = (2, 2) @@
+-"c" = 'world'
+-"d" = 1.5
++"c" = 'world hello'
++"d" = 5.25
+@@ DELETE ("a", "b") = (5, 5) @@
+-"a" = 5
+-"b" = 5
+-"c" = 'world'
+-"d" = 1.5
+@@ INSERT ("a", "b") = (4, 4) @@
++"a" = 4
++"b" = 4
++"c" = 'goodbye world'''
++"d" = NULL
+--- "t2"
++++ "t2"
+@@ INSERT ("a") = (0) @@
++"a" = 0
++"b" = X'FFFFFF'
+@@ DELETE ("a") = (1) @@
+-"a" = 1
+-"b" = X'01FF'
+@@ DELETE ("a") = (2) @@
+-"a" = 2
+-"b" = X'02FF'
+`, diff)
+}
+
+func TestOptionsPreviewBlobBytes(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var buf bytes.Buffer
+	tee := io.TeeReader(changeset, &buf)
+	opts := Options{PreviewBlobBytes: 2}
+	diff, err := opts.ToDiff(conn, tee)
+	require.NoError(err, "Options.ToDiff")
+	require.Contains(diff, "+\"b\" = X'FFFF…(3 bytes)'\n")
+	require.Contains(diff, "-\"b\" = X'01FF'\n")
+
+	sql, err := opts.ToSQL(conn, &buf)
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, "X'FFFFFF'")
+}
+
+func TestVerifyRoundTrip(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	require.NoError(VerifyRoundTrip(conn, changeset))
+
+	// The changes are rolled back.
+	empty := &bytes.Buffer{}
+	require.NoError(sess.Changeset(empty))
+	require.NotEmpty(empty.Bytes())
+	n, err := sqlitex.ResultInt(conn.Prep(`SELECT count(*) FROM t;`))
+	require.NoError(err)
+	require.Equal(3, n)
+
+	// A change which does not apply is detected.
+	var cs testChangeset
+	cs.Table("t2", true, false)
+	cs.Change(sqlite.SQLITE_UPDATE,
+		[]interface{}{int64(9), []byte{0x01}},
+		[]interface{}{nil, []byte{0x02}})
+	err = VerifyRoundTrip(conn, &cs.Buffer)
+	require.Error(err)
+	require.Contains(err.Error(), "round trip is missing change")
+}
+
+func TestOptionsCastValues(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	sql, err := Options{CastValues: true}.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, `VALUES (CAST(3 AS INTEGER), CAST(3 AS INTEGER), CAST('goodbye world' AS TEXT), NULL);`)
+	require.Contains(sql, `VALUES (CAST(0 AS INTEGER), X'FFFFFF');`)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+
+	empty := &bytes.Buffer{}
+	require.NoError(sess.Changeset(empty))
+	require.Empty(empty.Bytes())
+}
+
+func TestView(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE t (a INTEGER PRIMARY KEY, b TEXT);
+CREATE VIEW v AS SELECT a, b FROM t;`))
+
+	var changeset testChangeset
+	changeset.Table("v", true, false)
+	changeset.Change(sqlite.SQLITE_INSERT, []interface{}{int64(1), "b"})
+
+	_, err = ToSQL(conn, &changeset)
+	require.Error(err)
+	require.True(errors.Is(err, ErrView))
+	require.Contains(err.Error(), `querying columns for table "v": `)
+
+	_, err = TableColumns(conn, "V")
+	require.True(errors.Is(err, ErrView))
+
+	cols, err := TableColumns(conn, "t")
+	require.NoError(err)
+	require.Len(cols, 2)
+}
+
+func TestOptionsCompactWhitespace(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	sql, err := Options{CompactWhitespace: true}.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, `INSERT INTO "t" ("a","b","c","d") VALUES (3,3,'goodbye world',NULL);`)
+	require.Contains(sql, `UPDATE "t" SET ("c","d") = ('world hello',5.25) WHERE ("a","b") = (2,2) /*old: ('world',1.5)*/;`)
+	require.Contains(sql, `DELETE FROM "t2" WHERE ("a") = (1) /*("b") = (X'01FF')*/;`)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+
+	empty := &bytes.Buffer{}
+	require.NoError(sess.Changeset(empty))
+	require.Empty(empty.Bytes())
+}
+
+func TestOptionsPrettyPrint(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	sql, err := Options{PrettyPrint: true}.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, `INSERT INTO "t2" (
+	"a",
+	"b"
+) VALUES (
+	0,
+	X'FFFFFF'
+);
+`)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+
+	empty := &bytes.Buffer{}
+	require.NoError(sess.Changeset(empty))
+	require.Empty(empty.Bytes())
+}
+
+func TestOptionsMaxLineWidth(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var buf bytes.Buffer
+	opts := Options{MaxLineWidth: 80}
+	sql, err := opts.ToSQL(conn, io.TeeReader(changeset, &buf))
+	require.NoError(err, "Options.ToSQL")
+	// Only the statements with long lines are wrapped.
+	require.Contains(sql, `
+INSERT INTO "t2" ("a", "b") VALUES (0, X'FFFFFF');
+`)
+	require.Contains(sql, `
+UPDATE "t" SET (
+	"c"
+) = (
+	'hello world'
+) WHERE (
+	"a",
+	"b"
+) = (
+	1,
+	1
+) /* old: ('hello') */;
+`)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	empty := &bytes.Buffer{}
+	require.NoError(sess.Changeset(empty))
+	require.Empty(empty.Bytes())
+
+	// The parameters of a wrapped statement are collected once.
+	statements, err := opts.ToStatements(conn, bytes.NewReader(buf.Bytes()))
+	require.NoError(err, "Options.ToStatements")
+	require.Equal([]interface{}{int64(1), int64(1), "hello world"},
+		statements[0].Args)
+}
+
+func TestToGoCode(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var buf bytes.Buffer
+	tee := io.TeeReader(changeset, &buf)
+	code, err := ToGoCode(conn, tee, "conn")
+	require.NoError(err, "ToGoCode")
+	require.Contains(code, "if err := sqlitex.Exec(conn, "+
+		"`INSERT INTO \"t\" (\"a\", \"b\", \"c\", \"d\") VALUES (?1, ?2, ?3, ?4);`, nil,\n"+
+		"\tint64(4), int64(4), \"goodbye world'\", nil); err != nil {\n"+
+		"\treturn err\n}\n")
+	require.Contains(code, "`UPDATE \"t\" SET (\"c\", \"d\") = (?3, ?4) "+
+		"WHERE (\"a\", \"b\") = (?1, ?2) /* old: ('world', 1.5) */;`, nil,\n"+
+		"\tint64(2), int64(2), \"world hello\", float64(5.25));")
+	require.Contains(code, "`INSERT INTO \"t2\" (\"a\", \"b\") VALUES (?1, X'FFFFFF');`, nil,\n"+
+		"\tint64(0)); err != nil {")
+	src := "package p\n\nfunc f() error {\n" + code + "return nil\n}\n"
+	_, err = format.Source([]byte(src))
+	require.NoError(err, "format.Source")
+
+	// Execute the parameterized statements that the code would.
+	_, err = withChangesetIter(&buf, func(iter sqlite.ChangesetIter) error {
+		return Options{}.forEachChange(conn, iter,
+			func(conn _Conn, c change) (string, error) {
+				var args []interface{}
+				conn.params = &args
+				sql, err := conn.BuildSQL(c)
+				if err != nil {
+					return "", err
+				}
+				return "", sqlitex.Exec(conn.Conn,
+					strings.TrimSuffix(sql, "\n"), nil, args...)
+			},
+			func(change, string) error { return nil })
+	})
+	require.NoError(err)
+
+	empty := &bytes.Buffer{}
+	require.NoError(sess.Changeset(empty))
+	require.Empty(empty.Bytes())
+}
+
+func TestTableColumnsQuoting(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE t (a INTEGER PRIMARY KEY);
+CREATE TABLE "we""ird" (x INTEGER PRIMARY KEY, y TEXT);`))
+
+	cols, err := TableColumns(conn, `we"ird`)
+	require.NoError(err)
+	require.Equal([]ColumnInfo{
+		{Name: "x", Type: "INTEGER", PK: 1},
+		{Name: "y", Type: "TEXT"},
+	}, cols)
+
+	// A table name may not break out of its quoting.
+	cols, err = TableColumns(conn, `t"); DROP TABLE t; --`)
+	require.NoError(err)
+	require.Empty(cols)
+	cols, err = TableColumns(conn, "t")
+	require.NoError(err)
+	require.Len(cols, 1)
+}
+
+func TestIdentifierQuoting(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	const schema = `
+CREATE TABLE y (a INTEGER PRIMARY KEY);
+CREATE TABLE "x"" ; DROP TABLE y; --" (id INTEGER PRIMARY KEY, "c""d" TEXT);`
+	require.NoError(sqlitex.ExecScript(conn, schema))
+	sess, err := conn.CreateSession("")
+	require.NoError(err)
+	defer sess.Delete()
+	require.NoError(sess.Attach(""))
+	require.NoError(sqlitex.ExecScript(conn, `
+INSERT INTO "x"" ; DROP TABLE y; --" VALUES (1, 'v'), (2, 'w');
+UPDATE "x"" ; DROP TABLE y; --" SET "c""d" = 'u' WHERE id = 1;
+DELETE FROM "x"" ; DROP TABLE y; --" WHERE id = 2;`))
+	changeset := &bytes.Buffer{}
+	require.NoError(sess.Changeset(changeset))
+
+	// A table or column name may not break out of its quoting.
+	sql, err := Options{TransactionPerTable: true}.ToSQL(conn,
+		bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`SAVEPOINT "x"" ; DROP TABLE y; --";
+INSERT INTO "x"" ; DROP TABLE y; --" ("id", "c""d") VALUES (1, 'u');
+RELEASE "x"" ; DROP TABLE y; --";
+`, sql)
+
+	applied, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer applied.Close()
+	require.NoError(sqlitex.ExecScript(applied, schema))
+	require.NoError(sqlitex.ExecScript(applied, sql))
+	n, err := sqlitex.ResultInt(applied.Prep(`SELECT count(*) FROM y;`))
+	require.NoError(err)
+	require.Equal(0, n)
+	v, err := sqlitex.ResultText(applied.Prep(
+		`SELECT "c""d" FROM "x"" ; DROP TABLE y; --" WHERE id = 1;`))
+	require.NoError(err)
+	require.Equal("u", v)
+
+	// The UPDATE and DELETE quote their identifiers too.
+	var cs testChangeset
+	cs.Table(`x" ; DROP TABLE y; --`, true, false)
+	cs.Change(sqlite.SQLITE_UPDATE,
+		[]interface{}{int64(1), "u"}, []interface{}{nil, "t"})
+	cs.Change(sqlite.SQLITE_DELETE, []interface{}{int64(1), "t"})
+	sql, err = ToSQL(conn, &cs.Buffer)
+	require.NoError(err, "ToSQL")
+	require.Equal(`UPDATE "x"" ; DROP TABLE y; --" SET ("c""d") = ('t') WHERE ("id") = (1) /* old: ('u') */;
+DELETE FROM "x"" ; DROP TABLE y; --" WHERE ("id") = (1) /* ("c""d") = ('t') */;
+`, sql)
+	require.NoError(sqlitex.ExecScript(applied, sql))
+	n, err = sqlitex.ResultInt(applied.Prep(`SELECT count(*) FROM y;`))
+	require.NoError(err)
+	require.Equal(0, n)
+}
+
+func TestOptionsPreserveOrder(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var cs testChangeset
+	cs.Table("t2", true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(7), []byte{0x07}})
+	cs.Table("t", true, true, false, false)
+	cs.Change(sqlite.SQLITE_INSERT,
+		[]interface{}{int64(7), int64(7), "seven", testNull{}})
+	cs.Change(sqlite.SQLITE_DELETE,
+		[]interface{}{int64(5), int64(5), "world", float64(1.5)})
+	cs.Table("t2", true, false)
+	cs.Change(sqlite.SQLITE_DELETE, []interface{}{int64(7), []byte{0x07}})
+
+	opts := Options{PreserveOrder: true, TransactionPerTable: true,
+		AnnotateSections: true}
+	sql, report, err := opts.ToSQLWithReport(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err)
+	require.Equal(`SAVEPOINT "t2";
+-- Table: t2 (inserts)
+INSERT INTO "t2" ("a", "b") VALUES (7, X'07');
+RELEASE "t2";
+
+SAVEPOINT "t";
+-- Table: t (inserts)
+INSERT INTO "t" ("a", "b", "c", "d") VALUES (7, 7, 'seven', NULL);
+-- Table: t (deletes)
+DELETE FROM "t" WHERE ("a", "b") = (5, 5) /* ("c", "d") = ('world', 1.5) */;
+RELEASE "t";
+
+SAVEPOINT "t2";
+-- Table: t2 (deletes)
+DELETE FROM "t2" WHERE ("a") = (7) /* ("b") = (X'07') */;
+RELEASE "t2";
+`, sql)
+	require.Equal(2, report.Tables)
+	require.Equal(4, report.Statements)
+
+	sql, err = Options{PreserveOrder: true}.ToSQL(conn, changeset)
+	require.NoError(err)
+	require.Equal(`UPDATE "t" SET ("c") = ('hello world') WHERE ("a", "b") = (1, 1) /* old: ('hello') */;
+INSERT INTO "t" ("a", "b", "c", "d") VALUES (3, 3, 'goodbye world', NULL);
+UPDATE "t" SET ("c", "d") = ('world hello', 5.25) WHERE ("a", "b") = (2, 2) /* old: ('world', 1.5) */;
+DELETE FROM "t" WHERE ("a", "b") = (5, 5) /* ("c", "d") = ('world', 1.5) */;
+INSERT INTO "t" ("a", "b", "c", "d") VALUES (4, 4, 'goodbye world''', NULL);
+
+INSERT INTO "t2" ("a", "b") VALUES (0, X'FFFFFF');
+DELETE FROM "t2" WHERE ("a") = (1) /* ("b") = (X'01FF') */;
+DELETE FROM "t2" WHERE ("a") = (2) /* ("b") = (X'02FF') */;
+`, sql)
+}
+
+func TestOptionsLineComments(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var buf bytes.Buffer
+	tee := io.TeeReader(changeset, &buf)
+	sql, err := Options{LineComments: true}.ToSQL(conn, tee)
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "t" ("a", "b", "c", "d") VALUES (3, 3, 'goodbye world', NULL);
+INSERT INTO "t" ("a", "b", "c", "d") VALUES (4, 4, 'goodbye world''', NULL);
+-- old: ('hello')
+UPDATE "t" SET ("c") = ('hello world') WHERE ("a", "b") = (1, 1);
+-- old: ('world', 1.5)
+UPDATE "t" SET ("c", "d") = ('world hello', 5.25) WHERE ("a", "b") = (2, 2);
+-- ("c", "d") = ('world', 1.5)
+DELETE FROM "t" WHERE ("a", "b") = (5, 5);
+
+INSERT INTO "t2" ("a", "b") VALUES (0, X'FFFFFF');
+-- ("b") = (X'01FF')
+DELETE FROM "t2" WHERE ("a") = (1);
+-- ("b") = (X'02FF')
+DELETE FROM "t2" WHERE ("a") = (2);
+`, sql)
+
+	undo, err := Options{LineComments: true, Invert: true}.ToSQL(conn,
+		bytes.NewReader(buf.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(undo, `-- undo of DELETE
+INSERT INTO "t" ("a", "b", "c", "d") VALUES (5, 5, 'world', 1.5);
+`)
+
+	// Line breaks in old values must not end the comment early.
+	var cs testChangeset
+	cs.Table("t", true, true, false, false)
+	cs.Change(sqlite.SQLITE_DELETE,
+		[]interface{}{int64(1), int64(1), "hello\n1);\nDROP TABLE t; --", testNull{}})
+	sql, err = Options{LineComments: true}.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`-- ("c", "d") = ('hello\n1);\nDROP TABLE t; --', NULL)
+DELETE FROM "t" WHERE ("a", "b") = (1, 1);
+`, sql)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	cols, err := TableColumns(conn, "t")
+	require.NoError(err)
+	require.Len(cols, 4)
+}
+
+func TestOptionsLogger(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var logs []string
+	opts := Options{
+		Logger: func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+		RowFilter: func(table string, pk map[string]interface{}) bool {
+			return table != "t2" || pk["a"] != int64(1)
+		},
+	}
+	_, err := opts.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Equal([]string{
+		`sqlitechangeset: loaded 4 columns of table "t"`,
+		`sqlitechangeset: loaded 2 columns of table "t2"`,
+		`sqlitechangeset: skipped change 6 (SQLITE_DELETE on "t2"): excluded by RowFilter`,
+	}, logs)
+
+	logs = nil
+	var cs testChangeset
+	cs.Table("t2", true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{nil, []byte{0x04}})
+	opts = Options{Logger: opts.Logger, ContinueOnError: true}
+	_, err = opts.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.Error(err)
+	require.Len(logs, 2)
+	require.Equal(`sqlitechangeset: skipped `+err.(ChangeErrors)[0].Error(), logs[1])
+
+	logs = nil
+	cs = testChangeset{}
+	cs.Table("t", true, true, false)
+	cs.Change(sqlite.SQLITE_INSERT,
+		[]interface{}{int64(9), int64(9), "c"})
+	opts.AllowMissingColumns = true
+	_, err = opts.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err)
+	require.Contains(logs, `sqlitechangeset: changeset has 3 columns for table "t" which has 4 columns`)
+
+	// A change with more columns than its table is an error, once the
+	// columns are queried again.
+	logs = nil
+	cs = testChangeset{}
+	cs.Table("t2", true, false, false)
+	cs.Change(sqlite.SQLITE_INSERT,
+		[]interface{}{int64(9), []byte{0x09}, int64(9)})
+	opts = Options{Logger: opts.Logger}
+	sql, err := opts.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.True(errors.Is(err, ErrExtraColumns), err)
+	require.Empty(sql)
+	require.Equal([]string{
+		`sqlitechangeset: loaded 2 columns of table "t2"`,
+		`sqlitechangeset: loaded 2 columns of table "t2"`,
+	}, logs)
+
+	// A change to a table which does not exist is an error, rather than
+	// a single column being taken as the rowid.
+	cs = testChangeset{}
+	cs.Table("missing", true)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(9)})
+	sql, err = opts.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.True(errors.Is(err, ErrNoSuchTable), err)
+	require.Empty(sql)
+}
+
+func TestPatchset(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE p (a INTEGER PRIMARY KEY, b TEXT, c TEXT);
+INSERT INTO p (a, b, c) VALUES (1, 'x', 'y'), (2, 'p', 'q'), (4, 'r', 's');`))
+	sess, err := conn.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(conn, `
+UPDATE p SET b = NULL WHERE a = 1;
+UPDATE p SET c = 'z' WHERE a = 4;
+DELETE FROM p WHERE a = 2;
+INSERT INTO p (a, b) VALUES (3, 'n');`))
+	var patchset bytes.Buffer
+	require.NoError(sess.Patchset(&patchset))
+
+	// Columns left undefined by the patchset are not set, while a column
+	// explicitly set to NULL is.
+	sql, err := ToSQL(conn, bytes.NewReader(patchset.Bytes()))
+	require.NoError(err, "ToSQL")
+	require.Equal(`INSERT INTO "p" ("a", "b", "c") VALUES (3, 'n', NULL);
+UPDATE "p" SET ("b") = (NULL) WHERE ("a") = (1);
+UPDATE "p" SET ("c") = ('z') WHERE ("a") = (4);
+DELETE FROM "p" WHERE ("a") = (2);
+`, sql)
+
+	// Apply the SQL to the prior state of the database.
+	require.NoError(sqlitex.ExecScript(conn, `
+DELETE FROM p;
+INSERT INTO p (a, b, c) VALUES (1, 'x', 'y'), (2, 'p', 'q'), (4, 'r', 's');`))
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	var rows []string
+	require.NoError(sqlitex.Exec(conn, `SELECT quote(a), quote(b), quote(c) FROM p ORDER BY a;`,
+		func(stmt *sqlite.Stmt) error {
+			rows = append(rows, stmt.ColumnText(0)+" "+
+				stmt.ColumnText(1)+" "+stmt.ColumnText(2))
+			return nil
+		}))
+	require.Equal([]string{"1 NULL 'y'", "3 'n' NULL", "4 'r' 'z'"}, rows)
+}
+
+func TestOptionsConflictSourceWins(t *testing.T) {
+	require := require.New(t)
+	const schema = `CREATE TABLE s (a INTEGER PRIMARY KEY, b TEXT, c TEXT);`
+	src, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer src.Close()
+	require.NoError(sqlitex.ExecScript(src, schema+`
+INSERT INTO s (a, b, c) VALUES (2, 'old', 'c'), (3, 'x', 'y');`))
+	sess, err := src.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(src, `
+INSERT INTO s (a, b, c) VALUES (1, 'src', 'src');
+UPDATE s SET b = 'new' WHERE a = 2;
+DELETE FROM s WHERE a = 3;`))
+	var changeset bytes.Buffer
+	require.NoError(sess.Changeset(&changeset))
+
+	// Every change conflicts with the target.
+	dst, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer dst.Close()
+	require.NoError(sqlitex.ExecScript(dst, schema+`
+INSERT INTO s (a, b, c) VALUES (1, 'dst', 'dst'), (2, 'other', 'keep'), (3, 'z', 'y');`))
+
+	opts := Options{ConflictSourceWins: true}
+	var sql string
+	var convErr error
+	require.NoError(dst.ChangesetApply(&changeset, nil,
+		func(_ sqlite.ConflictType, iter sqlite.ChangesetIter) sqlite.ConflictAction {
+			stmt, err := opts.ConflictChangesetIterToSQL(dst, iter)
+			if err != nil {
+				convErr = err
+			}
+			sql += stmt
+			return sqlite.SQLITE_CHANGESET_OMIT
+		}))
+	require.NoError(convErr)
+	require.Equal(`DELETE FROM "s" WHERE ("a") = (1) /* ("b", "c") = ('dst', 'dst') */;
+INSERT INTO "s" ("a", "b", "c") VALUES (1, 'src', 'src');
+DELETE FROM "s" WHERE ("a") = (2) /* ("b", "c") = ('other', 'keep') */;
+INSERT INTO "s" ("a", "b", "c") VALUES (2, 'new', 'keep');
+DELETE FROM "s" WHERE ("a") = (3) /* ("b", "c") = ('z', 'y') */;
+`, sql)
+
+	require.NoError(sqlitex.ExecScript(dst, sql))
+	var rows []string
+	require.NoError(sqlitex.Exec(dst, `SELECT a, b, c FROM s ORDER BY a;`,
+		func(stmt *sqlite.Stmt) error {
+			rows = append(rows, stmt.ColumnText(0)+" "+
+				stmt.ColumnText(1)+" "+stmt.ColumnText(2))
+			return nil
+		}))
+	require.Equal([]string{"1 src src", "2 new keep"}, rows)
+}
+
+func TestOptionsAllowMissingColumns(t *testing.T) {
+	require := require.New(t)
+	conn, sess, _ := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	// A changeset recorded before "d" was added to "t".
+	var cs testChangeset
+	cs.Table("t", true, true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(7), int64(7), "seven"})
+	cs.Change(sqlite.SQLITE_UPDATE,
+		[]interface{}{int64(1), int64(1), "hello"},
+		[]interface{}{nil, nil, "hi"})
+	cs.Change(sqlite.SQLITE_DELETE, []interface{}{int64(2), int64(2), "world"})
+
+	_, err := ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.True(errors.Is(err, ErrMissingColumns))
+	require.Contains(err.Error(), `table "t" has 4 columns but the changeset has 3`)
+
+	sql, err := Options{AllowMissingColumns: true}.ToSQL(conn,
+		bytes.NewReader(cs.Bytes()))
+	require.NoError(err)
+	require.Equal(`INSERT INTO "t" ("a", "b", "c") VALUES (7, 7, 'seven');
+UPDATE "t" SET ("c") = ('hi') WHERE ("a", "b") = (1, 1) /* old: ('hello') */;
+DELETE FROM "t" WHERE ("a", "b") = (2, 2) /* ("c") = ('world') */;
+`, sql)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+}
+
+func TestToSQLMulti(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	dialects := []Dialect{
+		{Name: "default"},
+		{Name: "upper", Options: Options{
+			EscapeText: func(s string) string {
+				return QuoteText(strings.ToUpper(s))
+			},
+			NoGrouping: true,
+		}},
+		{Name: "compact", Options: Options{CompactWhitespace: true,
+			AnnotateSections: true, Epilogue: "-- done\n"}},
+		// The Options which read the changeset ahead apply too.
+		{Name: "ahead", Options: Options{HashComment: true,
+			UniformInsertColumns: true, StrictSchema: true,
+			ReadTransaction: true}},
+	}
+	var buf bytes.Buffer
+	tee := io.TeeReader(changeset, &buf)
+	sqls, err := ToSQLMulti(conn, tee, dialects)
+	require.NoError(err, "ToSQLMulti")
+	require.Len(sqls, len(dialects))
+	for _, dialect := range dialects {
+		sql, err := dialect.Options.ToSQL(conn, bytes.NewReader(buf.Bytes()))
+		require.NoError(err, "Options.ToSQL")
+		require.Equal(sql, sqls[dialect.Name], dialect.Name)
+	}
+	require.Contains(sqls["upper"], `'GOODBYE WORLD'`)
+	require.True(strings.HasPrefix(sqls["ahead"], "-- changeset sha256:"))
+	require.True(conn.GetAutocommit(), "read transaction left open")
+
+	require.NoError(sqlitex.ExecScript(conn, `ALTER TABLE t2 ADD COLUMN e;`))
+	_, err = ToSQLMulti(conn, bytes.NewReader(buf.Bytes()), dialects)
+	var mismatch *SchemaMismatchError
+	require.True(errors.As(err, &mismatch), err)
+
+	_, err = ToSQLMulti(conn, bytes.NewReader(buf.Bytes()),
+		[]Dialect{{Name: "a"}, {Name: "a"}})
+	require.EqualError(err, `sqlitechangeset: duplicate dialect "a"`)
+}
+
+func TestOptionsIncludeExcludeColumns(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var buf bytes.Buffer
+	tee := io.TeeReader(changeset, &buf)
+	sql, err := Options{ExcludeColumns: map[string][]string{"t": {"C"}}}.
+		ToSQL(conn, tee)
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "t" ("a", "b", "d") VALUES (3, 3, NULL);
+INSERT INTO "t" ("a", "b", "d") VALUES (4, 4, NULL);
+UPDATE "t" SET ("d") = (5.25) WHERE ("a", "b") = (2, 2) /* old: (1.5) */;
+DELETE FROM "t" WHERE ("a", "b") = (5, 5) /* ("d") = (1.5) */;
+
+INSERT INTO "t2" ("a", "b") VALUES (0, X'FFFFFF');
+DELETE FROM "t2" WHERE ("a") = (1) /* ("b") = (X'01FF') */;
+DELETE FROM "t2" WHERE ("a") = (2) /* ("b") = (X'02FF') */;
+`, sql)
+
+	sql, err = Options{IncludeColumns: map[string][]string{"t2": {}}}.
+		ToSQL(conn, bytes.NewReader(buf.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, `INSERT INTO "t2" ("a") VALUES (0);
+DELETE FROM "t2" WHERE ("a") = (1);
+`)
+	require.Contains(sql, `UPDATE "t" SET ("c") = ('hello world') WHERE ("a", "b") = (1, 1) /* old: ('hello') */;`)
+
+	_, err = Options{ExcludeColumns: map[string][]string{"t2": {"a"}}}.
+		ToSQL(conn, bytes.NewReader(buf.Bytes()))
+	require.EqualError(err, `sqlitechangeset: "t2": cannot exclude PRIMARY KEY column "a"`)
+}
+
+func TestOptionsMaskValue(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	opts := Options{MaskValue: func(table, column string,
+		v sqlite.Value) (string, bool) {
+		return "'***'", table == "t" && column == "c"
+	}}
+	var buf bytes.Buffer
+	tee := io.TeeReader(changeset, &buf)
+	sql, err := opts.ToSQL(conn, tee)
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "t" ("a", "b", "c", "d") VALUES (3, 3, '***', NULL);
+INSERT INTO "t" ("a", "b", "c", "d") VALUES (4, 4, '***', NULL);
+UPDATE "t" SET ("c") = ('***') WHERE ("a", "b") = (1, 1) /* old: ('***') */;
+UPDATE "t" SET ("c", "d") = ('***', 5.25) WHERE ("a", "b") = (2, 2) /* old: ('***', 1.5) */;
+DELETE FROM "t" WHERE ("a", "b") = (5, 5) /* ("c", "d") = ('***', 1.5) */;
+
+INSERT INTO "t2" ("a", "b") VALUES (0, X'FFFFFF');
+DELETE FROM "t2" WHERE ("a") = (1) /* ("b") = (X'01FF') */;
+DELETE FROM "t2" WHERE ("a") = (2) /* ("b") = (X'02FF') */;
+`, sql)
+
+	code, err := opts.ToGoCode(conn, bytes.NewReader(buf.Bytes()), "conn")
+	require.NoError(err, "Options.ToGoCode")
+	require.NotContains(code, "goodbye")
+	require.Contains(code, `VALUES (?1, ?2, '***', ?3);`)
+
+	diff, err := opts.ToDiff(conn, bytes.NewReader(buf.Bytes()))
+	require.NoError(err, "Options.ToDiff")
+	require.NotContains(diff, "hello")
+}
+
+func TestConverterReset(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var loads int
+	cv := NewConverter(conn, Options{
+		Logger: func(format string, args ...interface{}) {
+			if strings.HasPrefix(format, "sqlitechangeset: loaded") {
+				loads++
+			}
+		},
+	})
+	var buf bytes.Buffer
+	tee := io.TeeReader(changeset, &buf)
+	sql, err := cv.ToSQL(tee)
+	require.NoError(err, "Converter.ToSQL")
+	again, err := cv.ToSQL(bytes.NewReader(buf.Bytes()))
+	require.NoError(err, "Converter.ToSQL")
+	require.Equal(sql, again)
+	require.Equal(2, loads, "columns should be cached across conversions")
+
+	require.NoError(sqlitex.ExecScript(conn, `ALTER TABLE t2 ADD COLUMN e TEXT;`))
+	var cs testChangeset
+	cs.Table("t2", true, false, false)
+	cs.Change(sqlite.SQLITE_INSERT,
+		[]interface{}{int64(9), []byte{0x09}, "e"})
+
+	// The cached columns are queried again for a change with more columns.
+	sql, err = cv.ToSQL(bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Converter.ToSQL")
+	require.Equal(`INSERT INTO "t2" ("a", "b", "e") VALUES (9, X'09', 'e');
+`, sql)
+	require.Equal(3, loads)
+
+	// Otherwise the cached columns are stale until Reset.
+	require.NoError(sqlitex.ExecScript(conn, `ALTER TABLE t2 RENAME COLUMN e TO f;`))
+	sql, err = cv.ToSQL(bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Converter.ToSQL")
+	require.Equal(`INSERT INTO "t2" ("a", "b", "e") VALUES (9, X'09', 'e');
+`, sql)
+
+	cv.Reset()
+	var out bytes.Buffer
+	report, err := cv.WriteSQL(&out, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Converter.WriteSQL")
+	require.Equal(`INSERT INTO "t2" ("a", "b", "f") VALUES (9, X'09', 'e');
+`, out.String())
+	require.Equal(1, report.Statements)
+	require.Equal(4, loads)
+}
+
+func TestInsertDefaultValues(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE d (id INTEGER PRIMARY KEY AUTOINCREMENT, v TEXT DEFAULT 'v');`))
+
+	// An INSERT whose key is left to be generated, and which defines no
+	// other values.
+	var cs testChangeset
+	cs.Table("d", false, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{nil, nil})
+	sql, err := ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "ToSQL")
+	require.Equal(`INSERT INTO "d" DEFAULT VALUES;
+`, sql)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+
+	var rows []string
+	require.NoError(sqlitex.Exec(conn, `SELECT id, v FROM d;`,
+		func(stmt *sqlite.Stmt) error {
+			rows = append(rows, stmt.ColumnText(0)+" "+stmt.ColumnText(1))
+			return nil
+		}))
+	require.Equal([]string{"1 v"}, rows)
+}
+
+func TestOptionsIncludeRowid(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE n (x TEXT, y TEXT);
+INSERT INTO n (rowid, x, y) VALUES (2, 'p', 'q'), (3, 'r', 's');`))
+
+	// A changeset keyed by rowid, as recorded with
+	// SQLITE_SESSION_OBJCONFIG_ROWID.
+	var cs testChangeset
+	cs.Table("n", true, false, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(5), "a", "b"})
+	cs.Change(sqlite.SQLITE_UPDATE,
+		[]interface{}{int64(2), "p", nil},
+		[]interface{}{nil, "pp", nil})
+	cs.Change(sqlite.SQLITE_DELETE, []interface{}{int64(3), "r", "s"})
+
+	sql, err := ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "ToSQL")
+	require.Equal(`INSERT INTO "n" ("x", "y") VALUES ('a', 'b');
+UPDATE "n" SET ("x") = ('pp') WHERE ("_rowid_") = (2) /* old: ('p') */;
+DELETE FROM "n" WHERE ("_rowid_") = (3) /* ("x", "y") = ('r', 's') */;
+`, sql)
+
+	sql, err = Options{IncludeRowid: true}.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, `INSERT INTO "n" ("_rowid_", "x", "y") VALUES (5, 'a', 'b');
+`)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	var rows []string
+	require.NoError(sqlitex.Exec(conn, `SELECT rowid, x, y FROM n ORDER BY rowid;`,
+		func(stmt *sqlite.Stmt) error {
+			rows = append(rows, stmt.ColumnText(0)+" "+
+				stmt.ColumnText(1)+" "+stmt.ColumnText(2))
+			return nil
+		}))
+	require.Equal([]string{"2 pp q", "5 a b"}, rows)
+}
+
+func TestSessionToSQLStream(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE s (a INTEGER PRIMARY KEY, b TEXT);
+CREATE TEMP TABLE ts (a INTEGER PRIMARY KEY, b TEXT);`))
+	sess, err := conn.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	for i := 0; i < 1000; i++ {
+		require.NoError(sqlitex.Exec(conn,
+			`INSERT INTO s (a, b) VALUES (?, ?);`, nil, i, strings.Repeat("x", i)))
+	}
+
+	want, err := SessionToSQL(conn, sess)
+	require.NoError(err, "SessionToSQL")
+	var out bytes.Buffer
+	report, err := SessionToSQLStream(conn, sess, &out)
+	require.NoError(err, "SessionToSQLStream")
+	require.Equal(want, out.String())
+	require.Equal(1000, report.Statements)
+
+	// A failed conversion must stop the session before returning.
+	_, err = Options{ExcludeColumns: map[string][]string{"s": {"a"}}}.
+		SessionToSQLStream(conn, sess, ioutil.Discard)
+	require.EqualError(err, `sqlitechangeset: "s": cannot exclude PRIMARY KEY column "a"`)
+	require.NoError(sqlitex.Exec(conn, `INSERT INTO s (a, b) VALUES (-1, 'y');`, nil))
+}
+
+func TestConflictHandler(t *testing.T) {
+	require := require.New(t)
+	const schema = `CREATE TABLE s (a INTEGER PRIMARY KEY, b TEXT, c TEXT);
+CREATE TABLE u (a INTEGER PRIMARY KEY, b TEXT UNIQUE);`
+	src, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer src.Close()
+	require.NoError(sqlitex.ExecScript(src, schema+`
+INSERT INTO s (a, b, c) VALUES (2, 'old', 'c'), (3, 'x', 'y'), (4, 'x', 'y');`))
+	sess, err := src.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(src, `
+INSERT INTO s (a, b, c) VALUES (1, 'src', 'src');
+UPDATE s SET b = 'new' WHERE a = 2;
+UPDATE s SET b = 'new' WHERE a = 3;
+DELETE FROM s WHERE a = 4;
+INSERT INTO u (a, b) VALUES (1, 'taken');`))
+	var changeset bytes.Buffer
+	require.NoError(sess.Changeset(&changeset))
+	u := bytes.NewReader(changeset.Bytes())
+
+	dst, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer dst.Close()
+	require.NoError(sqlitex.ExecScript(dst, schema+`
+INSERT INTO s (a, b, c) VALUES (1, 'dst', 'dst'), (2, 'other', 'keep');
+INSERT INTO u (a, b) VALUES (2, 'taken');`))
+
+	var logged []string
+	opts := Options{Logger: func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}}
+	var sql string
+	handler := opts.ConflictHandler(dst, func(stmt string) { sql += stmt })
+	require.NoError(dst.ChangesetApply(&changeset,
+		func(tbl string) bool { return tbl == "s" }, handler))
+	require.Equal(`DELETE FROM "s" WHERE ("a") = (1) /* ("b", "c") = ('dst', 'dst') */;
+INSERT INTO "s" ("a", "b", "c") VALUES (1, 'src', 'src');
+DELETE FROM "s" WHERE ("a") = (2) /* ("b", "c") = ('other', 'keep') */;
+INSERT INTO "s" ("a", "b", "c") VALUES (2, 'new', 'keep');
+INSERT INTO "s" ("a", "b") VALUES (3, 'new') ON CONFLICT ("a") DO UPDATE SET ("b") = (excluded."b") /* old: ('x') */;
+`, sql)
+
+	require.NoError(sqlitex.ExecScript(dst, sql))
+	var rows []string
+	require.NoError(sqlitex.Exec(dst, `SELECT a, b, c FROM s ORDER BY a;`,
+		func(stmt *sqlite.Stmt) error {
+			rows = append(rows, stmt.ColumnText(0)+" "+
+				stmt.ColumnText(1)+" "+stmt.ColumnText(2))
+			return nil
+		}))
+	require.Equal([]string{"1 src src", "2 new keep", "3 new "}, rows)
+
+	// A UNIQUE constraint violation cannot be resolved.
+	sql, logged = "", nil
+	require.Error(dst.ChangesetApply(u,
+		func(tbl string) bool { return tbl == "u" }, handler))
+	require.Empty(sql)
+	require.NotEmpty(logged)
+	last := logged[len(logged)-1]
+	require.Contains(last, ErrUnresolvableConflict.Error())
+	require.Contains(last, "SQLITE_CHANGESET_CONSTRAINT")
+
+	_, err = ConflictResolutionSQL(dst, sqlite.SQLITE_CHANGESET_FOREIGN_KEY,
+		sqlite.ChangesetIter{})
+	require.True(errors.Is(err, ErrUnresolvableConflict))
+}
+
+func TestConvertAndApply(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+	var buf bytes.Buffer
+	changeset = io.TeeReader(changeset, &buf)
+
+	count := func(where string) (n int) {
+		require.NoError(sqlitex.Exec(conn, `SELECT count(*) FROM t WHERE `+where+`;`,
+			func(stmt *sqlite.Stmt) error {
+				n = stmt.ColumnInt(0)
+				return nil
+			}))
+		return
+	}
+
+	// A failure rolls back the statements already applied.
+	require.NoError(sqlitex.ExecScript(conn,
+		`INSERT INTO t (a, b, c) VALUES (4, 4, 'taken');`))
+	sql, err := ConvertAndApply(conn, changeset)
+	require.Error(err)
+	require.Contains(sql, `INSERT INTO "t" ("a", "b", "c", "d") VALUES (3, 3, 'goodbye world', NULL);`)
+	require.Equal(0, count(`a = 3`))
+	require.True(conn.GetAutocommit())
+
+	require.NoError(sqlitex.ExecScript(conn, `DELETE FROM t WHERE a = 4;`))
+	applied, err := ConvertAndApply(conn, &buf)
+	require.NoError(err)
+	require.Equal(sql, applied)
+	require.Equal(1, count(`a = 3`))
+	require.Equal(1, count(`a = 1 AND c = 'hello world'`))
+	require.Equal(0, count(`a = 5`))
+}
+
+func TestTextBackslashes(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn,
+		`CREATE TABLE r (a INTEGER PRIMARY KEY, b TEXT);`))
+	sess, err := conn.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.Exec(conn, `INSERT INTO r (a, b) VALUES (1, ?), (2, ?);`,
+		nil, `a\b\'\n`, `100% a_b%_`))
+
+	var changeset bytes.Buffer
+	require.NoError(sess.Changeset(&changeset))
+	sql, err := ToSQL(conn, bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "ToSQL")
+	// SQLite string literals only escape single quotes.
+	require.Equal(`INSERT INTO "r" ("a", "b") VALUES (1, 'a\b\''\n');
+INSERT INTO "r" ("a", "b") VALUES (2, '100% a_b%_');
+`, sql)
+
+	AlwaysUseBlob = true
+	blobSQL, err := ToSQL(conn, bytes.NewReader(changeset.Bytes()))
+	AlwaysUseBlob = false
+	require.NoError(err, "ToSQL")
+	require.Equal(`INSERT INTO "r" ("a", "b") VALUES (1, X'615C625C275C6E');
+INSERT INTO "r" ("a", "b") VALUES (2, X'3130302520615F62255F');
+`, blobSQL)
+
+	undo, err := Options{Invert: true}.ToSQL(conn,
+		bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.NoError(sqlitex.ExecScript(conn, undo))
+	require.NoError(VerifyRoundTrip(conn, bytes.NewReader(changeset.Bytes())))
+}
+
+func TestOptionsWholeFloatsAsReal(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn,
+		`CREATE TABLE f (a INTEGER PRIMARY KEY, d DOUBLE, x);`))
+
+	var changeset testChangeset
+	changeset.Table("f", true, false, false)
+	changeset.Change(sqlite.SQLITE_INSERT,
+		[]interface{}{int64(1), float64(5), float64(5)})
+	changeset.Change(sqlite.SQLITE_INSERT,
+		[]interface{}{int64(2), float64(2.5), float64(1e300)})
+
+	sql, err := ToSQL(conn, bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "ToSQL")
+	require.Contains(sql, `VALUES (1, 5, 5);`)
+
+	sql, err = Options{WholeFloatsAsReal: true}.ToSQL(conn,
+		bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "f" ("a", "d", "x") VALUES (1, 5.0, 5.0);
+INSERT INTO "f" ("a", "d", "x") VALUES (2, 2.5, 1e+300);
+`, sql)
+
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	var types []string
+	require.NoError(sqlitex.Exec(conn,
+		`SELECT typeof(d), typeof(x) FROM f ORDER BY a;`,
+		func(stmt *sqlite.Stmt) error {
+			types = append(types, stmt.ColumnText(0), stmt.ColumnText(1))
+			return nil
+		}))
+	require.Equal([]string{"real", "real", "real", "real"}, types)
+}
+
+func TestSchemaAndDataSQL(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE child (id INTEGER PRIMARY KEY, parent INTEGER REFERENCES Parent (id));
+CREATE TABLE parent (id INTEGER PRIMARY KEY, name TEXT);
+CREATE TABLE unchanged (id INTEGER PRIMARY KEY);`))
+	sess, err := conn.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(conn, `
+INSERT INTO child (id, parent) VALUES (1, 1);
+INSERT INTO parent (id, name) VALUES (1, 'p');`))
+	var changeset bytes.Buffer
+	require.NoError(sess.Changeset(&changeset))
+
+	data := changeset.Bytes()
+
+	sql, err := SchemaAndDataSQL(conn, bytes.NewReader(data))
+	require.NoError(err)
+	require.Equal(`CREATE TABLE parent (id INTEGER PRIMARY KEY, name TEXT);
+CREATE TABLE child (id INTEGER PRIMARY KEY, parent INTEGER REFERENCES Parent (id));
+INSERT INTO "child" ("id", "parent") VALUES (1, 1);
+
+INSERT INTO "parent" ("id", "name") VALUES (1, 'p');
+`, sql)
+
+	replica, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer replica.Close()
+	require.NoError(sqlitex.ExecScript(replica, sql))
+	var name string
+	require.NoError(sqlitex.Exec(replica,
+		`SELECT name FROM parent JOIN child ON parent.id = child.parent;`,
+		func(stmt *sqlite.Stmt) error {
+			name = stmt.ColumnText(0)
+			return nil
+		}))
+	require.Equal("p", name)
+
+	// The hash comment and Prologue start the script.
+	opts := Options{HashComment: true, Prologue: "PRAGMA foreign_keys=ON;\n"}
+	sql, err = opts.SchemaAndDataSQL(conn, bytes.NewReader(data))
+	require.NoError(err)
+	require.Equal(fmt.Sprintf("-- changeset sha256:%s\n", changesetHash(data))+
+		`PRAGMA foreign_keys=ON;
+CREATE TABLE parent (id INTEGER PRIMARY KEY, name TEXT);
+CREATE TABLE child (id INTEGER PRIMARY KEY, parent INTEGER REFERENCES Parent (id));
+INSERT INTO "child" ("id", "parent") VALUES (1, 1);
+
+INSERT INTO "parent" ("id", "name") VALUES (1, 'p');
+`, sql)
+}
+
+func TestOptionsRewriteStatement(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+	var buf bytes.Buffer
+	changeset = io.TeeReader(changeset, &buf)
+
+	opts := Options{RewriteStatement: func(table string, op sqlite.OpType,
+		sql string) (string, error) {
+		if table == "t2" {
+			return "", nil
+		}
+		if op == sqlite.SQLITE_DELETE {
+			return "-- reviewed\n" + sql, nil
+		}
+		return sql, nil
+	}}
+	sql, err := opts.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "t" ("a", "b", "c", "d") VALUES (3, 3, 'goodbye world', NULL);
+INSERT INTO "t" ("a", "b", "c", "d") VALUES (4, 4, 'goodbye world''', NULL);
+UPDATE "t" SET ("c") = ('hello world') WHERE ("a", "b") = (1, 1) /* old: ('hello') */;
+UPDATE "t" SET ("c", "d") = ('world hello', 5.25) WHERE ("a", "b") = (2, 2) /* old: ('world', 1.5) */;
+-- reviewed
+DELETE FROM "t" WHERE ("a", "b") = (5, 5) /* ("c", "d") = ('world', 1.5) */;
+`, sql)
+
+	errRewrite := errors.New("rewrite failed")
+	opts.RewriteStatement = func(string, sqlite.OpType, string) (string, error) {
+		return "", errRewrite
+	}
+	_, err = opts.ToSQL(conn, &buf)
+	require.True(errors.Is(err, errRewrite))
+}
+
+// manyTables returns a connection with n tables and a changeset inserting a
+// row into each.
+func manyTables(b *testing.B, n int) (*sqlite.Conn, []byte) {
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(b, err, "sqlite.OpenConn()")
+	var schema string
+	var cs testChangeset
+	for i := 0; i < n; i++ {
+		tbl := fmt.Sprintf("t%d", i)
+		schema += fmt.Sprintf(
+			"CREATE TABLE %s (a INTEGER PRIMARY KEY, b TEXT, c REAL);\n", tbl)
+		cs.Table(tbl, true, false, false)
+		cs.Change(sqlite.SQLITE_INSERT,
+			[]interface{}{int64(i), "b", float64(i)})
+	}
+	require.NoError(b, sqlitex.ExecScript(conn, schema))
+	return conn, cs.Bytes()
+}
+
+func BenchmarkTableColumns(b *testing.B) {
+	conn, _ := manyTables(b, 100)
+	defer conn.Close()
+	// The PRAGMA statement formatted for each table, as used by
+	// TableColumns, is prepared and cached once per table, while the
+	// table-valued pragma_table_info is prepared once for all tables.
+	b.Run("pragma", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tbl := fmt.Sprintf("t%d", i%100)
+			err := sqlitex.Exec(conn, fmt.Sprintf(`PRAGMA TABLE_INFO(%s);`,
+				quoteIdentifier(tbl)), func(*sqlite.Stmt) error { return nil })
+			require.NoError(b, err)
+		}
+	})
+	b.Run("pragma_table_info", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tbl := fmt.Sprintf("t%d", i%100)
+			err := sqlitex.Exec(conn, `SELECT * FROM pragma_table_info(?1);`,
+				func(*sqlite.Stmt) error { return nil }, tbl)
+			require.NoError(b, err)
+		}
+	})
+}
+
+func BenchmarkToSQLManyTables(b *testing.B) {
+	conn, changeset := manyTables(b, 100)
+	defer conn.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := ToSQL(conn, bytes.NewReader(changeset))
+		require.NoError(b, err)
+	}
+}
+
+func TestOptionsLimitOne(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	sql, err := Options{LimitOne: true}.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "t" ("a", "b", "c", "d") VALUES (3, 3, 'goodbye world', NULL);
+INSERT INTO "t" ("a", "b", "c", "d") VALUES (4, 4, 'goodbye world''', NULL);
+UPDATE "t" SET ("c") = ('hello world') WHERE ("a", "b") = (1, 1) LIMIT 1 /* old: ('hello') */;
+UPDATE "t" SET ("c", "d") = ('world hello', 5.25) WHERE ("a", "b") = (2, 2) LIMIT 1 /* old: ('world', 1.5) */;
+DELETE FROM "t" WHERE ("a", "b") = (5, 5) LIMIT 1 /* ("c", "d") = ('world', 1.5) */;
+
+INSERT INTO "t2" ("a", "b") VALUES (0, X'FFFFFF');
+DELETE FROM "t2" WHERE ("a") = (1) LIMIT 1 /* ("b") = (X'01FF') */;
+DELETE FROM "t2" WHERE ("a") = (2) LIMIT 1 /* ("b") = (X'02FF') */;
+`, sql)
+}
+
+func TestOptionsAttach(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	dir, err := ioutil.TempDir("", "sqlitechangeset")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "it's.db")
+
+	opts := Options{
+		Attach:   []AttachDatabase{{Name: "audit", Path: path}},
+		Prologue: "CREATE TABLE audit.log (msg TEXT);\n",
+		RewriteStatement: func(table string, op sqlite.OpType,
+			sql string) (string, error) {
+			return sql + fmt.Sprintf("INSERT INTO audit.log VALUES ('%v');\n",
+				op), nil
+		},
+	}
+	sql, err := opts.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.True(strings.HasPrefix(sql, "ATTACH DATABASE "+QuoteText(path)+
+		` AS "audit";
+CREATE TABLE audit.log (msg TEXT);
+INSERT INTO "t" `), sql)
+
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	var n int
+	require.NoError(sqlitex.Exec(conn, `SELECT count(*) FROM audit.log;`,
+		func(stmt *sqlite.Stmt) error {
+			n = stmt.ColumnInt(0)
+			return nil
+		}))
+	require.Equal(8, n)
+}
+
+func TestOptionsUniformInsertColumns(t *testing.T) {
+	require := require.New(t)
+	conn, sess, _ := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	// Rows recorded before and after "d" was added to "t".
+	var cs testChangeset
+	cs.Table("t", true, true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(7), int64(7), "seven"})
+	cs.Table("t", true, true, false, false)
+	cs.Change(sqlite.SQLITE_INSERT,
+		[]interface{}{int64(8), int64(8), "eight", float64(2.5)})
+	cs.Table("t2", true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(9), []byte{0x09}})
+
+	opts := Options{AllowMissingColumns: true}
+	sql, err := opts.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err)
+	require.Contains(sql, `INSERT INTO "t" ("a", "b", "c") VALUES (7, 7, 'seven');`)
+
+	opts.UniformInsertColumns = true
+	sql, report, err := opts.ToSQLWithReport(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err)
+	require.Equal(`INSERT INTO "t" ("a", "b", "c", "d") VALUES (7, 7, 'seven', NULL);
+INSERT INTO "t" ("a", "b", "c", "d") VALUES (8, 8, 'eight', 2.5);
+
+INSERT INTO "t2" ("a", "b") VALUES (9, X'09');
+`, sql)
+	require.Equal(int64(cs.Len()), report.ChangesetBytes)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+}
+
+func TestToSQLFromBytes(t *testing.T) {
+	require := require.New(t)
+	conn, sess, _ := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	// A changeset encoded as the C API does, which flags each column of a
+	// composite PRIMARY KEY with its position in the key, and which marks
+	// a change made by a trigger as indirect.
+	changeset := []byte{
+		'T', 4, 1, 2, 0, 0, 't', 0,
+		// An indirect UPDATE of ("c") with old values of only the PK
+		// and the updated column.
+		byte(sqlite.SQLITE_UPDATE), 1,
+		1, 0, 0, 0, 0, 0, 0, 0, 1,
+		1, 0, 0, 0, 0, 0, 0, 0, 1,
+		3, 5, 'h', 'e', 'l', 'l', 'o',
+		0,
+		0, 0, 3, 2, 'h', 'i', 0,
+	}
+	sql, err := ToSQLFromBytes(conn, changeset)
+	require.NoError(err)
+	require.Equal(`UPDATE "t" SET ("c") = ('hi') WHERE ("a", "b") = (1, 1) /* old: ('hello') */;
+`, sql)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+}
+
+func TestWideTable(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	// sqlite.ChangesetIter.PK only supports up to 127 columns.
+	cols := []string{"a INTEGER", "b INTEGER"}
+	for i := len(cols); i < 130; i++ {
+		cols = append(cols, fmt.Sprintf("c%d INTEGER", i))
+	}
+	require.NoError(sqlitex.ExecScript(conn, `CREATE TABLE w (`+
+		strings.Join(cols, ", ")+`, PRIMARY KEY (b, a));`))
+	sess, err := conn.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(conn, `
+INSERT INTO w (a, b, c129) VALUES (1, 2, 3);`))
+
+	var changeset bytes.Buffer
+	require.NoError(sess.Changeset(&changeset))
+	sql, err := Options{Invert: true}.ToSQLFromBytes(conn, changeset.Bytes())
+	require.NoError(err)
+	require.True(strings.HasPrefix(sql, `DELETE FROM "w" WHERE ("a", "b") = (1, 2) /* undo of INSERT: ("c2", `), sql)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	require.NoError(VerifyRoundTrip(conn, bytes.NewReader(changeset.Bytes())))
+}
+
+func TestOptionsStrictSchema(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	sql, err := Options{StrictSchema: true}.ToSQL(conn, changeset)
+	require.NoError(err)
+	require.NotEmpty(sql)
+
+	var cs testChangeset
+	cs.Table("t2", true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(7), []byte{0x07}})
+	cs.Table("nope", true)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(1)})
+	cs.Table("t", true, true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(7), int64(7), "seven"})
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(8), int64(8), "eight"})
+	cs.Table("t2", false, true)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(8), []byte{0x08}})
+
+	opts := Options{StrictSchema: true}
+	_, err = opts.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	var mismatch *SchemaMismatchError
+	require.True(errors.As(err, &mismatch), "%v", err)
+	require.Equal([]string{
+		`table "nope" does not exist`,
+		`table "t" has 4 columns but the changeset has 3`,
+		`table "t2" has PRIMARY KEY ("a") but the changeset has ("b")`,
+	}, mismatch.Mismatches)
+	require.Contains(err.Error(), "\n\t"+`table "t" has 4 columns`)
+
+	opts.AllowMissingColumns = true
+	err = opts.ValidateSchema(conn, bytes.NewReader(cs.Bytes()))
+	require.True(errors.As(err, &mismatch), "%v", err)
+	require.Len(mismatch.Mismatches, 2)
+}
+
+func TestOptionsColumnTransitions(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+	var buf bytes.Buffer
+	changeset = io.TeeReader(changeset, &buf)
+
+	sql, err := Options{ColumnTransitions: true}.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, `UPDATE "t" SET ("c") = ('hello world') WHERE ("a", "b") = (1, 1) /* "c": 'hello' -> 'hello world' */;
+UPDATE "t" SET ("c", "d") = ('world hello', 5.25) WHERE ("a", "b") = (2, 2) /* "c": 'world' -> 'world hello', "d": 1.5 -> 5.25 */;
+`)
+
+	sql, err = Options{ColumnTransitions: true, Invert: true}.ToSQL(conn,
+		bytes.NewReader(buf.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, `UPDATE "t" SET ("c") = ('hello') WHERE ("a", "b") = (1, 1) /* undo of UPDATE: "c": 'hello world' -> 'hello' */;`)
+
+	// A patchset holds no old values.
+	psess, err := conn.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer psess.Delete()
+	require.NoError(psess.Attach("t2"), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(conn, `UPDATE t2 SET b = X'03' WHERE a = 1;`))
+	var patchset bytes.Buffer
+	require.NoError(psess.Patchset(&patchset))
+	sql, err = Options{ColumnTransitions: true}.ToSQL(conn, &patchset)
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`UPDATE "t2" SET ("b") = (X'03') WHERE ("a") = (1) /* "b": X'03' */;
+`, sql)
+}
+
+func TestOptionsMaxStatementLength(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+	data, err := ioutil.ReadAll(changeset)
+	require.NoError(err)
+
+	// Only the UPDATE of "c" and "d" is longer than 100 bytes, so it is
+	// split into an UPDATE of each.
+	opts := Options{MaxStatementLength: 100}
+	sql, err := opts.ToSQL(conn, bytes.NewReader(data))
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, `UPDATE "t" SET ("c") = ('world hello') WHERE ("a", "b") = (2, 2) /* old: ('world') */;
+UPDATE "t" SET ("d") = (5.25) WHERE ("a", "b") = (2, 2) /* old: (1.5) */;
+`)
+
+	// Guarded UPDATEs are not split, as they must apply as a whole.
+	opts = Options{MaxStatementLength: 120, GuardWithOldValues: true,
+		ContinueOnError: true}
+	sql, err = opts.ToSQL(conn, bytes.NewReader(data))
+	var errs ChangeErrors
+	require.True(errors.As(err, &errs), "%v", err)
+	require.Len(errs, 1)
+	require.True(errors.Is(errs[0], ErrStatementTooLong))
+	require.Equal(`sqlitechangeset: change 2 (SQLITE_UPDATE on "t"): `+
+		`sqlitechangeset: statement is too long: SQLITE_UPDATE on "t" `+
+		`is 136 bytes, exceeding 120`, err.Error())
+	require.NotContains(sql, `'world hello'`)
+	require.Contains(sql, `'hello world'`)
+
+	// An INSERT is split into an INSERT of its PK and as many other
+	// columns as fit, followed by UPDATEs of the inserted row, and an
+	// UPDATE of the PK sets it last.
+	var cs testChangeset
+	cs.Table("t", true, true, false, false)
+	cs.Change(sqlite.SQLITE_INSERT,
+		[]interface{}{int64(7), int64(7), "a longer text value to insert", 2.5})
+	cs.Change(sqlite.SQLITE_UPDATE,
+		[]interface{}{int64(1), int64(1), "hello", 1.5},
+		[]interface{}{int64(8), nil, "new text", 3.5})
+	opts = Options{MaxStatementLength: 70, NoGrouping: true}
+	sql, err = opts.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.True(errors.Is(err, ErrStatementTooLong), "%v", err)
+	opts.MaxStatementLength = 85
+	sql, err = opts.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "t" ("a", "b", "c") VALUES (7, 7, 'a longer text value to insert');
+UPDATE "t" SET ("d") = (2.5) WHERE ("a", "b") = (7, 7);
+UPDATE "t" SET ("c") = ('new text') WHERE ("a", "b") = (1, 1) /* old: ('hello') */;
+UPDATE "t" SET ("a", "d") = (8, 3.5) WHERE ("a", "b") = (1, 1) /* old: (1, 1.5) */;
+`, sql)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+}
+
+func TestOptionsOmitSemicolons(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	sql, err := Options{OmitSemicolons: true}.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "t" ("a", "b", "c", "d") VALUES (3, 3, 'goodbye world', NULL)
+INSERT INTO "t" ("a", "b", "c", "d") VALUES (4, 4, 'goodbye world''', NULL)
+UPDATE "t" SET ("c") = ('hello world') WHERE ("a", "b") = (1, 1) /* old: ('hello') */
+UPDATE "t" SET ("c", "d") = ('world hello', 5.25) WHERE ("a", "b") = (2, 2) /* old: ('world', 1.5) */
+DELETE FROM "t" WHERE ("a", "b") = (5, 5) /* ("c", "d") = ('world', 1.5) */
+
+INSERT INTO "t2" ("a", "b") VALUES (0, X'FFFFFF')
+DELETE FROM "t2" WHERE ("a") = (1) /* ("b") = (X'01FF') */
+DELETE FROM "t2" WHERE ("a") = (2) /* ("b") = (X'02FF') */
+`, sql)
+
+	// Each statement may be executed on its own.
+	for _, stmt := range strings.Split(strings.TrimSpace(sql), "\n") {
+		if stmt != "" {
+			require.NoError(sqlitex.Exec(conn, stmt, nil), stmt)
+		}
+	}
+}
+
+func TestPKPerTableHeader(t *testing.T) {
+	require := require.New(t)
+	conn, sess, _ := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	// The PK of a table is declared by each of its headers.
+	var cs testChangeset
+	cs.Table("t2", true, false)
+	cs.Change(sqlite.SQLITE_DELETE, []interface{}{int64(1), []byte{0x01, 0xFF}})
+	cs.Table("t2", false, true)
+	cs.Change(sqlite.SQLITE_DELETE, []interface{}{int64(2), []byte{0x02, 0xFF}})
+	cs.Table("t2", true, false)
+	cs.Change(sqlite.SQLITE_DELETE, []interface{}{int64(3), []byte{0x03}})
+
+	var logs []string
+	cv := NewConverter(conn, Options{NoGrouping: true,
+		Logger: func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		}})
+	require.Nil(cv.PK("t2"))
+	sql, err := cv.ToSQL(&cs)
+	require.NoError(err)
+	require.Equal(`DELETE FROM "t2" WHERE ("a") = (1) /* ("b") = (X'01FF') */;
+DELETE FROM "t2" WHERE ("b") = (X'02FF') /* ("a") = (2) */;
+DELETE FROM "t2" WHERE ("a") = (3) /* ("b") = (X'03') */;
+`, sql)
+	require.Equal([]string{
+		`sqlitechangeset: loaded 2 columns of table "t2"`,
+		`sqlitechangeset: changeset PK of table "t2" changed`,
+		`sqlitechangeset: changeset PK of table "t2" changed`,
+	}, logs)
+
+	// The PK of the last header is cached.
+	require.Equal([]bool{true, false}, cv.PK("T2"))
+	cv.Reset()
+	require.Nil(cv.PK("t2"))
+}
+
+func TestOptionsJSONColumns(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE j (a INTEGER PRIMARY KEY, doc JSON, note TEXT);
+INSERT INTO j (a, doc, note) VALUES (1, '{}', 'x');`))
+	sess, err := conn.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(conn, `
+INSERT INTO j (a, doc, note) VALUES (2, '{"b": [1, 2]}', '{"c": 3}');
+UPDATE j SET doc = '[ true ]' WHERE a = 1;`))
+	var changeset bytes.Buffer
+	require.NoError(sess.Changeset(&changeset))
+
+	sql, err := Options{JSONColumns: DeclaredJSON}.ToSQL(conn,
+		bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "j" ("a", "doc", "note") VALUES (2, json('{"b": [1, 2]}'), '{"c": 3}');
+UPDATE "j" SET ("doc") = (json('[ true ]')) WHERE ("a") = (1) /* old: ('{}') */;
+`, sql)
+
+	undo, err := Options{Invert: true}.ToSQL(conn,
+		bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.NoError(sqlitex.ExecScript(conn, undo))
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	var docs []string
+	require.NoError(sqlitex.Exec(conn, `SELECT doc FROM j ORDER BY a;`,
+		func(stmt *sqlite.Stmt) error {
+			docs = append(docs, stmt.ColumnText(0))
+			return nil
+		}))
+	require.Equal([]string{`[true]`, `{"b":[1,2]}`}, docs)
+}
+
+// BenchmarkToSQLSmallChangesets measures the allocations of converting many
+// small changesets. sqlite.ChangesetIter cannot be reused across changesets,
+// so these are mostly those of building the statements.
+func BenchmarkToSQLSmallChangesets(b *testing.B) {
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(b, err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(b, sqlitex.ExecScript(conn,
+		`CREATE TABLE t (a INTEGER PRIMARY KEY, b TEXT, c REAL, d BLOB);`))
+	var cs testChangeset
+	cs.Table("t", true, false, false, false)
+	for i := 0; i < 10; i++ {
+		cs.Change(sqlite.SQLITE_INSERT,
+			[]interface{}{int64(i), "b", float64(i), []byte{byte(i)}})
+	}
+	cs.Change(sqlite.SQLITE_UPDATE,
+		[]interface{}{int64(1), "b", nil, nil},
+		[]interface{}{nil, "bb", nil, nil})
+	cs.Change(sqlite.SQLITE_DELETE,
+		[]interface{}{int64(2), "b", float64(2), []byte{2}})
+	changeset := cs.Bytes()
+	cv := NewConverter(conn, Options{})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := cv.ToSQL(bytes.NewReader(changeset))
+		require.NoError(b, err)
+	}
+}
+
+func TestChangesetHash(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+	var buf bytes.Buffer
+	changeset = io.TeeReader(changeset, &buf)
+
+	sql, err := Options{HashComment: true, Prologue: "BEGIN;\n"}.ToSQL(conn,
+		changeset)
+	require.NoError(err, "Options.ToSQL")
+	sum := sha256.Sum256(buf.Bytes())
+	hash, err := ChangesetHash(bytes.NewReader(buf.Bytes()))
+	require.NoError(err)
+	require.Equal(hex.EncodeToString(sum[:]), hash)
+	require.True(strings.HasPrefix(sql,
+		"-- changeset sha256:"+hash+"\nBEGIN;\nINSERT INTO \"t\""), sql)
+
+	sql, err = ToSQL(conn, bytes.NewReader(buf.Bytes()))
+	require.NoError(err, "ToSQL")
+	require.NotContains(sql, "sha256")
+}
+
+func TestOptionsRecursiveDeletes(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	// The pragma has no effect within the transaction of ExecScript.
+	require.NoError(sqlitex.Exec(conn, `PRAGMA foreign_keys = ON;`, nil))
+	const rows = `
+INSERT INTO tree (id, parent, name) VALUES
+        (1, NULL, 'root'), (2, 1, 'child'), (3, 2, 'grandchild'),
+        (4, NULL, 'other'), (5, 4, 'kept'), (6, NULL, 'unchanged');`
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE tree (id INTEGER PRIMARY KEY, parent INTEGER REFERENCES tree, name TEXT);
+CREATE TABLE flat (id INTEGER PRIMARY KEY);`+rows))
+	count := func() (n int64) {
+		require.NoError(sqlitex.Exec(conn, `SELECT count(*) FROM tree;`,
+			func(stmt *sqlite.Stmt) error {
+				n = stmt.ColumnInt64(0)
+				return nil
+			}))
+		return
+	}
+
+	// The changeset deletes the parents before their children, and not
+	// row 5, which references row 4.
+	var cs testChangeset
+	cs.Table("tree", true, false, false)
+	cs.Change(sqlite.SQLITE_DELETE, []interface{}{int64(1), testNull{}, "root"})
+	cs.Change(sqlite.SQLITE_DELETE, []interface{}{int64(4), testNull{}, "other"})
+	cs.Change(sqlite.SQLITE_DELETE, []interface{}{int64(2), int64(1), "child"})
+	cs.Change(sqlite.SQLITE_DELETE, []interface{}{int64(3), int64(2), "grandchild"})
+	cs.Table("flat", true)
+	cs.Change(sqlite.SQLITE_DELETE, []interface{}{int64(1)})
+
+	// Without RecursiveDeletes the first DELETE violates the foreign key.
+	sql, err := ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "ToSQL")
+	require.Error(sqlitex.ExecScript(conn, sql))
+	require.Equal(int64(6), count())
+
+	sql, err = Options{RecursiveDeletes: true}.ToSQL(conn,
+		bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`WITH RECURSIVE "sqlitechangeset.RecursiveDeletes" ("id") AS (VALUES (1), (4), (2), (3) UNION SELECT "child"."id" FROM "tree" AS "child" JOIN "tree" AS "parent" ON ("child"."parent") = ("parent"."id") JOIN "sqlitechangeset.RecursiveDeletes" AS "deleted" ON ("parent"."id") = ("deleted"."id")) DELETE FROM "tree" WHERE ("id") IN (SELECT "id" FROM "sqlitechangeset.RecursiveDeletes");
+
+DELETE FROM "flat" WHERE ("id") = (1);
+`, sql)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	// Row 5 is deleted with its parent.
+	require.Equal(int64(1), count())
+
+	// A DELETE too long for MaxStatementLength is split, here by one
+	// fewer row.
+	max := len(sql[:strings.Index(sql, "\n")+1]) - len(", (3)")
+	require.NoError(sqlitex.ExecScript(conn, `DELETE FROM tree;`+rows))
+	opts := Options{RecursiveDeletes: true, MaxStatementLength: max}
+	sql, err = opts.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(3, strings.Count(sql, "DELETE FROM"), sql)
+	require.Contains(sql, `(VALUES (1), (4), (2) UNION`)
+	require.Contains(sql, `(VALUES (3) UNION`)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	require.Equal(int64(1), count())
+}
+
+func TestForeignKeys(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE parent (a INTEGER, b INTEGER, PRIMARY KEY (a, b));
+CREATE TABLE other (id INTEGER PRIMARY KEY);
+CREATE TABLE child (id INTEGER PRIMARY KEY, pa INTEGER, pb INTEGER,
+        o INTEGER REFERENCES other,
+        FOREIGN KEY (pa, pb) REFERENCES parent (a, b));`))
+
+	fks, err := ForeignKeys(conn, "child")
+	require.NoError(err, "ForeignKeys()")
+	require.ElementsMatch([]ForeignKey{
+		{Table: "parent", From: []string{"pa", "pb"}, To: []string{"a", "b"}},
+		{Table: "other", From: []string{"o"}},
+	}, fks)
+
+	fks, err = ForeignKeys(conn, "parent")
+	require.NoError(err, "ForeignKeys()")
+	require.Empty(fks)
+
+	// The foreign keys are cached like the columns of each table.
+	Conn := Options{}.newConn(conn)
+	fks, err = Conn.GetForeignKeys("child")
+	require.NoError(err, "_Conn.GetForeignKeys()")
+	require.Len(fks, 2)
+	require.NoError(sqlitex.ExecScript(conn, `DROP TABLE child;`))
+	cached, err := Conn.GetForeignKeys("child")
+	require.NoError(err, "_Conn.GetForeignKeys()")
+	require.Equal(fks, cached)
+}
+
+func TestOptionsOrderByDependencies(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.Exec(conn, `PRAGMA foreign_keys = ON;`, nil))
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE item (id INTEGER PRIMARY KEY, "order" INTEGER REFERENCES "order");
+CREATE TABLE "order" (id INTEGER PRIMARY KEY, customer INTEGER REFERENCES customer);
+CREATE TABLE customer (id INTEGER PRIMARY KEY);
+INSERT INTO customer (id) VALUES (1);
+INSERT INTO "order" (id, customer) VALUES (1, 1);
+INSERT INTO item (id, "order") VALUES (1, 1);`))
+
+	// The changes appear with each child table before its parent.
+	var cs testChangeset
+	cs.Table("item", true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(2), int64(2)})
+	cs.Change(sqlite.SQLITE_DELETE, []interface{}{int64(1), int64(1)})
+	cs.Table("order", true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(2), int64(2)})
+	cs.Change(sqlite.SQLITE_DELETE, []interface{}{int64(1), int64(1)})
+	cs.Table("customer", true)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(2)})
+	cs.Change(sqlite.SQLITE_DELETE, []interface{}{int64(1)})
+
+	unordered, err := ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "ToSQL")
+	require.Error(sqlitex.ExecScript(conn, unordered))
+
+	sql, err := Options{OrderByDependencies: true}.ToSQL(conn,
+		bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "customer" ("id") VALUES (2);
+
+INSERT INTO "order" ("id", "customer") VALUES (2, 2);
+
+INSERT INTO "item" ("id", "order") VALUES (2, 2);
+
+DELETE FROM "item" WHERE ("id") = (1) /* ("order") = (1) */;
+
+DELETE FROM "order" WHERE ("id") = (1) /* ("customer") = (1) */;
+
+DELETE FROM "customer" WHERE ("id") = (1);
+`, sql)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+
+	// A cycle of foreign keys cannot be ordered.
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE a (id INTEGER PRIMARY KEY, b INTEGER REFERENCES b);
+CREATE TABLE b (id INTEGER PRIMARY KEY, c INTEGER REFERENCES c);
+CREATE TABLE c (id INTEGER PRIMARY KEY, b INTEGER REFERENCES b);`))
+	cs = testChangeset{}
+	cs.Table("a", true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(1), int64(1)})
+	cs.Table("b", true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(1), int64(1)})
+	cs.Table("c", true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(1), int64(1)})
+	_, err = Options{OrderByDependencies: true}.ToSQL(conn,
+		bytes.NewReader(cs.Bytes()))
+	require.True(errors.Is(err, ErrForeignKeyCycle), err)
+	require.Contains(err.Error(), `"b" -> "c" -> "b"`)
+}
+
+func TestToEvents(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	events, err := ToEvents(conn, changeset)
+	require.NoError(err, "ToEvents")
+	var buf bytes.Buffer
+	require.NoError(WriteEventsJSON(&buf, events))
+	require.Equal(`{"table":"t","op":"UPDATE","key":{"a":1,"b":1},"before":{"a":1,"b":1,"c":"hello"},"after":{"c":"hello world"}}
+{"table":"t","op":"INSERT","key":{"a":3,"b":3},"after":{"a":3,"b":3,"c":"goodbye world","d":null}}
+{"table":"t","op":"UPDATE","key":{"a":2,"b":2},"before":{"a":2,"b":2,"c":"world","d":1.5},"after":{"c":"world hello","d":5.25}}
+{"table":"t","op":"DELETE","key":{"a":5,"b":5},"before":{"a":5,"b":5,"c":"world","d":1.5}}
+{"table":"t","op":"INSERT","key":{"a":4,"b":4},"after":{"a":4,"b":4,"c":"goodbye world'","d":null}}
+{"table":"t2","op":"INSERT","key":{"a":0},"after":{"a":0,"b":"////"}}
+{"table":"t2","op":"DELETE","key":{"a":1},"before":{"a":1,"b":"Af8="}}
+{"table":"t2","op":"DELETE","key":{"a":2},"before":{"a":2,"b":"Av8="}}
+`, buf.String())
+
+	msg, err := events[5].MarshalMsgpack()
+	require.NoError(err, "ChangeEvent.MarshalMsgpack()")
+	require.Equal([]byte{0x84,
+		0xa5, 'a', 'f', 't', 'e', 'r', 0x82,
+		0xa1, 'a', 0xd3, 0, 0, 0, 0, 0, 0, 0, 0,
+		0xa1, 'b', 0xc4, 3, 0xff, 0xff, 0xff,
+		0xa3, 'k', 'e', 'y', 0x81,
+		0xa1, 'a', 0xd3, 0, 0, 0, 0, 0, 0, 0, 0,
+		0xa2, 'o', 'p', 0xa6, 'I', 'N', 'S', 'E', 'R', 'T',
+		0xa5, 't', 'a', 'b', 'l', 'e', 0xa2, 't', '2',
+	}, msg)
+}
+
+func TestChangeEventDebezium(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	events, err := ToEvents(conn, changeset)
+	require.NoError(err, "ToEvents")
+	ts := time.Unix(1600000000, 123456789)
+	for _, test := range []struct {
+		event int
+		json  string
+	}{
+		{1, `{"op":"c","before":null,"after":{"a":3,"b":3,"c":"goodbye world","d":null},"source":{"connector":"sqlite","name":"db","table":"t","ts_ms":1600000000123},"ts_ms":1600000000123}`},
+		{0, `{"op":"u","before":{"a":1,"b":1,"c":"hello"},"after":{"c":"hello world"},"source":{"connector":"sqlite","name":"db","table":"t","ts_ms":1600000000123},"ts_ms":1600000000123}`},
+		{6, `{"op":"d","before":{"a":1,"b":"Af8="},"after":null,"source":{"connector":"sqlite","name":"db","table":"t2","ts_ms":1600000000123},"ts_ms":1600000000123}`},
+	} {
+		data, err := json.Marshal(events[test.event].Debezium("db", ts))
+		require.NoError(err, "json.Marshal()")
+		require.Equal(test.json, string(data))
+	}
+}
+
+func TestToStatements(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	statements, err := ToStatements(conn, changeset)
+	require.NoError(err, "ToStatements")
+	require.Len(statements, 8)
+	require.Equal(Statement{
+		SQL:  `UPDATE "t" SET ("c") = (?3) WHERE ("a", "b") = (?1, ?2) /* old: ('hello') */;`,
+		Args: []interface{}{int64(1), int64(1), "hello world"},
+	}, statements[0])
+	require.Equal(Statement{
+		SQL:  `INSERT INTO "t2" ("a", "b") VALUES (?1, X'FFFFFF');`,
+		Args: []interface{}{int64(0)},
+	}, statements[5])
+
+	for _, st := range statements {
+		require.NoError(st.Exec(conn), st.SQL)
+	}
+	empty := &bytes.Buffer{}
+	require.NoError(sess.Changeset(empty), "sqlite.Session.Changeset()")
+	require.Empty(empty.Bytes())
+}
+
+func TestToSQLPair(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var buf bytes.Buffer
+	forward, rollback, err := ToSQLPair(conn, io.TeeReader(changeset, &buf))
+	require.NoError(err, "ToSQLPair")
+	sql, err := ToSQL(conn, bytes.NewReader(buf.Bytes()))
+	require.NoError(err, "ToSQL")
+	require.Equal(sql, forward)
+	undo, err := Options{Invert: true}.ToSQL(conn, bytes.NewReader(buf.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(undo, rollback)
+
+	// Applying the forward and then the rollback SQL leaves the database
+	// as it was.
+	rows := func() (rows []string) {
+		require.NoError(sqlitex.Exec(conn, `
+SELECT quote(a)||quote(b)||quote(c)||quote(d) FROM t UNION ALL
+SELECT quote(a)||quote(b) FROM t2 ORDER BY 1;`,
+			func(stmt *sqlite.Stmt) error {
+				rows = append(rows, stmt.ColumnText(0))
+				return nil
+			}))
+		return
+	}
+	before := rows()
+	require.NoError(sqlitex.ExecScript(conn, forward))
+	require.NotEqual(before, rows())
+	require.NoError(sqlitex.ExecScript(conn, rollback))
+	require.Equal(before, rows())
+
+	// An UPDATE of the PK is undone by an UPDATE of the new PK back to
+	// the old.
+	var cs testChangeset
+	cs.Table("t2", true, false)
+	cs.Change(sqlite.SQLITE_UPDATE,
+		[]interface{}{int64(1), []byte{0x01, 0xff}},
+		[]interface{}{int64(7), []byte{0x07}})
+	for _, opts := range []Options{{}, {PKUpdateAsDeleteInsert: true}} {
+		forward, rollback, err = opts.ToSQLPair(conn,
+			bytes.NewReader(cs.Bytes()))
+		require.NoError(err, "Options.ToSQLPair")
+		if !opts.PKUpdateAsDeleteInsert {
+			require.Equal(`UPDATE "t2" SET ("a", "b") = (1, X'01FF') WHERE ("a") = (7) /* undo of UPDATE to: (7, X'07') */;
+`, rollback)
+		}
+		require.NoError(sqlitex.ExecScript(conn, forward))
+		require.NotEqual(before, rows())
+		require.NoError(sqlitex.ExecScript(conn, rollback))
+		require.Equal(before, rows(), rollback)
+	}
+}
+
+func TestTableNameCase(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn,
+		`CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT);`))
+
+	var cs testChangeset
+	cs.Table("t", true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(1), "a"})
+	cs.Table("T", true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(2), "b"})
+	var logs []string
+	opts := Options{Logger: func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}}
+	sql, err := opts.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "t" ("id", "v") VALUES (1, 'a');
+
+INSERT INTO "T" ("id", "v") VALUES (2, 'b');
+`, sql)
+	require.Equal([]string{`sqlitechangeset: loaded 2 columns of table "t"`},
+		logs, "the columns should be cached once for both casings")
+
+	Conn := opts.newConn(conn)
+	for _, tbl := range []string{"T", "t"} {
+		_, err = Conn.GetColumns(tbl)
+		require.NoError(err, "_Conn.GetColumns()")
+		_, err = Conn.GetForeignKeys(tbl)
+		require.NoError(err, "_Conn.GetForeignKeys()")
+	}
+	require.Len(Conn.Columns, 1)
+	require.Len(Conn.ForeignKeys, 1)
+}
+
+func TestOptionsHistory(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE t_history (op TEXT, ts TEXT,
+        old_a, new_a, old_b, new_b, old_c, new_c, old_d, new_d);
+CREATE TABLE t2_history (op TEXT, ts TEXT, old_a, new_a, old_b, new_b);`))
+
+	opts := Options{PreserveOrder: true, History: &HistoryTable{
+		Name:     "%s_history",
+		OpColumn: "op", TimeColumn: "ts", Time: "'2020-01-01'",
+		OldPrefix: "old_", NewPrefix: "new_",
+	}}
+	var buf bytes.Buffer
+	sql, err := opts.ToSQL(conn, io.TeeReader(changeset, &buf))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "t_history" ("op", "ts", "old_a", "old_b", "old_c", "new_c") VALUES ('UPDATE', '2020-01-01', 1, 1, 'hello', 'hello world');
+INSERT INTO "t_history" ("op", "ts", "new_a", "new_b", "new_c", "new_d") VALUES ('INSERT', '2020-01-01', 3, 3, 'goodbye world', NULL);
+INSERT INTO "t_history" ("op", "ts", "old_a", "old_b", "old_c", "new_c", "old_d", "new_d") VALUES ('UPDATE', '2020-01-01', 2, 2, 'world', 'world hello', 1.5, 5.25);
+INSERT INTO "t_history" ("op", "ts", "old_a", "old_b", "old_c", "old_d") VALUES ('DELETE', '2020-01-01', 5, 5, 'world', 1.5);
+INSERT INTO "t_history" ("op", "ts", "new_a", "new_b", "new_c", "new_d") VALUES ('INSERT', '2020-01-01', 4, 4, 'goodbye world''', NULL);
+
+INSERT INTO "t2_history" ("op", "ts", "new_a", "new_b") VALUES ('INSERT', '2020-01-01', 0, X'FFFFFF');
+INSERT INTO "t2_history" ("op", "ts", "old_a", "old_b") VALUES ('DELETE', '2020-01-01', 1, X'01FF');
+INSERT INTO "t2_history" ("op", "ts", "old_a", "old_b") VALUES ('DELETE', '2020-01-01', 2, X'02FF');
+`, sql)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+
+	opts.History.NewPrefix = "old_"
+	_, err = opts.ToSQL(conn, bytes.NewReader(buf.Bytes()))
+	require.EqualError(err, `sqlitechangeset: history table OldPrefix and NewPrefix are both "old_"`)
+}
+
+func TestUnsupportedChangesetFormat(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(changeset)
+	require.NoError(err)
+	valid := buf.Bytes()
+	for name, data := range map[string][]byte{
+		"truncated":    valid[:len(valid)-3],
+		"garbage":      {0x01, 0x02, 0x03},
+		"unknown type": {'X', 0x01, 0x02},
+	} {
+		_, err := ToSQL(conn, bytes.NewReader(data))
+		require.True(errors.Is(err, ErrUnsupportedChangesetFormat), name)
+		require.Contains(err.Error(), "SQLITE_CORRUPT", name)
+	}
+
+	// Errors other than the format of the changeset are not wrapped.
+	var cs testChangeset
+	cs.Table("t2", true)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(1)})
+	_, err = ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.True(errors.Is(err, ErrMissingColumns))
+	require.False(errors.Is(err, ErrUnsupportedChangesetFormat))
+}
+
+func TestDump(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var dump strings.Builder
+	require.NoError(Dump(conn, changeset, &dump), "Dump")
+	require.Equal(`table "t"
+  INSERT
+    row
+      "a" [PK]: new 3
+      "b" [PK]: new 3
+      "c": new 'goodbye world'
+      "d": new NULL
+    row
+      "a" [PK]: new 4
+      "b" [PK]: new 4
+      "c": new 'goodbye world'''
+      "d": new NULL
+  UPDATE
+    row
+      "a" [PK]: old 1
+      "b" [PK]: old 1
+      "c": old 'hello', new 'hello world'
+      "d": undefined
+    row
+      "a" [PK]: old 2
+      "b" [PK]: old 2
+      "c": old 'world', new 'world hello'
+      "d": old 1.5, new 5.25
+  DELETE
+    row
+      "a" [PK]: old 5
+      "b" [PK]: old 5
+      "c": old 'world'
+      "d": old 1.5
+table "t2"
+  INSERT
+    row
+      "a" [PK]: new 0
+      "b": new X'FFFFFF'
+  DELETE
+    row
+      "a" [PK]: old 1
+      "b": old X'01FF'
+    row
+      "a" [PK]: old 2
+      "b": old X'02FF'
+`, dump.String())
+}
+
+func TestOptionsPKWatermark(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var buf bytes.Buffer
+	opts := Options{PKWatermark: map[string][]interface{}{
+		"t":  {int64(2), 2},
+		"t2": {1.5},
+	}}
+	sql, err := opts.ToSQL(conn, io.TeeReader(changeset, &buf))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "t" ("a", "b", "c", "d") VALUES (3, 3, 'goodbye world', NULL);
+INSERT INTO "t" ("a", "b", "c", "d") VALUES (4, 4, 'goodbye world''', NULL);
+DELETE FROM "t" WHERE ("a", "b") = (5, 5) /* ("c", "d") = ('world', 1.5) */;
+
+DELETE FROM "t2" WHERE ("a") = (2) /* ("b") = (X'02FF') */;
+`, sql)
+
+	// The key is ordered by the columns of the PRIMARY KEY, and values as
+	// SQLite orders them.
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE k (x, y, PRIMARY KEY (y, x));`))
+	var cs testChangeset
+	cs.Table("k", true, true)
+	for _, row := range [][]interface{}{
+		{int64(9), testNull{}},
+		{int64(1), int64(1)},
+		{int64(2), 1.5},
+		{int64(0), "a"},
+		{"b", "a"},
+		{int64(0), []byte{0x00}},
+	} {
+		cs.Change(sqlite.SQLITE_INSERT, row)
+	}
+	opts.PKWatermark = map[string][]interface{}{"k": {1.5, 2}}
+	sql, err = opts.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "k" ("x", "y") VALUES (0, 'a');
+INSERT INTO "k" ("x", "y") VALUES ('b', 'a');
+INSERT INTO "k" ("x", "y") VALUES (0, X'00');
+`, sql)
+
+	opts.PKWatermark = map[string][]interface{}{"t2": {int64(1), int64(1)}}
+	_, err = opts.ToSQL(conn, bytes.NewReader(buf.Bytes()))
+	require.EqualError(err, `sqlitechangeset: PKWatermark of table "t2" has 2 values but its primary key has 1 columns`)
+}
+
+func TestGeneratedColumns(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE g (
+        id INTEGER PRIMARY KEY,
+        price REAL, qty INT, -- a comment, with a ( paren
+        "total (incl. tax)" REAL GENERATED ALWAYS AS (price * qty * 1.1) STORED,
+        label TEXT AS (printf('%d x %s', qty, ')')),
+        CHECK (qty > 0)
+);`))
+
+	gen, err := GeneratedColumns(conn, "g")
+	require.NoError(err, "GeneratedColumns()")
+	require.Equal([]GeneratedColumn{
+		{Name: "total (incl. tax)", Expr: "price * qty * 1.1", Stored: true},
+		{Name: "label", Expr: "printf('%d x %s', qty, ')')"},
+	}, gen)
+
+	// Changesets do not record generated columns.
+	var cs testChangeset
+	cs.Table("g", true, false, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(1), 2.5, int64(2)})
+	sql, err := Options{GeneratedColumnComments: true}.ToSQL(conn,
+		bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "g" ("id", "price", "qty") VALUES (1, 2.5, 2) /* generated: "total (incl. tax)" AS (price * qty * 1.1) STORED, "label" AS (printf('%d x %s', qty, ')')) VIRTUAL */;
+`, sql)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+}
+
+func TestOptionsBatchUpdates(t *testing.T) {
+	require := require.New(t)
+	const schema = `CREATE TABLE q (id INTEGER PRIMARY KEY, a, b);
+                INSERT INTO q (id, a, b) VALUES (1, 1, 1), (2, 2, 2), (3, 3, 3), (4, 4, 4);`
+
+	src, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer src.Close()
+	require.NoError(sqlitex.ExecScript(src, schema))
+	sess, err := src.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(src, `
+                UPDATE q SET a = 'x' || id WHERE id < 4;
+                UPDATE q SET a = NULL, b = 'y' WHERE id = 4;`))
+
+	sql, err := SessionToSQL(src, sess)
+	require.NoError(err, "SessionToSQL")
+	require.NotContains(sql, "CASE")
+
+	sql, err = Options{BatchUpdates: 2}.SessionToSQL(src, sess)
+	require.NoError(err, "Options.SessionToSQL")
+	require.Equal(3, strings.Count(sql, "UPDATE"), sql)
+	require.Equal(1, strings.Count(sql, "CASE"), sql)
+	require.Regexp(`UPDATE "q" SET "a" = CASE "id" WHEN (\d) THEN 'x\d' WHEN (\d) THEN 'x\d' END WHERE "id" IN \(\d, \d\);`, sql)
+
+	// A batch is not grown past MaxStatementLength.
+	batched := regexp.MustCompile(`UPDATE "q" SET "a" = CASE .*\n`).
+		FindString(sql)
+	sql, err = Options{BatchUpdates: 3, MaxStatementLength: len(batched)}.
+		SessionToSQL(src, sess)
+	require.NoError(err, "Options.SessionToSQL")
+	require.Equal(3, strings.Count(sql, "UPDATE"), sql)
+	require.Equal(1, strings.Count(sql, "CASE"), sql)
+	for _, line := range strings.Split(sql, "\n") {
+		require.LessOrEqual(len(line)+1, len(batched), line)
+	}
+
+	sql, err = Options{BatchUpdates: 3}.SessionToSQL(src, sess)
+	require.NoError(err, "Options.SessionToSQL")
+	require.Equal(2, strings.Count(sql, "UPDATE"), sql)
+	require.Contains(sql, `WHERE "id" IN (`)
+
+	dst, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer dst.Close()
+	require.NoError(sqlitex.ExecScript(dst, schema))
+	require.NoError(sqlitex.ExecScript(dst, sql))
+	var rows []string
+	require.NoError(sqlitex.Exec(dst,
+		`SELECT quote(a) || ',' || quote(b) FROM q ORDER BY id;`,
+		func(stmt *sqlite.Stmt) error {
+			rows = append(rows, stmt.ColumnText(0))
+			return nil
+		}))
+	require.Equal([]string{`'x1',1`, `'x2',2`, `'x3',3`, `NULL,'y'`}, rows)
+}
+
+func TestOptionsReadTransaction(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var inTx []bool
+	opts := Options{ReadTransaction: true,
+		RowFilter: func(string, map[string]interface{}) bool {
+			inTx = append(inTx, !conn.GetAutocommit())
+			return true
+		}}
+	var buf bytes.Buffer
+	sql, err := opts.ToSQL(conn, io.TeeReader(changeset, &buf))
+	require.NoError(err, "Options.ToSQL")
+	require.NotEmpty(inTx)
+	require.NotContains(inTx, false)
+	require.True(conn.GetAutocommit(), "transaction left open")
+
+	// An open transaction is used and left open.
+	require.NoError(sqlitex.Exec(conn, `BEGIN;`, nil))
+	sql2, err := opts.ToSQL(conn, bytes.NewReader(buf.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(sql, sql2)
+	require.False(conn.GetAutocommit(), "transaction ended")
+	require.NoError(sqlitex.Exec(conn, `COMMIT;`, nil))
+
+	inTx = nil
+	var stream strings.Builder
+	_, err = opts.SessionToSQLStream(conn, sess, &stream)
+	require.NoError(err, "Options.SessionToSQLStream")
+	require.NotContains(inTx, false)
+	require.True(conn.GetAutocommit(), "transaction left open")
+}
+
+func TestOptionsDisableTriggers(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	const trigger = `CREATE TRIGGER "log t" AFTER INSERT ON t BEGIN INSERT INTO log VALUES (new.a); END`
+	require.NoError(sqlitex.ExecScript(conn,
+		`CREATE TABLE log (a);`+trigger+`;`))
+
+	sql, err := Options{DisableTriggers: true}.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.True(strings.HasPrefix(sql, `DROP TRIGGER IF EXISTS "log t";`+"\n"), sql)
+	require.True(strings.HasSuffix(sql, "\n"+trigger+";\n"), sql)
+
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	var n int64
+	require.NoError(sqlitex.Exec(conn, `SELECT count(*) FROM log;`,
+		func(stmt *sqlite.Stmt) error {
+			n = stmt.ColumnInt64(0)
+			return nil
+		}))
+	require.Equal(int64(0), n)
+	require.NoError(sqlitex.Exec(conn, `SELECT count(*) FROM sqlite_master
+                WHERE type = 'trigger';`,
+		func(stmt *sqlite.Stmt) error {
+			n = stmt.ColumnInt64(0)
+			return nil
+		}))
+	require.Equal(int64(1), n)
+}
+
+func TestDecode(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var buf bytes.Buffer
+	ops, err := Decode(conn, io.TeeReader(changeset, &buf))
+	require.NoError(err, "Decode")
+	require.Len(ops, 8)
+	require.Equal(Op{Table: "t", Type: sqlite.SQLITE_UPDATE,
+		Key: map[string]interface{}{"a": int64(2), "b": int64(2)},
+		Old: map[string]interface{}{"a": int64(2), "b": int64(2),
+			"c": "world", "d": 1.5},
+		New: map[string]interface{}{"c": "world hello", "d": 5.25},
+	}, ops[2])
+	require.Equal(Op{Table: "t2", Type: sqlite.SQLITE_DELETE,
+		Key: map[string]interface{}{"a": int64(1)},
+		Old: map[string]interface{}{"a": int64(1), "b": []byte{0x01, 0xff}},
+	}, ops[6])
+
+	ops, err = Options{Invert: true}.Decode(conn, &buf)
+	require.NoError(err, "Options.Decode")
+	require.Equal(sqlite.SQLITE_INSERT, ops[6].Type)
+	require.Equal(map[string]interface{}{"a": int64(1), "b": []byte{0x01, 0xff}},
+		ops[6].New)
+}
+
+func TestOptionsConflictResolver(t *testing.T) {
+	require := require.New(t)
+	const schema = `CREATE TABLE s (a INTEGER PRIMARY KEY, b TEXT, c TEXT);`
+	src, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer src.Close()
+	require.NoError(sqlitex.ExecScript(src, schema+`
+INSERT INTO s (a, b, c) VALUES (2, 'old', 'c'), (3, 'x', 'y');`))
+	sess, err := src.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(src, `
+INSERT INTO s (a, b, c) VALUES (1, 'src', 'src');
+UPDATE s SET b = 'new' WHERE a = 2;
+UPDATE s SET b = 'new' WHERE a = 3;`))
+	var changeset bytes.Buffer
+	require.NoError(sess.Changeset(&changeset))
+	data := changeset.Bytes()
+
+	dst, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer dst.Close()
+	require.NoError(sqlitex.ExecScript(dst, schema+`
+INSERT INTO s (a, b, c) VALUES (1, 'dst', 'dst'), (2, 'other', 'keep');`))
+
+	type conflict struct {
+		op              sqlite.OpType
+		local, incoming map[string]interface{}
+	}
+	conflicts := make(map[int64]conflict)
+	resolutions := map[int64]Resolution{1: UseLocal, 2: UseIncoming, 3: Skip}
+	var logged []string
+	opts := Options{
+		ConflictResolver: func(table string, op sqlite.OpType,
+			local, incoming map[string]interface{}) Resolution {
+			require.Equal("s", table)
+			a := incoming["a"].(int64)
+			conflicts[a] = conflict{op, local, incoming}
+			return resolutions[a]
+		},
+		Logger: func(format string, args ...interface{}) {
+			logged = append(logged, fmt.Sprintf(format, args...))
+		}}
+	var sql string
+	handler := opts.ConflictHandler(dst, func(stmt string) { sql += stmt })
+	require.NoError(dst.ChangesetApply(bytes.NewReader(data), nil, handler))
+	require.Equal(map[int64]conflict{
+		1: {sqlite.SQLITE_INSERT,
+			map[string]interface{}{"a": int64(1), "b": "dst", "c": "dst"},
+			map[string]interface{}{"a": int64(1), "b": "src", "c": "src"}},
+		2: {sqlite.SQLITE_UPDATE,
+			map[string]interface{}{"a": int64(2), "b": "other", "c": "keep"},
+			map[string]interface{}{"a": int64(2), "b": "new"}},
+		3: {sqlite.SQLITE_UPDATE, nil,
+			map[string]interface{}{"a": int64(3), "b": "new"}},
+	}, conflicts)
+	require.Equal(`DELETE FROM "s" WHERE ("a") = (2) /* ("b", "c") = ('other', 'keep') */;
+INSERT INTO "s" ("a", "b", "c") VALUES (2, 'new', 'keep');
+`, sql)
+	require.Contains(logged, `sqlitechangeset: skipping conflicting SQLITE_UPDATE of "s" map[a:3]: SQLITE_CHANGESET_NOTFOUND`)
+
+	// Abort aborts the apply.
+	resolutions[1] = Abort
+	sql, logged = "", nil
+	require.Error(dst.ChangesetApply(bytes.NewReader(data), nil, handler))
+	require.Empty(sql)
+	require.NotEmpty(logged)
+}
+
+func TestUpdateToNull(t *testing.T) {
+	require := require.New(t)
+	conn, sess, _ := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	nsess, err := conn.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer nsess.Delete()
+	require.NoError(nsess.Attach("t"), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(conn,
+		`UPDATE t SET c = NULL WHERE a = 1 AND b = 1;`))
+
+	sql, err := SessionToSQL(conn, nsess)
+	require.NoError(err, "SessionToSQL")
+	require.Equal(`UPDATE "t" SET ("c") = (NULL) WHERE ("a", "b") = (1, 1) /* old: ('hello') */;
+`, sql)
+
+	require.NoError(sqlitex.ExecScript(conn,
+		`UPDATE t SET c = 'hello' WHERE a = 1 AND b = 1;`))
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	var typ string
+	require.NoError(sqlitex.Exec(conn, `SELECT typeof(c) FROM t WHERE a = 1;`,
+		func(stmt *sqlite.Stmt) error {
+			typ = stmt.ColumnText(0)
+			return nil
+		}))
+	require.Equal("null", typ)
+}
+
+func TestUndefinedAndNull(t *testing.T) {
+	require := require.New(t)
+	const schema = `CREATE TABLE q (id INTEGER PRIMARY KEY, a, b DEFAULT 'd');
+                INSERT INTO q (id, a, b) VALUES (1, 'x', 'y'), (3, 'z', 'z');`
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn, schema))
+	sess, err := conn.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(conn, `
+                UPDATE q SET a = NULL WHERE id = 1;
+                INSERT INTO q (id, a, b) VALUES (2, NULL, NULL);
+                DELETE FROM q WHERE id = 3;`))
+	var changeset, patchset bytes.Buffer
+	require.NoError(sess.Changeset(&changeset))
+	require.NoError(sess.Patchset(&patchset))
+
+	// Values defined as NULL are present, while undefined values are
+	// not.
+	ops, err := Decode(conn, bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "Decode")
+	require.Equal([]Op{{Table: "q", Type: sqlite.SQLITE_UPDATE,
+		Key: map[string]interface{}{"id": int64(1)},
+		Old: map[string]interface{}{"id": int64(1), "a": "x"},
+		New: map[string]interface{}{"a": nil},
+	}, {Table: "q", Type: sqlite.SQLITE_INSERT,
+		Key: map[string]interface{}{"id": int64(2)},
+		New: map[string]interface{}{"id": int64(2), "a": nil, "b": nil},
+	}, {Table: "q", Type: sqlite.SQLITE_DELETE,
+		Key: map[string]interface{}{"id": int64(3)},
+		Old: map[string]interface{}{"id": int64(3), "a": "z", "b": "z"},
+	}}, ops)
+	ops, err = Decode(conn, bytes.NewReader(patchset.Bytes()))
+	require.NoError(err, "Decode")
+	require.Equal(map[string]interface{}{"id": int64(1)}, ops[0].Old)
+	require.Equal(map[string]interface{}{"a": nil}, ops[0].New)
+	require.Equal(map[string]interface{}{"id": int64(3)}, ops[2].Old)
+
+	sql, err := ToSQL(conn, bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "ToSQL")
+	require.Equal(`INSERT INTO "q" ("id", "a", "b") VALUES (2, NULL, NULL);
+UPDATE "q" SET ("a") = (NULL) WHERE ("id") = (1) /* old: ('x') */;
+DELETE FROM "q" WHERE ("id") = (3) /* ("a", "b") = ('z', 'z') */;
+`, sql)
+	psql, err := ToSQL(conn, bytes.NewReader(patchset.Bytes()))
+	require.NoError(err, "ToSQL")
+	require.Equal(`INSERT INTO "q" ("id", "a", "b") VALUES (2, NULL, NULL);
+UPDATE "q" SET ("a") = (NULL) WHERE ("id") = (1);
+DELETE FROM "q" WHERE ("id") = (3);
+`, psql)
+
+	// Both leave the target as the source.
+	for _, sql := range []string{sql, psql} {
+		dst, err := sqlite.OpenConn(":memory:", 0)
+		require.NoError(err, "sqlite.OpenConn()")
+		defer dst.Close()
+		require.NoError(sqlitex.ExecScript(dst, schema))
+		require.NoError(sqlitex.ExecScript(dst, sql))
+		var rows []string
+		require.NoError(sqlitex.Exec(dst,
+			`SELECT quote(id), quote(a), quote(b) FROM q ORDER BY id;`,
+			func(stmt *sqlite.Stmt) error {
+				rows = append(rows, stmt.ColumnText(0)+" "+
+					stmt.ColumnText(1)+" "+stmt.ColumnText(2))
+				return nil
+			}))
+		require.Equal([]string{"1 NULL 'y'", "2 NULL NULL"}, rows)
+	}
+}
+
+func TestInsertNullOverDefault(t *testing.T) {
+	require := require.New(t)
+	src, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer src.Close()
+	require.NoError(sqlitex.ExecScript(src,
+		`CREATE TABLE q (id INTEGER PRIMARY KEY, c TEXT);`))
+	sess, err := src.CreateSession("")
+	require.NoError(err, "sqlite.Conn.CreateSession()")
+	defer sess.Delete()
+	require.NoError(sess.Attach(""), "sqlite.Session.Attach()")
+	require.NoError(sqlitex.ExecScript(src,
+		`INSERT INTO q (id) VALUES (1);`))
+
+	sql, err := SessionToSQL(src, sess)
+	require.NoError(err, "SessionToSQL")
+	require.Equal(`INSERT INTO "q" ("id", "c") VALUES (1, NULL);
+`, sql)
+
+	// The NULL is inserted in place of the default of the target.
+	dst, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer dst.Close()
+	require.NoError(sqlitex.ExecScript(dst,
+		`CREATE TABLE q (id INTEGER PRIMARY KEY, c TEXT DEFAULT 'default');`))
+	require.NoError(sqlitex.ExecScript(dst, sql))
+	var c string
+	require.NoError(sqlitex.Exec(dst, `SELECT quote(c) FROM q WHERE id = 1;`,
+		func(stmt *sqlite.Stmt) error {
+			c = stmt.ColumnText(0)
+			return nil
+		}))
+	require.Equal("NULL", c)
+}
+
+func TestOptionsFloatPrecision(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn,
+		`CREATE TABLE f (a INTEGER PRIMARY KEY, d DOUBLE, x);`))
+
+	var changeset testChangeset
+	changeset.Table("f", true, false, false)
+	changeset.Change(sqlite.SQLITE_INSERT,
+		[]interface{}{int64(1), float64(1) / 3, float64(5)})
+	changeset.Change(sqlite.SQLITE_INSERT,
+		[]interface{}{int64(2), float64(1234567.5), float64(2.5e-7)})
+
+	sql, err := Options{FloatPrecision: 0}.ToSQL(conn,
+		bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "f" ("a", "d", "x") VALUES (1, 0.3333333333333333, 5);
+INSERT INTO "f" ("a", "d", "x") VALUES (2, 1.2345675e+06, 2.5e-07);
+`, sql)
+
+	sql, err = Options{FloatPrecision: 6}.ToSQL(conn,
+		bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "f" ("a", "d", "x") VALUES (1, 0.333333, 5);
+INSERT INTO "f" ("a", "d", "x") VALUES (2, 1.23457e+06, 2.5e-07);
+`, sql)
+
+	sql, err = Options{FloatPrecision: 6, WholeFloatsAsReal: true}.ToSQL(
+		conn, bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Contains(sql, `VALUES (1, 0.333333, 5.0);`)
+
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	var d float64
+	require.NoError(sqlitex.Exec(conn, `SELECT d FROM f WHERE a = 1;`,
+		func(stmt *sqlite.Stmt) error {
+			d = stmt.ColumnFloat(0)
+			return nil
+		}))
+	require.Equal(0.333333, d)
+}
+
+func TestOptionsDeferForeignKeys(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.Exec(conn, `PRAGMA foreign_keys = ON;`, nil))
+	require.NoError(sqlitex.ExecScript(conn, `
+CREATE TABLE a (id INTEGER PRIMARY KEY, b INTEGER REFERENCES b);
+CREATE TABLE b (id INTEGER PRIMARY KEY, a INTEGER REFERENCES a);`))
+
+	// The rows of a and b reference each other.
+	var cs testChangeset
+	cs.Table("a", true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(1), int64(1)})
+	cs.Table("b", true, false)
+	cs.Change(sqlite.SQLITE_INSERT, []interface{}{int64(1), int64(1)})
+
+	unordered, err := ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "ToSQL")
+	require.Error(sqlitex.ExecScript(conn, unordered))
+	_, err = Options{OrderByDependencies: true}.ToSQL(conn,
+		bytes.NewReader(cs.Bytes()))
+	require.True(errors.Is(err, ErrForeignKeyCycle), err)
+
+	sql, err := Options{DeferForeignKeys: true, OrderByDependencies: true}.
+		ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`SAVEPOINT "sqlitechangeset.DeferForeignKeys";
+PRAGMA defer_foreign_keys=ON;
+INSERT INTO "b" ("id", "a") VALUES (1, 1);
+
+INSERT INTO "a" ("id", "b") VALUES (1, 1);
+RELEASE "sqlitechangeset.DeferForeignKeys";
+`, sql)
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	var n int64
+	require.NoError(sqlitex.Exec(conn,
+		`SELECT (SELECT count(*) FROM a) + (SELECT count(*) FROM b);`,
+		func(stmt *sqlite.Stmt) error {
+			n = stmt.ColumnInt64(0)
+			return nil
+		}))
+	require.Equal(int64(2), n)
+
+	// A violation remaining once all changes are applied still fails.
+	var bad testChangeset
+	bad.Table("a", true, false)
+	bad.Change(sqlite.SQLITE_INSERT, []interface{}{int64(2), int64(2)})
+	sql, err = Options{DeferForeignKeys: true}.ToSQL(conn,
+		bytes.NewReader(bad.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Error(sqlitex.ExecScript(conn, sql))
+}
+
+func TestOptionsDumpCompatible(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	opts := Options{DumpCompatible: true,
+		Prologue: "-- prologue\n", Epilogue: "-- epilogue\n"}
+	sql, err := opts.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.True(strings.HasPrefix(sql, `PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+-- prologue
+INSERT INTO "t" `), sql)
+	require.True(strings.HasSuffix(sql, `;
+-- epilogue
+COMMIT;
+`), sql)
+
+	// The script begins its own transaction, so it is applied one
+	// statement at a time rather than by ExecScript.
+	for script := sql; strings.TrimSpace(script) != ""; {
+		stmt, trailing, err := conn.PrepareTransient(script)
+		require.NoError(err, "sqlite.Conn.PrepareTransient()")
+		script = script[len(script)-trailing:]
+		if stmt == nil {
+			continue
+		}
+		_, err = stmt.Step()
+		require.NoError(err, "sqlite.Stmt.Step()")
+		require.NoError(stmt.Finalize())
+	}
+	require.True(conn.GetAutocommit(), "transaction left open")
+	var n int64
+	require.NoError(sqlitex.Exec(conn, `SELECT count(*) FROM t;`,
+		func(stmt *sqlite.Stmt) error {
+			n = stmt.ColumnInt64(0)
+			return nil
+		}))
+	require.Equal(int64(4), n)
+}
+
+func TestRecords(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	records, err := Records(conn, changeset)
+	require.NoError(err, "Records")
+	require.Len(records, 8)
+	integer := func(i int64) Value { return Value{sqlite.SQLITE_INTEGER, i} }
+	require.Equal(ChangeRecord{Table: "t", Op: "UPDATE",
+		PK: map[string]Value{"a": integer(2), "b": integer(2)},
+		Old: map[string]Value{"a": integer(2), "b": integer(2),
+			"c": {sqlite.SQLITE_TEXT, "world"},
+			"d": {sqlite.SQLITE_FLOAT, 1.5}},
+		New: map[string]Value{"c": {sqlite.SQLITE_TEXT, "world hello"},
+			"d": {sqlite.SQLITE_FLOAT, 5.25}},
+	}, records[2])
+	require.Equal(ChangeRecord{Table: "t", Op: "INSERT",
+		PK: map[string]Value{"a": integer(3), "b": integer(3)},
+		New: map[string]Value{"a": integer(3), "b": integer(3),
+			"c": {sqlite.SQLITE_TEXT, "goodbye world"},
+			"d": {sqlite.SQLITE_NULL, nil}},
+	}, records[1])
+	require.Equal(ChangeRecord{Table: "t2", Op: "DELETE",
+		PK: map[string]Value{"a": integer(2)},
+		Old: map[string]Value{"a": integer(2),
+			"b": {sqlite.SQLITE_BLOB, []byte{0x02, 0xff}}},
+	}, records[7])
+}
+
+func TestOptionsValueTransforms(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	upper := func(table, column string, v Value) (Value, bool) {
+		if s, ok := v.V.(string); ok {
+			v.V = strings.ToUpper(s)
+		}
+		return v, false
+	}
+	prefix := func(table, column string, v Value) (Value, bool) {
+		if s, ok := v.V.(string); ok && table == "t" && column == "c" {
+			return Value{sqlite.SQLITE_TEXT, "x:" + s}, true
+		}
+		return v, false
+	}
+	never := func(table, column string, v Value) (Value, bool) {
+		if column == "c" {
+			v.V = "never"
+		}
+		return v, false
+	}
+	opts := Options{ValueTransforms: []ValueTransform{upper, prefix, never},
+		MaskValue: func(table, column string, v sqlite.Value) (string, bool) {
+			return "0.0", column == "d" && v.Type() == sqlite.SQLITE_FLOAT
+		}}
+	sql, err := opts.ToSQL(conn, changeset)
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "t" ("a", "b", "c", "d") VALUES (3, 3, 'x:GOODBYE WORLD', NULL);
+INSERT INTO "t" ("a", "b", "c", "d") VALUES (4, 4, 'x:GOODBYE WORLD''', NULL);
+UPDATE "t" SET ("c") = ('x:HELLO WORLD') WHERE ("a", "b") = (1, 1) /* old: ('x:HELLO') */;
+UPDATE "t" SET ("c", "d") = ('x:WORLD HELLO', 0.0) WHERE ("a", "b") = (2, 2) /* old: ('x:WORLD', 0.0) */;
+DELETE FROM "t" WHERE ("a", "b") = (5, 5) /* ("c", "d") = ('x:WORLD', 0.0) */;
+
+INSERT INTO "t2" ("a", "b") VALUES (0, X'FFFFFF');
+DELETE FROM "t2" WHERE ("a") = (1) /* ("b") = (X'01FF') */;
+DELETE FROM "t2" WHERE ("a") = (2) /* ("b") = (X'02FF') */;
+`, sql)
+}
+
+func TestOptionsValueTransformsGoTypes(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn,
+		`CREATE TABLE g (a INTEGER PRIMARY KEY, b, c, d, e);`))
+	var cs testChangeset
+	cs.Table("g", true, false, false, false, false)
+	cs.Change(sqlite.SQLITE_INSERT,
+		[]interface{}{int64(1), "b", "c", "d", "e"})
+
+	// Values of other Go integer types, bool and float32 are converted.
+	opts := Options{ValueTransforms: []ValueTransform{
+		func(table, column string, v Value) (Value, bool) {
+			switch column {
+			case "b":
+				v.V = 7
+			case "c":
+				v.V = uint32(8)
+			case "d":
+				v.V = true
+			case "e":
+				v.V = float32(0.5)
+			}
+			return v, false
+		}}}
+	sql, err := opts.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`INSERT INTO "g" ("a", "b", "c", "d", "e") VALUES (1, 7, 8, 1, 0.5);
+`, sql)
+
+	// Any other type is an error, including one which is not comparable.
+	for _, v := range []interface{}{[]int{1}, uint64(math.MaxUint64)} {
+		v := v
+		opts.ValueTransforms = []ValueTransform{
+			func(table, column string, in Value) (Value, bool) {
+				if column == "c" {
+					in.V = v
+				}
+				return in, false
+			}}
+		_, err = opts.ToSQL(conn, bytes.NewReader(cs.Bytes()))
+		require.True(errors.Is(err, ErrUnsupportedValueType), err)
+		require.Contains(err.Error(), `column "c" of table "g"`)
+	}
+}
+
+func TestInt64Range(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn,
+		`CREATE TABLE i (a INTEGER PRIMARY KEY, x);`))
+
+	vals := []int64{math.MinInt64, math.MinInt32 - 1, -1, 0,
+		math.MaxInt32 + 1, 1<<53 + 1, math.MaxInt64}
+	var changeset testChangeset
+	changeset.Table("i", true, false)
+	for i, v := range vals {
+		changeset.Change(sqlite.SQLITE_INSERT,
+			[]interface{}{int64(i), v})
+	}
+
+	sql, err := ToSQL(conn, bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "ToSQL")
+	require.Contains(sql, `VALUES (0, -9223372036854775808);`)
+	require.Contains(sql, `VALUES (1, -2147483649);`)
+	require.Contains(sql, `VALUES (4, 2147483648);`)
+	require.Contains(sql, `VALUES (5, 9007199254740993);`)
+	require.Contains(sql, `VALUES (6, 9223372036854775807);`)
+
+	ops, err := Decode(conn, bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "Decode")
+	for i, v := range vals {
+		require.Equal(v, ops[i].New["x"])
+	}
+
+	require.NoError(sqlitex.ExecScript(conn, sql))
+	var got []int64
+	require.NoError(sqlitex.Exec(conn,
+		`SELECT x FROM i WHERE typeof(x) = 'integer' ORDER BY a;`,
+		func(stmt *sqlite.Stmt) error {
+			got = append(got, stmt.ColumnInt64(0))
+			return nil
+		}))
+	require.Equal(vals, got)
+}
+
+func TestOptionsSavepointEvery(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	var buf bytes.Buffer
+	sql, err := Options{SavepointEvery: 3}.ToSQL(conn,
+		io.TeeReader(changeset, &buf))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(`SAVEPOINT "batch_1";
+INSERT INTO "t" ("a", "b", "c", "d") VALUES (3, 3, 'goodbye world', NULL);
+INSERT INTO "t" ("a", "b", "c", "d") VALUES (4, 4, 'goodbye world''', NULL);
+UPDATE "t" SET ("c") = ('hello world') WHERE ("a", "b") = (1, 1) /* old: ('hello') */;
+RELEASE "batch_1";
+SAVEPOINT "batch_2";
+UPDATE "t" SET ("c", "d") = ('world hello', 5.25) WHERE ("a", "b") = (2, 2) /* old: ('world', 1.5) */;
+DELETE FROM "t" WHERE ("a", "b") = (5, 5) /* ("c", "d") = ('world', 1.5) */;
+
+INSERT INTO "t2" ("a", "b") VALUES (0, X'FFFFFF');
+RELEASE "batch_2";
+SAVEPOINT "batch_3";
+DELETE FROM "t2" WHERE ("a") = (1) /* ("b") = (X'01FF') */;
+DELETE FROM "t2" WHERE ("a") = (2) /* ("b") = (X'02FF') */;
+RELEASE "batch_3";
+`, sql)
+
+	streamed, err := Options{SavepointEvery: 4, NoGrouping: true}.ToSQL(
+		conn, bytes.NewReader(buf.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.Equal(2, strings.Count(streamed, `SAVEPOINT "batch_`))
+	require.Equal(2, strings.Count(streamed, `RELEASE "batch_`))
+	require.True(strings.HasSuffix(streamed, "RELEASE \"batch_2\";\n"))
+
+	// The savepoints would overlap those of TransactionPerTable.
+	perTable, err := Options{SavepointEvery: 3, TransactionPerTable: true}.
+		ToSQL(conn, bytes.NewReader(buf.Bytes()))
+	require.NoError(err, "Options.ToSQL")
+	require.NotContains(perTable, "batch_")
+
+	require.NoError(sqlitex.ExecScript(conn, sql))
+}
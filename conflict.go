@@ -0,0 +1,175 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"fmt"
+
+	"crawshaw.io/sqlite"
+)
+
+// ErrUnresolvableConflict is returned by ConflictResolutionSQL for conflict
+// types which cannot be resolved by changing the conflicting row alone.
+var ErrUnresolvableConflict = fmt.Errorf(
+	"sqlitechangeset: conflict cannot be resolved by changing its row")
+
+// ErrConflictAborted is returned by ConflictResolutionSQL when the
+// ConflictResolver resolves a conflict with Abort.
+var ErrConflictAborted = fmt.Errorf(
+	"sqlitechangeset: conflict resolution aborted")
+
+// Resolution is the resolution of a conflict chosen by a ConflictResolver.
+type Resolution int
+
+const (
+	// UseLocal keeps the conflicting row of the target, omitting the
+	// change.
+	UseLocal Resolution = iota
+	// UseIncoming resolves the conflict in favor of the change, as
+	// ConflictResolutionSQL does without a ConflictResolver.
+	UseIncoming
+	// Skip omits the change, like UseLocal, and reports it to the
+	// Logger.
+	Skip
+	// Abort aborts applying the changeset.
+	Abort
+)
+
+// resolve returns the Resolution of the ConflictResolver for the conflict of
+// conflictType for the change of iter, or UseIncoming if there is none. The
+// change of a foreign key conflict cannot be read, so it is always
+// UseIncoming.
+func (opts Options) resolve(conn *sqlite.Conn,
+	conflictType sqlite.ConflictType,
+	iter sqlite.ChangesetIter) (Resolution, error) {
+	if opts.ConflictResolver == nil ||
+		conflictType == sqlite.SQLITE_CHANGESET_FOREIGN_KEY {
+		return UseIncoming, nil
+	}
+	c, err := opts.newConn(conn).ReadChange(iter,
+		conflictType == sqlite.SQLITE_CHANGESET_DATA ||
+			conflictType == sqlite.SQLITE_CHANGESET_CONFLICT)
+	if err != nil {
+		return 0, err
+	}
+	var incoming map[string]interface{}
+	if c.Op != sqlite.SQLITE_DELETE {
+		incoming = c.PKValues()
+		for col, val := range c.values(c.New) {
+			incoming[col] = val
+		}
+	}
+	res := opts.ConflictResolver(c.Table, c.Op, c.values(c.Conflict),
+		incoming)
+	if res == Skip {
+		opts.logf("skipping conflicting %v of %q %v: %v", c.Op, c.Table,
+			c.PKValues(), conflictType)
+	}
+	return res, nil
+}
+
+// ConflictResolutionSQL returns the SQL which resolves the conflict of
+// conflictType for the change of iter, as passed to the conflict handler of
+// sqlite.Conn.ChangesetApply, using the default Options.
+func ConflictResolutionSQL(conn *sqlite.Conn, conflictType sqlite.ConflictType,
+	iter sqlite.ChangesetIter) (string, error) {
+	return Options{}.ConflictResolutionSQL(conn, conflictType, iter)
+}
+
+// ConflictResolutionSQL returns the SQL which resolves the conflict of
+// conflictType for the change of iter, as passed to the conflict handler of
+// sqlite.Conn.ChangesetApply, in favor of the changeset. What the SQL does
+// depends on the conflict type:
+//
+//   - SQLITE_CHANGESET_DATA: the row of an UPDATE or DELETE exists, but its
+//     old values differ from the change. The conflicting row is deleted and,
+//     for an UPDATE, inserted as the change leaves it, as with
+//     ConflictSourceWins.
+//
+//   - SQLITE_CHANGESET_CONFLICT: the primary key of an INSERT already exists.
+//     The conflicting row is deleted and the row of the INSERT inserted.
+//
+//   - SQLITE_CHANGESET_NOTFOUND: the row of an UPDATE or DELETE does not
+//     exist, so there are no conflicting values. A DELETE is already done and
+//     the SQL is empty. An UPDATE is rendered as with UpdateAsUpsert, so the
+//     row is created with only its primary key and the updated columns.
+//
+//   - SQLITE_CHANGESET_CONSTRAINT and SQLITE_CHANGESET_FOREIGN_KEY: applying
+//     the change violates a constraint other than the primary key, or the
+//     changeset as a whole leaves foreign keys unsatisfied. No values of the
+//     conflicting rows are available, so ErrUnresolvableConflict is returned.
+//
+// With a ConflictResolver, the SQL is empty unless it resolves the conflict
+// with UseIncoming, and ErrConflictAborted is returned if it resolves it with
+// Abort.
+func (opts Options) ConflictResolutionSQL(conn *sqlite.Conn,
+	conflictType sqlite.ConflictType, iter sqlite.ChangesetIter) (string, error) {
+	res, err := opts.resolve(conn, conflictType, iter)
+	if err != nil {
+		return "", err
+	}
+	switch res {
+	case UseLocal, Skip:
+		return "", nil
+	case Abort:
+		return "", fmt.Errorf("%w: %v", ErrConflictAborted, conflictType)
+	}
+	switch conflictType {
+	case sqlite.SQLITE_CHANGESET_DATA, sqlite.SQLITE_CHANGESET_CONFLICT:
+		opts.ConflictSourceWins = true
+		return opts.ConflictChangesetIterToSQL(conn, iter)
+	case sqlite.SQLITE_CHANGESET_NOTFOUND:
+		opts.UpdateAsUpsert = true
+		Conn := opts.newConn(conn)
+		c, err := Conn.ReadChange(iter, false)
+		if err != nil {
+			return "", err
+		}
+		if c.Op == sqlite.SQLITE_DELETE {
+			return "", nil
+		}
+		return Conn.BuildSQL(c)
+	default:
+		return "", fmt.Errorf("%w: %v", ErrUnresolvableConflict, conflictType)
+	}
+}
+
+// ConflictHandler returns a conflict handler for sqlite.Conn.ChangesetApply
+// which omits each conflicting change and instead passes the SQL resolving it,
+// from ConflictResolutionSQL, to resolve. The SQL should be executed once
+// ChangesetApply returns, as it would otherwise conflict with the changes
+// still being applied. A conflict which cannot be resolved aborts
+// ChangesetApply, and is reported to the Logger.
+func (opts Options) ConflictHandler(conn *sqlite.Conn, resolve func(sql string)) func(
+	sqlite.ConflictType, sqlite.ChangesetIter) sqlite.ConflictAction {
+	return func(conflictType sqlite.ConflictType,
+		iter sqlite.ChangesetIter) sqlite.ConflictAction {
+		sql, err := opts.ConflictResolutionSQL(conn, conflictType, iter)
+		if err != nil {
+			opts.logf("aborting apply: %v", err)
+			return sqlite.SQLITE_CHANGESET_ABORT
+		}
+		if sql != "" {
+			resolve(sql)
+		}
+		return sqlite.SQLITE_CHANGESET_OMIT
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"io"
+
+	"crawshaw.io/sqlite"
+)
+
+// Converter converts changesets into SQL using a single connection and
+// Options, caching the columns, foreign keys and generated columns of each
+// table across conversions rather than querying them again for each
+// changeset, as well as the PK declared for each table by the changesets. Like the sqlite.Conn it uses, a Converter must not be used
+// concurrently.
+//
+// The cache is not updated when the schema changes, so Reset must be called
+// after any change to the columns of a table, such as by ALTER TABLE, before
+// converting changesets for the new schema. Only the columns of a table with
+// fewer columns than a change, as after ALTER TABLE ADD COLUMN, are queried
+// again without a Reset.
+type Converter struct {
+	conn *sqlite.Conn
+	opts Options
+}
+
+// NewConverter returns a Converter which converts changesets on conn using
+// opts.
+func NewConverter(conn *sqlite.Conn, opts Options) *Converter {
+	opts.columns = make(map[string][]ColumnInfo)
+	opts.foreignKeys = make(map[string][]ForeignKey)
+	opts.generated = make(map[string][]GeneratedColumn)
+	opts.pks = make(map[string][]bool)
+	return &Converter{conn: conn, opts: opts}
+}
+
+// ToSQL is like Options.ToSQL.
+func (cv *Converter) ToSQL(changeset io.Reader) (string, error) {
+	return cv.opts.ToSQL(cv.conn, changeset)
+}
+
+// WriteSQL is like Options.WriteSQL.
+func (cv *Converter) WriteSQL(w io.Writer, changeset io.Reader) (Report, error) {
+	return cv.opts.WriteSQL(w, cv.conn, changeset)
+}
+
+// Reset clears the cached metadata of all tables, so that it is queried
+// again by the next conversion.
+func (cv *Converter) Reset() {
+	for tbl := range cv.opts.columns {
+		delete(cv.opts.columns, tbl)
+	}
+	for tbl := range cv.opts.foreignKeys {
+		delete(cv.opts.foreignKeys, tbl)
+	}
+	for tbl := range cv.opts.generated {
+		delete(cv.opts.generated, tbl)
+	}
+	for tbl := range cv.opts.pks {
+		delete(cv.opts.pks, tbl)
+	}
+}
+
+// PK returns the PK flag of each column of tbl, as declared by the last
+// change to tbl converted, or nil if no change to tbl has been converted
+// since the last Reset. The first column of a table without a PRIMARY KEY
+// may be its rowid.
+func (cv *Converter) PK(tbl string) []bool {
+	pk := cv.opts.pks[tableKey(tbl)]
+	if pk == nil {
+		return nil
+	}
+	return append([]bool(nil), pk...)
+}
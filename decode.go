@@ -0,0 +1,172 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"io"
+	"strings"
+
+	"crawshaw.io/sqlite"
+)
+
+// Op is a decoded change of a changeset, for applying changes by means other
+// than SQL, such as to a remote API or a different store.
+//
+// The values of the columns are keyed by column name and are an int64,
+// float64, string, []byte, or nil for NULL. As for a ChangeEvent, a column is
+// only present in Old or New if the change defines its value.
+type Op struct {
+	Table string
+	// Type is SQLITE_INSERT, SQLITE_UPDATE or SQLITE_DELETE.
+	Type sqlite.OpType
+	// Key holds the primary key of the row, as it was prior to the change
+	// unless the change is an INSERT.
+	Key map[string]interface{}
+	// Old holds the old values of an UPDATE or DELETE, and New the new
+	// values of an INSERT or UPDATE.
+	Old, New map[string]interface{}
+}
+
+// Decode returns the changes of changeset as Ops using the default Options.
+func Decode(conn *sqlite.Conn, changeset io.Reader) ([]Op, error) {
+	return Options{}.Decode(conn, changeset)
+}
+
+// Decode returns the changes of changeset as Ops, in changeset order. The
+// Options which select and read changes, such as RowFilter, IncludeColumns
+// and Invert, apply, but those which render SQL do not.
+func (opts Options) Decode(conn *sqlite.Conn, changeset io.Reader) ([]Op, error) {
+	var ops []Op
+	err := opts.forEachDecoded(conn, changeset, func(c change) {
+		ops = append(ops, c.op())
+	})
+	if fatal(err) != nil {
+		return nil, err
+	}
+	return ops, err
+}
+
+// forEachDecoded calls fn with each change of changeset which is selected by
+// the Options, without rendering its SQL.
+func (opts Options) forEachDecoded(conn *sqlite.Conn, changeset io.Reader,
+	fn func(c change)) error {
+	_, err := withChangesetIter(changeset, func(iter sqlite.ChangesetIter) error {
+		return opts.forEachChange(conn, iter,
+			func(_ _Conn, _ change) (string, error) { return "", nil },
+			func(c change, _ string) error {
+				fn(c)
+				return nil
+			})
+	})
+	return err
+}
+
+// op returns c as an Op.
+func (c change) op() Op {
+	return Op{Table: c.Table, Type: c.Op, Key: c.PKValues(),
+		Old: c.values(c.Old), New: c.values(c.New)}
+}
+
+// values returns the defined values of vals keyed by column name, or nil,
+// rather than an empty map, if none are defined.
+func (c change) values(vals []sqlite.Value) map[string]interface{} {
+	var m map[string]interface{}
+	for i, col := range c.Columns {
+		if vals == nil || vals[i].IsNil() {
+			continue
+		}
+		if m == nil {
+			m = make(map[string]interface{})
+		}
+		m[col.Name] = goValue(vals[i])
+	}
+	return m
+}
+
+// Value is a value of a column as SQLite stores it, for comparing changes.
+type Value struct {
+	// Type is SQLITE_INTEGER, SQLITE_FLOAT, SQLITE_TEXT, SQLITE_BLOB or
+	// SQLITE_NULL.
+	Type sqlite.ColumnType
+	// V is an int64, float64, string or []byte, or nil for NULL.
+	V interface{}
+}
+
+// ChangeRecord is a change of a changeset in a form which may be compared,
+// such as by tests asserting what a changeset holds rather than matching its
+// SQL. As for an Op, a column is only present in Old or New if the change
+// defines its value.
+type ChangeRecord struct {
+	Table string
+	// Op is "INSERT", "UPDATE" or "DELETE".
+	Op string
+	// PK holds the primary key of the row, as it was prior to the change
+	// unless the change is an INSERT.
+	PK       map[string]Value
+	Old, New map[string]Value
+}
+
+// Records returns the changes of changeset as ChangeRecords using the default
+// Options.
+func Records(conn *sqlite.Conn, changeset io.Reader) ([]ChangeRecord, error) {
+	return Options{}.Records(conn, changeset)
+}
+
+// Records returns the changes of changeset as ChangeRecords, in changeset
+// order. The Options apply as for Decode.
+func (opts Options) Records(conn *sqlite.Conn,
+	changeset io.Reader) ([]ChangeRecord, error) {
+	var records []ChangeRecord
+	err := opts.forEachDecoded(conn, changeset, func(c change) {
+		records = append(records, c.record())
+	})
+	if fatal(err) != nil {
+		return nil, err
+	}
+	return records, err
+}
+
+// record returns c as a ChangeRecord.
+func (c change) record() ChangeRecord {
+	// typed returns the defined values of vals, or nil if none are
+	// defined.
+	typed := func(vals []sqlite.Value, pk bool) map[string]Value {
+		var m map[string]Value
+		for i, col := range c.Columns {
+			if vals == nil || vals[i].IsNil() || pk && !c.PK[i] {
+				continue
+			}
+			if m == nil {
+				m = make(map[string]Value)
+			}
+			m[col.Name] = Value{Type: vals[i].Type(), V: goValue(vals[i])}
+		}
+		return m
+	}
+	key := c.Old
+	if c.Op == sqlite.SQLITE_INSERT {
+		key = c.New
+	}
+	return ChangeRecord{Table: c.Table,
+		Op: strings.TrimPrefix(c.Op.String(), "SQLITE_"),
+		PK: typed(key, true), Old: typed(c.Old, false),
+		New: typed(c.New, false)}
+}
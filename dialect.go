@@ -0,0 +1,177 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"crawshaw.io/sqlite"
+)
+
+// Dialect is a named set of Options which renders SQL for a particular target
+// database, for example with its own EscapeText or BooleanLiterals.
+type Dialect struct {
+	Name    string
+	Options Options
+}
+
+// ToSQLMulti converts changeset into SQL for each of dialects while reading
+// the changeset only once. The SQL is keyed by the Name of each Dialect, which
+// must be unique, and is the same as the Dialect's Options.ToSQL would return.
+// If any dialect sets ReadTransaction, all of them are converted within the
+// one read transaction.
+//
+// If any dialect sets ContinueOnError, the ChangeErrors of the first dialect
+// with any are returned along with the SQL of all dialects.
+func ToSQLMulti(conn *sqlite.Conn, changeset io.Reader,
+	dialects []Dialect) (sqls map[string]string, err error) {
+	var readTx, readAhead bool
+	for _, dialect := range dialects {
+		readTx = readTx || dialect.Options.ReadTransaction
+		readAhead = readAhead || dialect.Options.readsAhead()
+	}
+	if readTx {
+		var end func(*error)
+		if end, err = beginRead(conn); err != nil {
+			return nil, err
+		}
+		defer end(&err)
+	}
+	var data []byte
+	if readAhead {
+		if data, err = ioutil.ReadAll(changeset); err != nil {
+			return nil, err
+		}
+		changeset = bytes.NewReader(data)
+	}
+	conns := make([]_Conn, len(dialects))
+	writers := make([]*scriptWriter, len(dialects))
+	outs := make([]strings.Builder, len(dialects))
+	errs := make([]ChangeErrors, len(dialects))
+	names := make(map[string]bool, len(dialects))
+	// The dialects share the metadata of each table.
+	columns := make(map[string][]ColumnInfo)
+	fks := make(map[string][]ForeignKey)
+	gen := make(map[string][]GeneratedColumn)
+	pks := make(map[string][]bool)
+	for i, dialect := range dialects {
+		if names[dialect.Name] {
+			return nil, fmt.Errorf("sqlitechangeset: duplicate dialect %q",
+				dialect.Name)
+		}
+		names[dialect.Name] = true
+		opts := dialect.Options
+		opts.ReadTransaction = false
+		if opts.readsAhead() {
+			opts.columns = columns
+			if opts, err = opts.readAhead(conn, data); err != nil {
+				return nil, err
+			}
+		}
+		conns[i] = _Conn{Conn: conn, Columns: columns, ForeignKeys: fks,
+			Generated: gen, PKs: pks, Options: opts}
+		writers[i] = newScriptWriter(&outs[i], conns[i])
+		if err := writers[i].begin(); err != nil {
+			return nil, err
+		}
+	}
+	_, err = withChangesetIter(changeset, func(iter sqlite.ChangesetIter) error {
+		var n int
+		for {
+			hasRow, err := iter.Next()
+			if err != nil {
+				return err
+			}
+			if !hasRow {
+				break
+			}
+			n++
+			for i, conn := range conns {
+				conn.Options.progress(n, false)
+				c, sql, ok, err := conn.convert(iter, n-1,
+					_Conn.BuildSQL, &errs[i])
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+				sql, err = conn.Options.rewrite(c, sql)
+				if err != nil {
+					return err
+				}
+				if sql == "" {
+					continue
+				}
+				if err := writers[i].add(c, sql); err != nil {
+					return err
+				}
+			}
+		}
+		for _, conn := range conns {
+			conn.Options.progress(n, true)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sqls = make(map[string]string, len(dialects))
+	for i, dialect := range dialects {
+		if err := writers[i].end(); err != nil {
+			return nil, err
+		}
+		sqls[dialect.Name] = outs[i].String()
+		if err == nil && len(errs[i]) > 0 {
+			err = errs[i]
+		}
+	}
+	return sqls, err
+}
+
+// ToSQLPair converts changeset into the SQL which applies it and the SQL
+// which rolls it back using the default Options. See Options.ToSQLPair.
+func ToSQLPair(conn *sqlite.Conn,
+	changeset io.Reader) (forward, rollback string, err error) {
+	return Options{}.ToSQLPair(conn, changeset)
+}
+
+// ToSQLPair converts changeset into the SQL which applies it, as ToSQL
+// would, and the SQL which rolls it back, as ToSQL would with Invert, while
+// reading the changeset only once. Applying forward and then rollback leaves
+// the database as it was.
+func (opts Options) ToSQLPair(conn *sqlite.Conn,
+	changeset io.Reader) (forward, rollback string, err error) {
+	undo := opts
+	undo.Invert = !opts.Invert
+	sqls, err := ToSQLMulti(conn, changeset, []Dialect{
+		{Name: "forward", Options: opts},
+		{Name: "rollback", Options: undo},
+	})
+	if fatal(err) != nil {
+		return "", "", err
+	}
+	return sqls["forward"], sqls["rollback"], err
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"bytes"
+	"fmt"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// diffSchema is the schema name used to attach the second database in Diff.
+const diffSchema = "sqlitechangeset_diff"
+
+// Diff returns a changeset which when applied to the database connected to
+// by a, turns it into the database connected to by b. Only the given tables
+// are compared, or all tables in a if tables is empty. The changeset may be
+// passed to ToSQL.
+//
+// The main database of b must be a file, as it is attached to a for the
+// comparison. The compared tables must have a PRIMARY KEY and the same
+// schema in both databases.
+func Diff(a, b *sqlite.Conn, tables []string) (changeset []byte, err error) {
+	var file string
+	err = sqlitex.Exec(b, `PRAGMA database_list;`,
+		func(stmt *sqlite.Stmt) error {
+			if stmt.ColumnText(1) == "main" {
+				file = stmt.ColumnText(2)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	if file == "" {
+		return nil, fmt.Errorf("sqlitechangeset: Diff: database b is not a file")
+	}
+
+	err = sqlitex.Exec(a, fmt.Sprintf(`ATTACH DATABASE ? AS %s;`,
+		quoteIdentifier(diffSchema)), nil, file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		detachErr := sqlitex.Exec(a,
+			fmt.Sprintf(`DETACH DATABASE %s;`, quoteIdentifier(diffSchema)), nil)
+		if err == nil {
+			err = detachErr
+		}
+	}()
+	return DiffDatabases(a, "main", diffSchema, tables)
+}
+
+// DiffDatabases returns a changeset which when applied to the attached
+// database named from, turns it into the attached database named to. Only
+// the given tables are compared, or all tables in from if tables is empty.
+func DiffDatabases(conn *sqlite.Conn,
+	from, to string, tables []string) ([]byte, error) {
+	if len(tables) == 0 {
+		var err error
+		if tables, err = tableNames(conn, from); err != nil {
+			return nil, err
+		}
+	}
+
+	sess, err := conn.CreateSession(to)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Delete()
+	for _, tbl := range tables {
+		if err := sess.Attach(tbl); err != nil {
+			return nil, err
+		}
+		if err := sess.Diff(from, tbl); err != nil {
+			return nil, err
+		}
+	}
+	changeset := &bytes.Buffer{}
+	if err := sess.Changeset(changeset); err != nil {
+		return nil, err
+	}
+	return changeset.Bytes(), nil
+}
+
+// tableNames returns the names of all tables in the attached database named
+// schema, excluding SQLite's internal tables.
+func tableNames(conn *sqlite.Conn, schema string) ([]string, error) {
+	const TABLESF = `SELECT name FROM %s.sqlite_master
+                WHERE type = 'table' AND substr(name, 1, 7) <> 'sqlite_';`
+	var tables []string
+	err := sqlitex.Exec(conn, fmt.Sprintf(TABLESF, quoteIdentifier(schema)),
+		func(stmt *sqlite.Stmt) error {
+			tables = append(tables, stmt.ColumnText(0))
+			return nil
+		})
+	return tables, err
+}
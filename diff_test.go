@@ -0,0 +1,77 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "sqlitechangeset")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// Only the names of internal tables start with "sqlite_", so sqlite1
+	// must be diffed.
+	const schema = `CREATE TABLE t (a INTEGER PRIMARY KEY, b TEXT);
+                CREATE TABLE sqlite1 (a INTEGER PRIMARY KEY, b TEXT);`
+	a, err := sqlite.OpenConn(filepath.Join(dir, "a.db"), 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer a.Close()
+	require.NoError(sqlitex.ExecScript(a, schema+`
+                INSERT INTO t (a, b) VALUES (1, 'one'), (2, 'two'), (3, 'three');
+                INSERT INTO sqlite1 (a, b) VALUES (1, 'one');`))
+
+	b, err := sqlite.OpenConn(filepath.Join(dir, "b.db"), 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer b.Close()
+	require.NoError(sqlitex.ExecScript(b, schema+`
+                INSERT INTO t (a, b) VALUES (1, 'one'), (2, 'TWO'), (4, 'four');
+                INSERT INTO sqlite1 (a, b) VALUES (1, 'ONE');`))
+
+	changeset, err := Diff(a, b, nil)
+	require.NoError(err, "Diff")
+	require.NotEmpty(changeset)
+
+	sql, err := ToSQL(a, bytes.NewReader(changeset))
+	require.NoError(err, "ToSQL")
+	require.NoError(sqlitex.ExecScript(a, sql))
+
+	rows := func(conn *sqlite.Conn) (rows []string) {
+		require.NoError(sqlitex.Exec(conn, `SELECT b FROM t
+                UNION ALL SELECT b FROM sqlite1 ORDER BY b;`,
+			func(stmt *sqlite.Stmt) error {
+				rows = append(rows, stmt.ColumnText(0))
+				return nil
+			}))
+		return
+	}
+	require.Equal(rows(b), rows(a))
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"crawshaw.io/sqlite"
+)
+
+// Dump writes the structure of changeset to w using the default Options. See
+// Options.Dump.
+func Dump(conn *sqlite.Conn, changeset io.Reader, w io.Writer) error {
+	return Options{}.Dump(conn, changeset, w)
+}
+
+// Dump writes the structure of changeset to w as an indented tree, for
+// debugging its conversion. The changes are grouped by table, in the order
+// the tables first appear, and then by operation. Each change lists every
+// column of its table with its old and new values, or "undefined" if the
+// change defines neither:
+//
+//	table "t"
+//	  UPDATE
+//	    row
+//	      "a" [PK]: old 1
+//	      "c": old 'hello', new 'hello world'
+//	      "d": undefined
+//
+// The values are rendered as SQL literals.
+func (opts Options) Dump(conn *sqlite.Conn, changeset io.Reader,
+	w io.Writer) error {
+	var tables []string
+	// ops holds the rows of each operation of each table.
+	ops := make(map[string][][]string)
+	_, err := withChangesetIter(changeset, func(iter sqlite.ChangesetIter) error {
+		return opts.forEachChange(conn, iter, _Conn.buildDump,
+			func(c change, row string) error {
+				if _, ok := ops[c.Table]; !ok {
+					tables = append(tables, c.Table)
+					ops[c.Table] = make([][]string, len(opSections))
+				}
+				opID := opIndex[c.Op]
+				ops[c.Table][opID] = append(ops[c.Table][opID], row)
+				return nil
+			})
+	})
+	if fatal(err) != nil {
+		return err
+	}
+	opNames := make([]string, len(opSections))
+	for op, opID := range opIndex {
+		opNames[opID] = strings.TrimPrefix(op.String(), "SQLITE_")
+	}
+	var dump strings.Builder
+	for _, tbl := range tables {
+		fmt.Fprintf(&dump, "table %s\n", quoteIdentifier(tbl))
+		for opID, rows := range ops[tbl] {
+			if len(rows) == 0 {
+				continue
+			}
+			fmt.Fprintf(&dump, "  %s\n", opNames[opID])
+			for _, row := range rows {
+				dump.WriteString(row)
+			}
+		}
+	}
+	if _, wErr := io.WriteString(w, dump.String()); wErr != nil {
+		return wErr
+	}
+	return err
+}
+
+// buildDump renders c as a row of the tree written by Dump.
+func (conn _Conn) buildDump(c change) (string, error) {
+	conn.table = c.Table
+	row := "    row\n"
+	for i, col := range c.Columns {
+		var pk string
+		if c.PK[i] {
+			pk = " [PK]"
+		}
+		var vals []string
+		if !c.Old[i].IsNil() {
+			vals = append(vals, "old "+conn.valueString(col, c.Old[i]))
+		}
+		if !c.New[i].IsNil() {
+			vals = append(vals, "new "+conn.valueString(col, c.New[i]))
+		}
+		if len(vals) == 0 {
+			vals = append(vals, "undefined")
+		}
+		row += fmt.Sprintf("      %s%s: %s\n", quoteIdentifier(col.Name), pk,
+			strings.Join(vals, _COMMA))
+	}
+	return row, nil
+}
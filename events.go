@@ -0,0 +1,228 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+)
+
+// ChangeEvent is a change of a changeset as a serializable event, for
+// publishing to a message queue such as Kafka or NATS.
+//
+// The values of the columns are keyed by column name and are an int64,
+// float64, string, []byte, or nil for NULL. A column is only present if the
+// change defines its value, so Before holds the old values of a DELETE, After
+// the new values of an INSERT, and an UPDATE holds the primary key and the
+// old and new values of only the columns it changes, as a changeset holds no
+// others. A patchset holds no old values other than the primary key.
+type ChangeEvent struct {
+	Table string `json:"table"`
+	// Op is "INSERT", "UPDATE" or "DELETE".
+	Op string `json:"op"`
+	// Key holds the primary key of the row, as it was prior to the change
+	// unless the change is an INSERT.
+	Key    map[string]interface{} `json:"key"`
+	Before map[string]interface{} `json:"before,omitempty"`
+	After  map[string]interface{} `json:"after,omitempty"`
+}
+
+// ToEvents returns the changes of changeset as ChangeEvents using the default
+// Options.
+func ToEvents(conn *sqlite.Conn, changeset io.Reader) ([]ChangeEvent, error) {
+	return Options{}.ToEvents(conn, changeset)
+}
+
+// ToEvents returns the changes of changeset as ChangeEvents, in changeset
+// order. The Options which select and read changes, such as RowFilter,
+// IncludeColumns and Invert, apply, but those which render SQL do not.
+func (opts Options) ToEvents(conn *sqlite.Conn,
+	changeset io.Reader) ([]ChangeEvent, error) {
+	ops, err := opts.Decode(conn, changeset)
+	if fatal(err) != nil {
+		return nil, err
+	}
+	events := make([]ChangeEvent, len(ops))
+	for i, op := range ops {
+		events[i] = op.Event()
+	}
+	return events, err
+}
+
+// Event returns op as a ChangeEvent.
+func (op Op) Event() ChangeEvent {
+	return ChangeEvent{Table: op.Table,
+		Op:  strings.TrimPrefix(op.Type.String(), "SQLITE_"),
+		Key: op.Key, Before: op.Old, After: op.New}
+}
+
+// WriteEventsJSON writes events to w as newline-delimited JSON, one event per
+// line. BLOBs are encoded as base64 strings, and NULLs as null.
+func WriteEventsJSON(w io.Writer, events []ChangeEvent) error {
+	enc := json.NewEncoder(w)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DebeziumEnvelope is the payload of a Debezium change event, for
+// pipelines which consume the events of Debezium connectors. Only the
+// following subset of the Debezium schema is supported:
+//
+//	{"op": "c", "before": null, "after": {...}, "source": {...}, "ts_ms": 0}
+//
+// Op is "c" for an INSERT, "u" for an UPDATE and "d" for a DELETE. Unlike
+// Debezium, Before and After hold only the values defined by the change, so
+// those of an UPDATE are not of the whole row. The Debezium schema of the
+// payload, the message key and the "r" (read) and "t" (truncate) ops are not
+// produced.
+type DebeziumEnvelope struct {
+	Op     string                 `json:"op"`
+	Before map[string]interface{} `json:"before"`
+	After  map[string]interface{} `json:"after"`
+	Source DebeziumSource         `json:"source"`
+	TsMs   int64                  `json:"ts_ms"`
+}
+
+// DebeziumSource is the source metadata of a DebeziumEnvelope.
+type DebeziumSource struct {
+	// Connector is always "sqlite".
+	Connector string `json:"connector"`
+	// Name is the logical name of the database, which Debezium uses as
+	// the prefix of topic names.
+	Name  string `json:"name"`
+	Table string `json:"table"`
+	TsMs  int64  `json:"ts_ms"`
+}
+
+// debeziumOps maps the Op of a ChangeEvent to the op of a DebeziumEnvelope.
+var debeziumOps = map[string]string{
+	"INSERT": "c",
+	"UPDATE": "u",
+	"DELETE": "d",
+}
+
+// Debezium returns ev as a DebeziumEnvelope from the database with the
+// logical name, at time ts. A changeset does not record when its changes
+// were made, so ts is used for both the source and the envelope.
+func (ev ChangeEvent) Debezium(name string, ts time.Time) DebeziumEnvelope {
+	ms := ts.UnixNano() / int64(time.Millisecond)
+	return DebeziumEnvelope{Op: debeziumOps[ev.Op],
+		Before: ev.Before, After: ev.After,
+		Source: DebeziumSource{Connector: "sqlite", Name: name,
+			Table: ev.Table, TsMs: ms},
+		TsMs: ms}
+}
+
+// MarshalMsgpack encodes ev as a MessagePack map with the same keys as its
+// JSON encoding. BLOBs are encoded as bin, and NULLs as nil.
+func (ev ChangeEvent) MarshalMsgpack() ([]byte, error) {
+	fields := map[string]interface{}{
+		"table": ev.Table,
+		"op":    ev.Op,
+		"key":   ev.Key,
+	}
+	if len(ev.Before) > 0 {
+		fields["before"] = ev.Before
+	}
+	if len(ev.After) > 0 {
+		fields["after"] = ev.After
+	}
+	return appendMsgpack(nil, fields)
+}
+
+// appendMsgpack appends the MessagePack encoding of v, a value of a
+// ChangeEvent, to b. The keys of maps are sorted, so that the encoding is
+// deterministic.
+func appendMsgpack(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case int64:
+		return appendUint64(append(b, 0xd3), uint64(v)), nil
+	case float64:
+		return appendUint64(append(b, 0xcb), math.Float64bits(v)), nil
+	case string:
+		if len(v) < 32 {
+			b = append(b, 0xa0|byte(len(v)))
+		} else {
+			b = appendMsgpackLen(b, len(v), 0xd9, 0xda, 0xdb)
+		}
+		return append(b, v...), nil
+	case []byte:
+		return append(appendMsgpackLen(b, len(v), 0xc4, 0xc5, 0xc6),
+			v...), nil
+	case map[string]interface{}:
+		if len(v) < 16 {
+			b = append(b, 0x80|byte(len(v)))
+		} else {
+			b = appendMsgpackLen(b, len(v), 0, 0xde, 0xdf)
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b, _ = appendMsgpack(b, k)
+			var err error
+			if b, err = appendMsgpack(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("sqlitechangeset: "+
+			"cannot encode %T as MessagePack", v)
+	}
+}
+
+// appendMsgpackLen appends the type and length n of a string, binary or map
+// to b, using the smallest of the types with 8, 16 and 32-bit lengths. Maps
+// have no type with an 8-bit length, so t8 is 0 for them.
+func appendMsgpackLen(b []byte, n int, t8, t16, t32 byte) []byte {
+	switch {
+	case t8 != 0 && n <= math.MaxUint8:
+		return append(b, t8, byte(n))
+	case n <= math.MaxUint16:
+		return append(b, t16, byte(n>>8), byte(n))
+	default:
+		return append(b, t32, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+// appendUint64 appends v to b in big-endian order.
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
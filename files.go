@@ -0,0 +1,125 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"crawshaw.io/sqlite"
+)
+
+// ToSQLFiles converts changeset into the equivalent SQL statements using the
+// default Options, writing the statements for each table into a separate
+// file in dir. The returned map holds the path of the file for each table.
+func ToSQLFiles(conn *sqlite.Conn,
+	changeset io.Reader, dir string) (map[string]string, error) {
+	return Options{}.ToSQLFiles(conn, changeset, dir)
+}
+
+// ToSQLFiles converts changeset into the equivalent SQL statements, writing
+// the statements for each table into a separate file in dir. The returned map
+// holds the path of the file for each table.
+//
+// Files are named after their table with a .sql extension. Characters other
+// than letters, digits, '-', '_' and '.' are replaced with '_', and a numeric
+// suffix is added if two tables would otherwise share a file. Each file is
+// wrapped as the script of ToSQL is, with the Attach statements, Prologue and
+// Epilogue, the statements of DisableTriggers and DeferForeignKeys, and the
+// savepoints of TransactionPerTable and SavepointEvery, so that it may be
+// applied on its own. AnalyzeThreshold counts the statements of each file.
+func (opts Options) ToSQLFiles(conn *sqlite.Conn,
+	changeset io.Reader, dir string) (map[string]string, error) {
+	if opts.DisableTriggers && opts.triggers == nil {
+		// Load the triggers once for all of the files.
+		var err error
+		if opts.triggers, err = triggers(conn); err != nil {
+			return nil, err
+		}
+	}
+	groups := tableGroups{Options: opts, conn: opts.newConn(conn)}
+	_, err := withChangesetIter(changeset, func(iter sqlite.ChangesetIter) error {
+		return opts.forEachStatement(conn, iter, groups.add)
+	})
+	if fatal(err) != nil {
+		return nil, err
+	}
+	// Any ChangeErrors are returned once the files are written.
+	convErr := err
+
+	paths := make(map[string]string, len(groups.tables))
+	used := make(map[string]bool, len(groups.tables))
+	for tblID, tbl := range groups.tables {
+		name := sanitizeFileName(tbl)
+		// Compare case insensitively to avoid collisions on case
+		// insensitive file systems.
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s_%d", sanitizeFileName(tbl), n)
+		}
+		used[strings.ToLower(name)] = true
+
+		// The scriptWriter holds no statements of its own, and only
+		// writes the beginning and end of the script around the block
+		// of the table, whose SavepointEvery batches it delimits.
+		var sql strings.Builder
+		sw := newScriptWriter(&sql, groups.conn)
+		for _, op := range groups.tableOps[tblID] {
+			sw.statements += len(op)
+		}
+		groups.savepoints = sw.savepoints
+		if err := sw.begin(); err != nil {
+			return nil, err
+		}
+		sql.WriteString(groups.block(tblID, 0, 1, 2))
+		if err := sw.end(); err != nil {
+			return nil, err
+		}
+
+		path := filepath.Join(dir, name+".sql")
+		if err := ioutil.WriteFile(path, []byte(sql.String()), 0644); err != nil {
+			return nil, err
+		}
+		paths[tbl] = path
+	}
+	return paths, convErr
+}
+
+// sanitizeFileName returns name with any characters which are not safe to
+// use in a file name replaced with '_'.
+func sanitizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z',
+			'0' <= r && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	if name == "" || strings.Trim(name, ".") == "" {
+		// Avoid empty names and the special names "." and "..".
+		name = "_" + name
+	}
+	return name
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToSQLFiles(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	dir, err := ioutil.TempDir("", "sqlitechangeset")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	paths, err := ToSQLFiles(conn, changeset, dir)
+	require.NoError(err, "ToSQLFiles")
+	require.Equal(map[string]string{
+		"t":  filepath.Join(dir, "t.sql"),
+		"t2": filepath.Join(dir, "t2.sql"),
+	}, paths)
+
+	for _, path := range paths {
+		sql, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		require.NoError(sqlitex.ExecScript(conn, string(sql)))
+	}
+}
+
+func TestOptionsToSQLFilesWrapping(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+	require.NoError(sqlitex.ExecScript(conn,
+		`CREATE TRIGGER tr AFTER INSERT ON t2 BEGIN SELECT 1; END;`))
+
+	dir, err := ioutil.TempDir("", "sqlitechangeset")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// Each file is wrapped as the script of ToSQL is.
+	opts := Options{DisableTriggers: true, DeferForeignKeys: true,
+		SavepointEvery: 2}
+	paths, err := opts.ToSQLFiles(conn, changeset, dir)
+	require.NoError(err, "Options.ToSQLFiles")
+	sql, err := ioutil.ReadFile(paths["t2"])
+	require.NoError(err)
+	require.Equal(`DROP TRIGGER IF EXISTS "tr";
+SAVEPOINT "sqlitechangeset.DeferForeignKeys";
+PRAGMA defer_foreign_keys=ON;
+SAVEPOINT "batch_1";
+INSERT INTO "t2" ("a", "b") VALUES (0, X'FFFFFF');
+DELETE FROM "t2" WHERE ("a") = (1) /* ("b") = (X'01FF') */;
+RELEASE "batch_1";
+SAVEPOINT "batch_2";
+DELETE FROM "t2" WHERE ("a") = (2) /* ("b") = (X'02FF') */;
+RELEASE "batch_2";
+RELEASE "sqlitechangeset.DeferForeignKeys";
+CREATE TRIGGER tr AFTER INSERT ON t2 BEGIN SELECT 1; END;
+`, string(sql))
+
+	for _, path := range paths {
+		sql, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		require.NoError(sqlitex.ExecScript(conn, string(sql)))
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"t":          "t",
+		"my table":   "my_table",
+		"../etc/pwd": ".._etc_pwd",
+		"..":         "_..",
+		"":           "_",
+		`a"b`:        "a_b",
+	} {
+		require.Equal(t, expected, sanitizeFileName(name), name)
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"fmt"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// ForeignKey is a foreign key constraint of a table, as reported by PRAGMA
+// FOREIGN_KEY_LIST.
+type ForeignKey struct {
+	// Table is the referenced table.
+	Table string
+	// From are the columns of the referencing table, and To the columns
+	// of Table which they reference. To is empty if the primary key of
+	// Table is referenced.
+	From, To []string
+}
+
+// ForeignKeys returns the foreign keys of tbl in the database connected to by
+// conn, which are the edges of the graph of dependencies between tables.
+func ForeignKeys(conn *sqlite.Conn, tbl string) ([]ForeignKey, error) {
+	const FOREIGN_KEY_LISTF = `PRAGMA FOREIGN_KEY_LIST(%s);`
+	var fks []ForeignKey
+	ids := make(map[int64]int)
+	err := sqlitex.Exec(conn,
+		fmt.Sprintf(FOREIGN_KEY_LISTF, quoteIdentifier(tbl)),
+		func(stmt *sqlite.Stmt) error {
+			id := stmt.GetInt64("id")
+			i, ok := ids[id]
+			if !ok {
+				i = len(fks)
+				ids[id] = i
+				fks = append(fks, ForeignKey{Table: stmt.GetText("table")})
+			}
+			fks[i].From = append(fks[i].From, stmt.GetText("from"))
+			if stmt.ColumnType(stmt.ColumnIndex("to")) != sqlite.SQLITE_NULL {
+				fks[i].To = append(fks[i].To, stmt.GetText("to"))
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("querying foreign keys of table %q: %w",
+			tbl, err)
+	}
+	return fks, nil
+}
+
+// GetForeignKeys returns the foreign keys of tbl, caching the result for
+// subsequent calls.
+func (conn _Conn) GetForeignKeys(tbl string) ([]ForeignKey, error) {
+	fks, ok := conn.ForeignKeys[tableKey(tbl)]
+	if ok {
+		return fks, nil
+	}
+	if conn.Options.cachedOnly {
+		return nil, fmt.Errorf("sqlitechangeset: "+
+			"foreign keys of table %q were not loaded", tbl)
+	}
+	fks, err := ForeignKeys(conn.Conn, tbl)
+	if err != nil {
+		return nil, err
+	}
+	conn.ForeignKeys[tableKey(tbl)] = fks
+	return fks, nil
+}
+
+// selfReference is a foreign key of a table which references the same table,
+// such as the parent of a row in a hierarchy, given by the indexes of its
+// columns.
+type selfReference struct {
+	from, to []int
+}
+
+// selfReferences returns the foreign keys of tbl, whose columns are cols,
+// which reference tbl itself.
+func selfReferences(conn _Conn, tbl string,
+	cols []ColumnInfo) ([]selfReference, error) {
+	fks, err := conn.GetForeignKeys(tbl)
+	if err != nil {
+		return nil, err
+	}
+	index := func(name string) int {
+		for i, col := range cols {
+			if strings.EqualFold(col.Name, name) {
+				return i
+			}
+		}
+		return -1
+	}
+	var refs []selfReference
+	for _, fk := range fks {
+		if !strings.EqualFold(fk.Table, tbl) {
+			continue
+		}
+		to := fk.To
+		if len(to) == 0 {
+			to = pkColumns(cols)
+		}
+		if len(to) != len(fk.From) {
+			continue
+		}
+		var ref selfReference
+		for i := range to {
+			from, to := index(fk.From[i]), index(to[i])
+			if from < 0 || to < 0 {
+				break
+			}
+			ref.from = append(ref.from, from)
+			ref.to = append(ref.to, to)
+		}
+		if len(ref.from) == len(to) {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// pkColumns returns the names of the primary key columns of cols, in the
+// order of the primary key.
+func pkColumns(cols []ColumnInfo) []string {
+	var pk []string
+	for n := 1; ; n++ {
+		found := false
+		for _, col := range cols {
+			if col.PK == n {
+				pk = append(pk, col.Name)
+				found = true
+			}
+		}
+		if !found {
+			return pk
+		}
+	}
+}
+
+// recursiveDeletes returns true if c is a DELETE which RecursiveDeletes may
+// replace: one which is not guarded, rewritten or recorded in a History
+// table, nor in conflict.
+func (conn _Conn) recursiveDeletes(c change) bool {
+	opts := conn.Options
+	return opts.RecursiveDeletes && c.Op == sqlite.SQLITE_DELETE &&
+		c.Conflict == nil && conn.params == nil && !opts.GuardWithOldRow &&
+		opts.History == nil && opts.RewriteStatement == nil
+}
+
+// recursiveDelete collects the DELETEs of rows of a table with self
+// references, which are replaced by a single DELETE of the rows and their
+// descendants, for RecursiveDeletes.
+type recursiveDelete struct {
+	refs []selfReference
+	// cols are the columns of the table, and pk the indexes of its PK.
+	cols []ColumnInfo
+	pk   []int
+	// keys are the PK values of the deleted rows.
+	keys []string
+}
+
+// add adds c, a DELETE, to the rows to delete. It returns false if the PK of
+// c differs from that of the rows already added.
+func (del *recursiveDelete) add(conn _Conn, c change) bool {
+	var pk []int
+	for i := range c.Columns {
+		if c.PK[i] {
+			pk = append(pk, i)
+		}
+	}
+	if del.cols == nil {
+		del.cols, del.pk = c.Columns, pk
+	}
+	if len(c.Columns) != len(del.cols) || len(pk) != len(del.pk) {
+		return false
+	}
+	for j, i := range pk {
+		if del.pk[j] != i {
+			return false
+		}
+	}
+	f := conn.layout()
+	conn.table = c.Table
+	var vals string
+	for _, i := range pk {
+		vals += conn.param(c.Columns[i], c.Old[i]) + f.Comma
+	}
+	del.keys = append(del.keys, f.list(vals))
+	return true
+}
+
+// sql returns the DELETE of the rows of table tbl and their descendants,
+// split into several if needed to stay within MaxStatementLength.
+func (del *recursiveDelete) sql(conn _Conn, tbl string) []string {
+	const WITHF = `WITH RECURSIVE %s %s AS (VALUES `
+	const RECURSEF = ` UNION SELECT %s FROM %s AS "child" ` +
+		`JOIN %s AS "parent" ON %s ` +
+		`JOIN %s AS "deleted" ON %s = %s) ` +
+		`DELETE FROM %s WHERE %s IN (SELECT %s FROM %s)`
+	f := conn.layout()
+	// columns returns the columns idx, qualified by the table alias, if
+	// any.
+	columns := func(alias string, idx []int) string {
+		var cols string
+		for _, i := range idx {
+			if alias != "" {
+				cols += alias + "."
+			}
+			cols += quoteIdentifier(del.cols[i].Name) + f.Comma
+		}
+		return strings.TrimSuffix(cols, f.Comma)
+	}
+	list := func(alias string, idx []int) string {
+		return f.list(columns(alias, idx))
+	}
+	// A child references its parent by any of the self references.
+	var on []string
+	for _, ref := range del.refs {
+		on = append(on, list(`"child"`, ref.from)+" = "+
+			list(`"parent"`, ref.to))
+	}
+	cte := quoteIdentifier(_RECURSIVE_DELETES)
+	table := quoteIdentifier(tbl)
+	prefix := fmt.Sprintf(WITHF, cte, list("", del.pk))
+	suffix := f.statement(fmt.Sprintf(RECURSEF,
+		columns(`"child"`, del.pk), table, table, strings.Join(on, " OR "),
+		cte, list(`"parent"`, del.pk), list(`"deleted"`, del.pk),
+		table, list("", del.pk), columns("", del.pk), cte))
+
+	// Add the keys to the current statement while it fits, and else
+	// start another.
+	max := conn.Options.MaxStatementLength
+	var stmts []string
+	var keys []string
+	n := len(prefix) + len(suffix)
+	for _, key := range del.keys {
+		if len(keys) > 0 && max > 0 &&
+			n+len(f.Comma)+len(key) > max {
+			stmts = append(stmts,
+				prefix+strings.Join(keys, f.Comma)+suffix)
+			keys, n = nil, len(prefix)+len(suffix)
+		}
+		if len(keys) > 0 {
+			n += len(f.Comma)
+		}
+		keys = append(keys, key)
+		n += len(key)
+	}
+	return append(stmts, prefix+strings.Join(keys, f.Comma)+suffix)
+}
+
+// ErrForeignKeyCycle is returned with Options.OrderByDependencies when the
+// foreign keys of the tables in a changeset form a cycle, so that no order of
+// the tables has each follow the tables it references, unless
+// Options.DeferForeignKeys is also set.
+var ErrForeignKeyCycle = fmt.Errorf(
+	"sqlitechangeset: cycle of foreign keys between tables")
+
+// dependencyOrder returns the indexes of tables ordered so that each follows
+// the tables it references by the foreign keys which foreignKeys returns for
+// it, and which otherwise keep their order. Only references between the
+// tables are considered, and a table referencing itself is ignored. If a
+// cycle of references is found, it is returned as an ErrForeignKeyCycle,
+// unless allowCycles is set, in which case the reference closing the cycle
+// is ignored.
+func dependencyOrder(tables []string,
+	foreignKeys func(tbl string) ([]ForeignKey, error),
+	allowCycles bool) ([]int, error) {
+	index := make(map[string]int, len(tables))
+	for tblID, tbl := range tables {
+		index[strings.ToLower(tbl)] = tblID
+	}
+	refs := make([][]int, len(tables))
+	for tblID, tbl := range tables {
+		fks, err := foreignKeys(tbl)
+		if err != nil {
+			return nil, err
+		}
+		for _, fk := range fks {
+			ref, ok := index[strings.ToLower(fk.Table)]
+			if ok && ref != tblID {
+				refs[tblID] = append(refs[tblID], ref)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	order := make([]int, 0, len(tables))
+	state := make([]int, len(tables))
+	// path holds the tables being visited, to report any cycle.
+	var path []int
+	var visit func(tblID int) error
+	visit = func(tblID int) error {
+		switch state[tblID] {
+		case visited:
+			return nil
+		case visiting:
+			if allowCycles {
+				return nil
+			}
+			start := len(path) - 1
+			for path[start] != tblID {
+				start--
+			}
+			var cycle []string
+			for _, id := range append(path[start:], tblID) {
+				cycle = append(cycle, quoteIdentifier(tables[id]))
+			}
+			return fmt.Errorf("%w: %v", ErrForeignKeyCycle,
+				strings.Join(cycle, " -> "))
+		}
+		state[tblID] = visiting
+		path = append(path, tblID)
+		for _, ref := range refs[tblID] {
+			if err := visit(ref); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[tblID] = visited
+		order = append(order, tblID)
+		return nil
+	}
+	for tblID := range tables {
+		if err := visit(tblID); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
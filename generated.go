@@ -0,0 +1,259 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"fmt"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// GeneratedColumn is a generated column of a table. PRAGMA TABLE_INFO, and so
+// TableColumns, omits generated columns, as do changesets, and their values
+// cannot be set by an INSERT or UPDATE.
+type GeneratedColumn struct {
+	Name string
+	// Expr is the expression which generates the value of the column, as
+	// declared by the CREATE TABLE statement of its table.
+	Expr string
+	// Stored is true for a STORED column, and false for a VIRTUAL one.
+	Stored bool
+}
+
+// GeneratedColumns returns the generated columns of tbl in the database
+// connected to by conn, in table order.
+func GeneratedColumns(conn *sqlite.Conn, tbl string) ([]GeneratedColumn, error) {
+	const TABLE_XINFOF = `PRAGMA TABLE_XINFO(%s);`
+	// The hidden column of TABLE_XINFO is 2 for VIRTUAL and 3 for STORED
+	// generated columns.
+	const hiddenVirtual, hiddenStored = 2, 3
+	var gen []GeneratedColumn
+	err := sqlitex.Exec(conn, fmt.Sprintf(TABLE_XINFOF, quoteIdentifier(tbl)),
+		func(stmt *sqlite.Stmt) error {
+			switch stmt.GetInt64("hidden") {
+			case hiddenVirtual:
+				gen = append(gen, GeneratedColumn{
+					Name: stmt.GetText("name")})
+			case hiddenStored:
+				gen = append(gen, GeneratedColumn{
+					Name: stmt.GetText("name"), Stored: true})
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("querying generated columns of table %q: %w",
+			tbl, err)
+	}
+	if len(gen) == 0 {
+		return nil, nil
+	}
+	create, err := createTableSQL(conn, tbl)
+	if err != nil {
+		return nil, err
+	}
+	defs := columnDefinitions(create)
+	for i := range gen {
+		for _, def := range defs {
+			name, rest := splitIdentifier(def)
+			if strings.EqualFold(name, gen[i].Name) {
+				gen[i].Expr = generatedExpr(rest)
+				break
+			}
+		}
+	}
+	return gen, nil
+}
+
+// GetGeneratedColumns returns the generated columns of tbl, caching the
+// result for subsequent calls.
+func (conn _Conn) GetGeneratedColumns(tbl string) ([]GeneratedColumn, error) {
+	gen, ok := conn.Generated[tableKey(tbl)]
+	if ok {
+		return gen, nil
+	}
+	if conn.Options.cachedOnly {
+		return nil, fmt.Errorf("sqlitechangeset: "+
+			"generated columns of table %q were not loaded", tbl)
+	}
+	gen, err := GeneratedColumns(conn.Conn, tbl)
+	if err != nil {
+		return nil, err
+	}
+	conn.Generated[tableKey(tbl)] = gen
+	return gen, nil
+}
+
+// generatedComment returns the comment listing the generated columns of
+// tbl, or "" if it has none.
+func (conn _Conn) generatedComment(tbl string) (string, error) {
+	gen, err := conn.GetGeneratedColumns(tbl)
+	if err != nil || len(gen) == 0 {
+		return "", err
+	}
+	f := conn.layout()
+	var cols []string
+	for _, col := range gen {
+		kind := "VIRTUAL"
+		if col.Stored {
+			kind = "STORED"
+		}
+		cols = append(cols, fmt.Sprintf("%s AS (%s) %s",
+			quoteIdentifier(col.Name), col.Expr, kind))
+	}
+	return "generated: " + strings.Join(cols, f.CommentComma), nil
+}
+
+// columnDefinitions returns the column definitions and table constraints of
+// create, a CREATE TABLE statement: the items of its outermost parentheses.
+func columnDefinitions(create string) []string {
+	var defs []string
+	var depth, start int
+	scanSQL(create, func(i int, c byte) {
+		switch c {
+		case '(':
+			depth++
+			if depth == 1 {
+				start = i + 1
+			}
+		case ')':
+			if depth == 1 {
+				defs = append(defs, trimComments(create[start:i]))
+			}
+			depth--
+		case ',':
+			if depth == 1 {
+				defs = append(defs, trimComments(create[start:i]))
+				start = i + 1
+			}
+		}
+	})
+	return defs
+}
+
+// trimComments returns def without surrounding space or leading comments.
+func trimComments(def string) string {
+	for {
+		def = strings.TrimSpace(def)
+		var end string
+		switch {
+		case strings.HasPrefix(def, "--"):
+			end = "\n"
+		case strings.HasPrefix(def, "/*"):
+			end = "*/"
+		default:
+			return def
+		}
+		n := strings.Index(def[2:], end)
+		if n < 0 {
+			return ""
+		}
+		def = def[2+n+len(end):]
+	}
+}
+
+// splitIdentifier splits def, a column definition, into the name of the
+// column, unquoted, and the rest of the definition.
+func splitIdentifier(def string) (name, rest string) {
+	if def == "" {
+		return "", ""
+	}
+	closing := map[byte]byte{'"': '"', '`': '`', '[': ']'}[def[0]]
+	if closing == 0 {
+		end := strings.IndexAny(def, " \t\r\n")
+		if end < 0 {
+			return def, ""
+		}
+		return def[:end], def[end:]
+	}
+	for i := 1; i < len(def); i++ {
+		if def[i] != closing {
+			name += def[i : i+1]
+			continue
+		}
+		if closing != ']' && i+1 < len(def) && def[i+1] == closing {
+			// A doubled quote escapes a quote.
+			name += string(closing)
+			i++
+			continue
+		}
+		return name, def[i+1:]
+	}
+	return name, ""
+}
+
+// generatedExpr returns the expression of rest, the column definition of a
+// generated column following its name: the text within the parentheses
+// which follow the AS keyword.
+func generatedExpr(rest string) string {
+	var depth, start int
+	var expr string
+	upper := strings.ToUpper(rest)
+	scanSQL(rest, func(i int, c byte) {
+		if expr != "" {
+			return
+		}
+		switch c {
+		case '(':
+			depth++
+			if depth == 1 && strings.HasSuffix(
+				strings.TrimSpace(upper[:i]), "AS") {
+				start = i + 1
+			}
+		case ')':
+			depth--
+			if depth == 0 && start > 0 {
+				expr = strings.TrimSpace(rest[start:i])
+			}
+		}
+	})
+	return expr
+}
+
+// scanSQL calls fn with each byte of sql, and its index, which is outside of
+// a string literal, quoted identifier or comment.
+func scanSQL(sql string, fn func(i int, c byte)) {
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		start, end := 1, ""
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end = string(c)
+		case c == '[':
+			end = "]"
+		case strings.HasPrefix(sql[i:], "--"):
+			start, end = 2, "\n"
+		case strings.HasPrefix(sql[i:], "/*"):
+			start, end = 2, "*/"
+		default:
+			fn(i, c)
+			continue
+		}
+		// A doubled quote within a quoted string ends it and starts
+		// another, which is equivalent.
+		n := strings.Index(sql[i+start:], end)
+		if n < 0 {
+			return
+		}
+		i += start + n + len(end) - 1
+	}
+}
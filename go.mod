@@ -3,7 +3,7 @@ module github.com/AdamSLevy/sqlitechangeset
 go 1.13
 
 require (
-	crawshaw.io/sqlite v0.2.5
+	crawshaw.io/sqlite v0.3.2
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/stretchr/testify v1.3.1-0.20190311161405-34c6fa2dc709
 )
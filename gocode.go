@@ -0,0 +1,123 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"crawshaw.io/sqlite"
+)
+
+// ToGoCode renders changeset as Go source using the default Options. See
+// Options.ToGoCode.
+func ToGoCode(conn *sqlite.Conn, changeset io.Reader, varName string) (string, error) {
+	return Options{}.ToGoCode(conn, changeset, varName)
+}
+
+// ToGoCode renders changeset as Go source which applies each change with a
+// call to sqlitex.Exec on the *sqlite.Conn named varName, for embedding a
+// changeset in a Go migration. Values are bound as parameters rather than
+// rendered as literals. Each call is followed by a check which returns any
+// error, so the code belongs in a function returning an error:
+//
+//	if err := sqlitex.Exec(conn, `DELETE FROM "t" WHERE ("a") = (?1) /* ("b") = ('x') */;`, nil,
+//		int64(1)); err != nil {
+//		return err
+//	}
+//
+// The calls are in changeset order. Prologue, Epilogue and the options which
+// add statements to the SQL script do not apply, and PKUpdateAsDeleteInsert is
+// ignored as each change must be a single statement.
+func (opts Options) ToGoCode(conn *sqlite.Conn, changeset io.Reader,
+	varName string) (string, error) {
+	opts.PKUpdateAsDeleteInsert = false
+	var code string
+	_, err := withChangesetIter(changeset, func(iter sqlite.ChangesetIter) error {
+		return opts.forEachChange(conn, iter,
+			func(conn _Conn, c change) (string, error) {
+				return conn.buildGoCode(c, varName)
+			},
+			func(_ change, call string) error {
+				code += call
+				return nil
+			})
+	})
+	return code, err
+}
+
+func (conn _Conn) buildGoCode(c change, varName string) (string, error) {
+	const EXECF = `if err := sqlitex.Exec(%s, %s, nil%s); err != nil {
+	return err
+}
+`
+	var args []interface{}
+	conn.params = &args
+	sql, err := conn.BuildSQL(c)
+	if err != nil {
+		return "", err
+	}
+	var goArgs []string
+	for _, arg := range args {
+		goArgs = append(goArgs, goLiteral(arg))
+	}
+	var argList string
+	if len(goArgs) > 0 {
+		argList = ",\n\t" + strings.Join(goArgs, _COMMA)
+	}
+	return fmt.Sprintf(EXECF, varName, goString(strings.TrimSuffix(sql, "\n")),
+		argList), nil
+}
+
+// goString returns s as a Go string literal, preferring a raw string.
+func goString(s string) string {
+	if strconv.CanBackquote(s) {
+		return "`" + s + "`"
+	}
+	return strconv.Quote(s)
+}
+
+// goLiteral returns the Go source for arg, a value returned by goValue, typed
+// so that sqlitex.Exec binds it with the same SQLite type.
+func goLiteral(arg interface{}) string {
+	switch arg := arg.(type) {
+	case nil:
+		return "nil"
+	case int64:
+		return fmt.Sprintf("int64(%d)", arg)
+	case float64:
+		switch {
+		case math.IsNaN(arg):
+			return "math.NaN()"
+		case math.IsInf(arg, 0):
+			return fmt.Sprintf("math.Inf(%d)", int(math.Copysign(1, arg)))
+		}
+		return fmt.Sprintf("float64(%s)",
+			strconv.FormatFloat(arg, 'g', -1, 64))
+	case string:
+		return strconv.Quote(arg)
+	default:
+		return fmt.Sprintf("%#v", arg)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+)
+
+// ChangesetHash returns the hex encoded SHA-256 hash of changeset, for
+// recognizing a changeset which has already been applied. The hash is of the
+// changeset's bytes, so the same changes in a different order, or as a
+// patchset, have a different hash.
+func ChangesetHash(changeset io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, changeset); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// changesetHash returns the ChangesetHash of changeset.
+func changesetHash(changeset []byte) string {
+	sum := sha256.Sum256(changeset)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HistoryTable configures the history tables of Options.History.
+type HistoryTable struct {
+	// Name is the name of the history table of each table, in which
+	// "%s" is replaced by the name of the table, such as "%s_history".
+	Name string
+	// OpColumn, if not empty, is the column which records the operation
+	// of each change as 'INSERT', 'UPDATE' or 'DELETE'.
+	OpColumn string
+	// TimeColumn, if not empty, is the column which records the time of
+	// each change, as the SQL expression Time, or CURRENT_TIMESTAMP if
+	// Time is empty. A changeset does not record when its changes were
+	// made, so the expression is evaluated when the SQL is applied.
+	TimeColumn, Time string
+	// OldPrefix and NewPrefix prefix the names of the columns which
+	// record the old and new values of each column, such as "old_" and
+	// "new_". They must differ.
+	OldPrefix, NewPrefix string
+}
+
+// buildHistory renders c as an INSERT into the history table of its table.
+// Only the values defined by c are inserted, so the columns of values which
+// are undefined, such as the new values of a DELETE, are left to their
+// defaults.
+func (conn _Conn) buildHistory(c change) (string, error) {
+	const INSERTF = `INSERT INTO %s %s VALUES %s`
+	h := conn.Options.History
+	if h.OldPrefix == h.NewPrefix {
+		return "", fmt.Errorf("sqlitechangeset: "+
+			"history table OldPrefix and NewPrefix are both %q",
+			h.OldPrefix)
+	}
+	f := conn.layout()
+	var cols, vals strings.Builder
+	if h.OpColumn != "" {
+		f.appendItem(&cols, quoteIdentifier(h.OpColumn))
+		f.appendItem(&vals,
+			fmt.Sprintf("'%s'", strings.TrimPrefix(c.Op.String(), "SQLITE_")))
+	}
+	if h.TimeColumn != "" {
+		now := h.Time
+		if now == "" {
+			now = "CURRENT_TIMESTAMP"
+		}
+		f.appendItem(&cols, quoteIdentifier(h.TimeColumn))
+		f.appendItem(&vals, now)
+	}
+	for i, col := range c.Columns {
+		if !c.Old[i].IsNil() {
+			f.appendItem(&cols, quoteIdentifier(h.OldPrefix+col.Name))
+			f.appendItem(&vals, conn.setParam(col, c.Old[i]))
+		}
+		if !c.New[i].IsNil() {
+			f.appendItem(&cols, quoteIdentifier(h.NewPrefix+col.Name))
+			f.appendItem(&vals, conn.setParam(col, c.New[i]))
+		}
+	}
+	table := strings.Replace(h.Name, "%s", c.Table, -1)
+	return f.statement(fmt.Sprintf(INSERTF, quoteIdentifier(table),
+		f.Open+cols.String()+f.Close, f.Open+vals.String()+f.Close)), nil
+}
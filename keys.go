@@ -0,0 +1,91 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"io"
+
+	"crawshaw.io/sqlite"
+)
+
+// ChangedRowKeys returns the primary keys of the rows changed by changeset
+// using the default Options. See Options.ChangedRowKeys.
+func ChangedRowKeys(conn *sqlite.Conn,
+	changeset io.Reader) (map[string][][]interface{}, error) {
+	return Options{}.ChangedRowKeys(conn, changeset)
+}
+
+// ChangedRowKeys returns the primary key of each row changed by changeset,
+// keyed by table, for invalidating caches of or reindexing the changed rows
+// without converting the changeset into SQL. Each key holds the values of the
+// primary key columns in the order they appear in the table, as an int64,
+// float64, string, []byte, or nil for NULL.
+//
+// The keys are in changeset order. The key of a row is that prior to the
+// change, unless the change is an INSERT, and an UPDATE which changes the
+// primary key is followed by the new key of its row. The RowFilter and
+// Invert Options apply.
+func (opts Options) ChangedRowKeys(conn *sqlite.Conn,
+	changeset io.Reader) (map[string][][]interface{}, error) {
+	keys := make(map[string][][]interface{})
+	_, err := withChangesetIter(changeset, func(iter sqlite.ChangesetIter) error {
+		return opts.forEachChange(conn, iter,
+			func(_ _Conn, _ change) (string, error) { return "", nil },
+			func(c change, _ string) error {
+				keys[c.Table] = append(keys[c.Table], c.changedKeys()...)
+				return nil
+			})
+	})
+	if fatal(err) != nil {
+		return nil, err
+	}
+	return keys, err
+}
+
+// changedKeys returns the primary key of the row of c, followed by its new key
+// if c is an UPDATE which changes it.
+func (c change) changedKeys() [][]interface{} {
+	vals := c.Old
+	if c.Op == sqlite.SQLITE_INSERT {
+		vals = c.New
+	}
+	var key, newKey []interface{}
+	var pkChanged bool
+	for i := range c.Columns {
+		if !c.PK[i] {
+			continue
+		}
+		key = append(key, goValue(vals[i]))
+		if c.Op != sqlite.SQLITE_UPDATE {
+			continue
+		}
+		if c.New[i].IsNil() || sameValue(c.Old[i], c.New[i]) {
+			newKey = append(newKey, goValue(c.Old[i]))
+			continue
+		}
+		newKey = append(newKey, goValue(c.New[i]))
+		pkChanged = true
+	}
+	if pkChanged {
+		return [][]interface{}{key, newKey}
+	}
+	return [][]interface{}{key}
+}
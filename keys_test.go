@@ -0,0 +1,76 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"bytes"
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangedRowKeys(t *testing.T) {
+	require := require.New(t)
+	conn, sess, changeset := createChangeset(t)
+	defer conn.Close()
+	defer sess.Delete()
+
+	keys, err := ChangedRowKeys(conn, changeset)
+	require.NoError(err, "ChangedRowKeys")
+	require.Equal(map[string][][]interface{}{
+		"t": {{int64(1), int64(1)}, {int64(3), int64(3)},
+			{int64(2), int64(2)}, {int64(5), int64(5)},
+			{int64(4), int64(4)}},
+		"t2": {{int64(0)}, {int64(1)}, {int64(2)}},
+	}, keys)
+}
+
+func TestChangedRowKeysPKUpdate(t *testing.T) {
+	require := require.New(t)
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(sqlitex.ExecScript(conn,
+		`CREATE TABLE k (a INTEGER, b TEXT, c TEXT, PRIMARY KEY (a, b));`))
+
+	// An UPDATE changes the key of its row from (1, 'x') to (1, 'y').
+	var changeset testChangeset
+	changeset.Table("k", true, true, false)
+	changeset.Change(sqlite.SQLITE_UPDATE,
+		[]interface{}{int64(1), "x", "old"},
+		[]interface{}{nil, "y", "new"})
+	changeset.Change(sqlite.SQLITE_UPDATE,
+		[]interface{}{int64(2), "z", "old"},
+		[]interface{}{nil, nil, "new"})
+
+	keys, err := ChangedRowKeys(conn, bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "ChangedRowKeys")
+	require.Equal(map[string][][]interface{}{"k": {
+		{int64(1), "x"}, {int64(1), "y"}, {int64(2), "z"}}}, keys)
+
+	keys, err = Options{RowFilter: func(_ string, pk map[string]interface{}) bool {
+		return pk["a"] == int64(2)
+	}}.ChangedRowKeys(conn, bytes.NewReader(changeset.Bytes()))
+	require.NoError(err, "Options.ChangedRowKeys")
+	require.Equal(map[string][][]interface{}{"k": {{int64(2), "z"}}}, keys)
+}
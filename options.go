@@ -0,0 +1,640 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"fmt"
+	"strings"
+
+	"crawshaw.io/sqlite"
+)
+
+// Options control how a changeset is converted into SQL. The zero value of
+// Options produces the same output as the package level functions.
+type Options struct {
+	// Prologue is written verbatim before the generated statements. For
+	// example "PRAGMA foreign_keys=OFF;\n" may be used to apply changes
+	// that temporarily violate foreign key constraints.
+	Prologue string
+	// Epilogue is written verbatim after the generated statements. For
+	// example "PRAGMA foreign_keys=ON;\n".
+	Epilogue string
+
+	// RowFilter, if not nil, is called with the table name and primary key
+	// values of each change. The change is omitted from the generated SQL
+	// if RowFilter returns false. The primary key values are keyed by
+	// column name and are an int64, float64, string, []byte or nil.
+	RowFilter func(table string, pk map[string]interface{}) bool
+
+	// PKWatermark, if it has an entry for a table, omits the changes of
+	// rows of the table whose primary key is not greater than the entry,
+	// so that processing may resume after the last row processed. The
+	// entry holds a value for each column of the PRIMARY KEY, in its
+	// order, of the types passed to RowFilter or an int. Keys are compared
+	// as SQLite orders values, first by the first column: NULL, then
+	// numbers, then TEXT by its bytes, then BLOBs. The collation of a
+	// column is not applied. Omitted changes are logged.
+	//
+	// SQLite does not order the changes of a changeset by primary key, so
+	// a watermark only resumes processing correctly if the rows were
+	// processed in key order, such as by sorting them, or if the changes
+	// are known to be in key order, such as rows appended with increasing
+	// keys.
+	PKWatermark map[string][]interface{}
+
+	// TransactionPerTable wraps the statements for each table in a
+	// SAVEPOINT named after the table and a matching RELEASE. A failure
+	// applying one table's changes may then be rolled back to the
+	// savepoint without discarding the changes to other tables.
+	TransactionPerTable bool
+
+	// Progress, if not nil, is called with the number of changes read so
+	// far after every ProgressInterval changes, and once more with the
+	// total when the changeset has been fully read.
+	Progress func(changesProcessed int)
+	// ProgressInterval is the number of changes between calls to
+	// Progress. If zero, DefaultProgressInterval is used.
+	ProgressInterval int
+
+	// GuardWithOldValues adds the old values of the updated columns to
+	// the WHERE clause of each UPDATE, so that a row is only updated if
+	// it still matches the state prior to the change. An UPDATE of a row
+	// which has since diverged affects zero rows.
+	//
+	// DELETE statements are not guarded and remain idempotent: deleting
+	// a row which no longer exists affects zero rows without error.
+	GuardWithOldValues bool
+
+	// GuardWithOldRow adds the old values of every column a change holds
+	// to the WHERE clause of each UPDATE and DELETE, so that a row is
+	// only changed if it is still identical to the row the source
+	// changed. A statement for a row which has since diverged affects
+	// zero rows, so the caller can detect the divergence from the number
+	// of changes. The whole old row of a DELETE is guarded, while an
+	// UPDATE is guarded by the old values of the columns it changes, as a
+	// changeset holds no old values for the columns an UPDATE leaves
+	// unchanged. Unlike GuardWithOldValues, an old value is guarded even
+	// if the change does not set a new one for its column.
+	//
+	// The old row is compared as a row value with IS, such as
+	// ("c", "d") IS ('world', 1.5), rather than by a hash, as SQLite has
+	// no built-in hash function, and IS compares each value exactly,
+	// NULLs included. A patchset holds no old values, so its statements
+	// are not guarded.
+	GuardWithOldRow bool
+
+	// AnnotateSections adds a comment such as "-- Table: t (inserts)"
+	// before each group of statements for a table and operation, making
+	// large scripts easier to navigate.
+	AnnotateSections bool
+
+	// FormatNull, if not nil, returns the SQL for a NULL value in a column
+	// with the given affinity, for example "CAST(NULL AS INTEGER)". By
+	// default NULL values are rendered as "NULL".
+	FormatNull func(affinity Affinity) string
+
+	// BooleanLiterals renders the values 0 and 1 of columns declared as
+	// BOOLEAN as FALSE and TRUE. SQLite stores booleans as integers, so
+	// this only affects readability. Other values are rendered as is.
+	BooleanLiterals bool
+
+	// Invert generates the SQL which undoes the changeset, rather than
+	// the SQL which applies it, as if the changeset were first inverted
+	// by sqlite.ChangesetInvert. Invert implies UndoComments.
+	Invert bool
+	// UndoComments labels the comments of each statement as undoing the
+	// original change, e.g. "/* undo of DELETE */", for changesets which
+	// have been inverted by sqlite.ChangesetInvert. The old values of an
+	// UPDATE are labeled as the values the original UPDATE set.
+	UndoComments bool
+
+	// NoGrouping emits statements in changeset order as soon as they are
+	// generated, instead of grouping them by table and operation. When
+	// writing to an io.Writer this bounds memory use to a single
+	// statement, regardless of the size of the changeset.
+	// TransactionPerTable and AnnotateSections have no effect as the
+	// statements are not grouped.
+	NoGrouping bool
+
+	// PreserveOrder emits statements in changeset order, like NoGrouping,
+	// for changesets whose order is significant to triggers or foreign
+	// keys. Unlike NoGrouping, each run of consecutive changes to the
+	// same table is treated as a table is when grouping: runs are
+	// separated by a blank line, TransactionPerTable wraps each run in a
+	// SAVEPOINT, and AnnotateSections labels each run of the same
+	// operation.
+	PreserveOrder bool
+
+	// AnalyzeThreshold, if greater than zero, appends "ANALYZE;" after
+	// the generated statements when there are at least this many, so the
+	// query planner statistics of the target stay accurate after a bulk
+	// change.
+	AnalyzeThreshold int
+	// AnalyzeOptimize additionally appends "PRAGMA optimize;" after the
+	// "ANALYZE;" added by AnalyzeThreshold.
+	AnalyzeOptimize bool
+
+	// UpdateAsUpsert renders each UPDATE as an INSERT of the primary key
+	// and updated columns with an ON CONFLICT DO UPDATE clause, so that a
+	// row missing from the target is created rather than silently left
+	// out. A row created this way only holds the primary key and the
+	// updated columns, with all other columns set to their defaults.
+	// With GuardWithOldValues or GuardWithOldRow the guard is applied to
+	// the DO UPDATE.
+	// An UPDATE which changes the primary key is rendered as an UPDATE.
+	UpdateAsUpsert bool
+
+	// PKUpdateAsDeleteInsert renders an UPDATE which changes the primary
+	// key as a DELETE of the old row followed by an INSERT of the new row,
+	// instead of an UPDATE of the key, so the two rows never exist at
+	// once. The changeset does not hold the values of columns not changed
+	// by the UPDATE, so if there are any, the old row is first copied into
+	// a temporary table, from which they are inserted, and which is then
+	// dropped.
+	PKUpdateAsDeleteInsert bool
+
+	// EscapeText, if not nil, returns the SQL literal for a TEXT value,
+	// including any enclosing quotes. It may be used for dialects with
+	// different escaping rules, or to normalize text. By default
+	// QuoteText is used. EscapeText is not used with AlwaysUseBlob.
+	EscapeText func(s string) string
+
+	// ContinueOnError skips any change which cannot be converted rather
+	// than aborting the conversion. The SQL for all other changes is
+	// returned along with a ChangeErrors holding the error for each
+	// skipped change. Errors reading the changeset itself still abort
+	// the conversion.
+	ContinueOnError bool
+
+	// PreviewBlobBytes, if greater than zero, truncates BLOB values
+	// longer than this many bytes in output meant for review, such as
+	// ToDiff, e.g. X'AABB…(1234 bytes)'. It never affects executable SQL,
+	// which always holds the full BLOB.
+	PreviewBlobBytes int
+
+	// CastValues wraps each non-NULL value in a CAST to the affinity of
+	// its column, e.g. CAST('5' AS INTEGER), so the target interprets the
+	// value with the intended type regardless of its own affinity rules.
+	// Columns without a declared type have BLOB affinity and are never
+	// cast. Like any CAST, values which do not convert cleanly to the
+	// affinity, such as non-numeric TEXT in an INTEGER column, are
+	// altered.
+	CastValues bool
+
+	// CompactWhitespace omits optional spacing from statements, separating
+	// list items with a bare comma and leaving comments unpadded, e.g.
+	// ("a","b") and /*old: ('x')*/.
+	CompactWhitespace bool
+
+	// PrettyPrint places each item of a column or value list on its own
+	// indented line. It takes precedence over CompactWhitespace for lists.
+	PrettyPrint bool
+
+	// MaxLineWidth, if greater than zero, lays out the statement of a
+	// change as with PrettyPrint if any of its lines would otherwise be
+	// longer than MaxLineWidth bytes, so that only long statements are
+	// wrapped. A wrapped statement may still have long lines, as
+	// comments and long values are never broken.
+	MaxLineWidth int
+
+	// LineComments places the comments describing each statement on the
+	// line before it as a "-- " line comment, rather than inline as a
+	// /* */ block comment. A line comment is not placed after the
+	// statement's semicolon, as a script ending in a comment is rejected
+	// by sqlitex.ExecScript. Line breaks within the comment, such as in
+	// old TEXT values, are escaped as \n and \r.
+	LineComments bool
+
+	// Logger, if not nil, is called to trace the conversion, such as when
+	// the columns of a table are loaded, when the columns of a changeset
+	// do not match its table, and when a change is skipped. The message
+	// is formatted as by fmt.Sprintf and is prefixed "sqlitechangeset: ".
+	Logger func(format string, args ...interface{})
+
+	// ConflictSourceWins makes ConflictChangesetIterToSQL resolve the
+	// conflict in favor of the changeset, rather than only noting the
+	// conflicting values in a comment. The conflicting row is deleted and,
+	// unless the change is a DELETE, the row is inserted as the change
+	// leaves it, with the columns not set by an UPDATE keeping their
+	// conflicting values. Only SQLITE_CHANGESET_DATA and
+	// SQLITE_CHANGESET_CONFLICT conflicts have a conflicting row.
+	ConflictSourceWins bool
+
+	// AllowMissingColumns converts changes which have fewer columns than
+	// their table, such as those recorded before an ALTER TABLE ADD
+	// COLUMN, treating the missing trailing columns as undefined. An
+	// INSERT then leaves them to their defaults, and an UPDATE leaves
+	// them unchanged. By default such changes fail with
+	// ErrMissingColumns. The Logger is told of each such change.
+	AllowMissingColumns bool
+
+	// IncludeColumns, if it has an entry for a table, limits the columns
+	// of the table in the generated SQL to the listed columns and the
+	// primary key. ExcludeColumns omits the listed columns of a table,
+	// which may not include any column of the primary key. Column names
+	// are matched without regard to case.
+	//
+	// An omitted column is left out of an INSERT, so the target uses its
+	// default, and out of an UPDATE, so the target keeps its value. An
+	// UPDATE of only omitted columns is skipped. Omitted values do not
+	// appear in comments, so these may be used to redact sensitive
+	// columns.
+	IncludeColumns map[string][]string
+	ExcludeColumns map[string][]string
+
+	// MaskValue, if not nil, is called with each defined value and the
+	// table and column it belongs to. If doMask is true, masked is used
+	// verbatim in place of the value's SQL, both in statements and in
+	// comments, e.g. "'***'" to share the SQL without leaking sensitive
+	// data. Masking a primary key, or an old value used by
+	// GuardWithOldValues or GuardWithOldRow, prevents the statement from
+	// matching its row.
+	MaskValue func(table, column string, v sqlite.Value) (masked string, doMask bool)
+
+	// ValueTransforms are applied in order to each defined value before it
+	// is rendered, both in statements and in comments, each receiving the
+	// value returned by the last, e.g. to normalize and then encrypt it. A
+	// transform which returns stop skips those after it. A value which the
+	// transforms change is rendered as a literal according to the Go type
+	// of its V, with the Options which format literals, such as
+	// EscapeText and FloatPrecision, and is not passed to MaskValue, which
+	// is applied to unchanged values as the last transform. A V of any Go
+	// integer type or bool is rendered as an INTEGER and a float32 as a
+	// REAL, while any other type than those of Value is an
+	// ErrUnsupportedValueType. The transforms
+	// may be called more than once for a value, so they should always
+	// return the same value for the same arguments. As with MaskValue,
+	// transforming a primary key prevents the statement from matching its
+	// row.
+	ValueTransforms []ValueTransform
+
+	// IncludeRowid keeps the rowid of each row inserted into a table
+	// without a PRIMARY KEY, as "_rowid_", for cloning a database exactly.
+	// Such a table can only be in a changeset recorded with
+	// SQLITE_SESSION_OBJCONFIG_ROWID, which keys each row by its rowid.
+	// Its UPDATEs and DELETEs always identify rows by "_rowid_", but by
+	// default its INSERTs let the target assign new rowids.
+	//
+	// The rowid of a table with an INTEGER PRIMARY KEY is that column, so
+	// it is always kept. The rowid of a table with any other PRIMARY KEY
+	// is not recorded by changesets, and a WITHOUT ROWID table has none.
+	IncludeRowid bool
+
+	// WholeFloatsAsReal renders FLOAT values which are whole numbers with a
+	// trailing ".0", e.g. 5.0 rather than 5, so that they are parsed as
+	// REAL rather than INTEGER. The target then stores them as REAL in
+	// columns with BLOB or NUMERIC affinity, as the source did. Columns
+	// with REAL affinity store them as REAL either way, and columns with
+	// INTEGER affinity store them as INTEGER either way.
+	WholeFloatsAsReal bool
+
+	// FloatPrecision, if greater than zero, is the number of significant
+	// digits of FLOAT values, e.g. 0.333333 rather than
+	// 0.3333333333333333 with a FloatPrecision of 6. Values with more
+	// digits are rounded, and so may not be stored exactly as in the
+	// source. With zero, the fewest digits which represent each value
+	// exactly are used. The Args of ToStatements hold the exact values.
+	FloatPrecision int
+
+	// RewriteStatement, if not nil, is called with the SQL generated for
+	// each change, along with its table and operation, and the SQL it
+	// returns is output instead, e.g. to add hints or comments. The SQL
+	// includes its terminating ";\n", which the rewritten SQL should keep.
+	// The change is skipped if RewriteStatement returns an empty string,
+	// and the conversion is aborted if it returns an error. It is not used
+	// by ConflictChangesetIterToSQL or ToGoCode.
+	RewriteStatement func(table string, op sqlite.OpType, sql string) (string, error)
+
+	// LimitOne appends "LIMIT 1" to each UPDATE and DELETE, so that a
+	// statement never affects more than one row, even if its WHERE clause
+	// is not unique in the target due to a differing schema. Such
+	// statements are only accepted by SQLite built from source with
+	// SQLITE_ENABLE_UPDATE_DELETE_LIMIT, which the amalgamation used by
+	// crawshaw.io/sqlite is not, so the SQL must be applied elsewhere.
+	// UpdateAsUpsert statements are INSERTs, and are not limited.
+	LimitOne bool
+
+	// Attach lists databases to attach at the start of the generated SQL,
+	// before the Prologue, so that a script which refers to them, such as
+	// through the Prologue or RewriteStatement, may be applied to a fresh
+	// connection. The generated statements themselves are not qualified by
+	// schema, so they apply to the tables of the main database, or to temp
+	// tables of the same name. ATTACH is not allowed within a transaction,
+	// so Attach may not be used with ConvertAndApply.
+	Attach []AttachDatabase
+
+	// History converts every change into an INSERT into the history
+	// table of its table, rather than applying it, turning the changeset
+	// into an append-only audit trail. The history table has a column for
+	// the old and new value of each column, named with the OldPrefix and
+	// NewPrefix of the HistoryTable, and optionally columns for the
+	// operation and time of the change. The Options which select how a
+	// change is applied, such as UpdateAsUpsert, do not apply. Use
+	// PreserveOrder to record the changes in the order they were made,
+	// rather than grouped by operation.
+	History *HistoryTable
+
+	// GeneratedColumnComments adds a comment to each INSERT into a table
+	// with generated columns, listing them with the expressions which
+	// generate them as declared by CREATE TABLE, e.g.
+	// /* generated: "total" AS (price * qty) STORED */. Generated
+	// columns are absent from changesets and cannot be inserted, so the
+	// comment explains their absence from the INSERT.
+	GeneratedColumnComments bool
+
+	// UniformInsertColumns gives all INSERTs into a table the same column
+	// list: the union of the columns defined by any of them. A column
+	// which an INSERT leaves undefined, such as with AllowMissingColumns,
+	// is then inserted as NULL rather than left to its default. This
+	// requires two passes over the changeset, so WriteSQL, and the
+	// functions based on it such as ToSQL, first read all of it into
+	// memory. It has no effect on the functions which convert a
+	// ChangesetIter, which can only be read once.
+	UniformInsertColumns bool
+
+	// StrictSchema checks the whole changeset against the schema with
+	// ValidateSchema before converting any of it, so that all mismatches
+	// are reported up front rather than failing midway. Like
+	// UniformInsertColumns it requires two passes over the changeset and
+	// has no effect on the functions which convert a ChangesetIter.
+	StrictSchema bool
+
+	// ColumnTransitions comments each UPDATE with the old and new value of
+	// each column it sets, e.g. /* "c": 'hello' -> 'hello world' */,
+	// rather than listing the old values in column order, which is easier
+	// to review for wide tables. A column whose old value is not known,
+	// as in a patchset, is listed with only its new value.
+	ColumnTransitions bool
+
+	// MaxStatementLength, if greater than zero, is the most bytes of SQL
+	// that may be generated for a single statement, such as the
+	// SQLITE_LIMIT_SQL_LENGTH of the target, which defaults to
+	// 1000000000. A longer statement is split: an UPDATE sets its
+	// columns in several UPDATEs, setting any new PK last, and an INSERT
+	// inserts its PK and NOT NULL columns with as many others as fit,
+	// followed by UPDATEs of the rest. A DELETE, a single value which
+	// does not fit, and a statement which must apply as a whole, such as
+	// with GuardWithOldValues, GuardWithOldRow, UpdateAsUpsert, History
+	// or ToStatements, cannot be split, and fail with ErrStatementTooLong,
+	// so they may be collected by ContinueOnError rather than failing when
+	// the SQL is applied. See BatchUpdates for the splitting of combined
+	// UPDATEs.
+	MaxStatementLength int
+
+	// OmitSemicolons ends the statement of each change with only a line
+	// break rather than ";\n", for callers which add their own statement
+	// terminators or separators. Note that some changes, such as with
+	// ConflictSourceWins or PKUpdateAsDeleteInsert, produce more than one
+	// statement. The statements added by other Options, such as
+	// TransactionPerTable, keep their semicolons, and the SQL is no longer
+	// a valid script.
+	OmitSemicolons bool
+
+	// JSONColumns, if not nil, is called with each column of a table, and
+	// the TEXT values which an INSERT or UPDATE sets in the columns for
+	// which it returns true are wrapped in json(...), so that the target
+	// validates and minifies them, e.g. json('{"a": 1}'). Applying a
+	// value which is not well-formed JSON then fails. DeclaredJSON selects
+	// the columns declared as JSON. Values in WHERE clauses and comments
+	// are not wrapped.
+	JSONColumns func(table string, col ColumnInfo) bool
+
+	// HashComment starts the generated SQL with a comment holding the
+	// ChangesetHash of the changeset, e.g. "-- changeset sha256:…", so that
+	// a replication log may recognize a changeset which has already been
+	// applied. The whole changeset is read before any SQL is written. It
+	// has no effect on the functions which convert a ChangesetIter.
+	HashComment bool
+
+	// RecursiveDeletes replaces the DELETEs of a table with a foreign key
+	// referencing the same table, such as the parent of a row in a
+	// hierarchy, by a DELETE of the rows and all of their descendants,
+	// which a WITH RECURSIVE common table expression selects:
+	//
+	//	WITH RECURSIVE "sqlitechangeset.RecursiveDeletes" ("id") AS
+	//	(VALUES (1), (4) UNION SELECT "child"."id" FROM "tree" AS "child"
+	//	JOIN "tree" AS "parent" ON ("child"."parent") = ("parent"."id")
+	//	JOIN "sqlitechangeset.RecursiveDeletes" AS "deleted"
+	//	ON ("parent"."id") = ("deleted"."id"))
+	//	DELETE FROM "tree" WHERE ("id") IN
+	//	(SELECT "id" FROM "sqlitechangeset.RecursiveDeletes");
+	//
+	// SQLite checks foreign keys once a statement completes, so children
+	// and their parents are deleted together with foreign_keys=ON and no
+	// ON DELETE CASCADE, unless the foreign key is ON DELETE RESTRICT,
+	// which is checked as each row is deleted. A row of the target which
+	// references a deleted row is deleted too, even if the changeset does
+	// not delete it. The DELETE is split into several, each of some of the
+	// rows and their descendants, if it would be longer than
+	// MaxStatementLength, and the comments of the DELETEs it replaces are
+	// omitted. Only grouped statements are
+	// replaced, so it has no effect with NoGrouping or PreserveOrder, nor
+	// with GuardWithOldRow, History or RewriteStatement, which need a
+	// statement for each row.
+	RecursiveDeletes bool
+
+	// OrderByDependencies orders the grouped statements by the foreign
+	// keys between the tables in a changeset, rather than by the order in
+	// which the tables first appear, so that the SQL can be applied with
+	// foreign_keys=ON. The INSERTs and UPDATEs of each table follow those
+	// of the tables it references, and then the DELETEs of each table
+	// precede those of the tables it references. If the foreign keys form
+	// a cycle, no such order exists and ErrForeignKeyCycle is returned,
+	// naming the tables in the cycle, unless DeferForeignKeys is set. A
+	// table referencing itself is not a cycle, see RecursiveDeletes. Like
+	// it, this has no effect with NoGrouping or PreserveOrder.
+	OrderByDependencies bool
+
+	// BatchUpdates, if greater than one, is the most UPDATEs of a table
+	// which are combined into a single statement, such as
+	//
+	//	UPDATE "t" SET "c" = CASE "id" WHEN 1 THEN 'a' WHEN 2 THEN 'b' END
+	//	WHERE "id" IN (1, 2);
+	//
+	// Only UPDATEs of the same columns of a table with a single PK column,
+	// which they do not change, are combined, in place of the first of
+	// them, and their comments are omitted. An UPDATE which would make the
+	// combined statement longer than MaxStatementLength starts a new one,
+	// and one which is too long by itself is split as MaxStatementLength
+	// describes.
+	// UPDATEs are not combined with NoGrouping, PreserveOrder,
+	// UpdateAsUpsert, GuardWithOldValues, GuardWithOldRow, LimitOne,
+	// History or RewriteStatement, nor by ToStatements.
+	BatchUpdates int
+
+	// ReadTransaction holds a read transaction on the connection for the
+	// whole of a conversion by WriteSQL and the functions built on it, so
+	// that every query of the schema sees the same version of it, even if
+	// another connection changes the schema meanwhile. The transaction
+	// blocks writers on other connections until the conversion finishes,
+	// unless the database is in WAL mode, where the conversion instead
+	// reads a snapshot. The connection must not be in use elsewhere during
+	// the conversion. If a transaction is already open on it, it is used
+	// instead.
+	ReadTransaction bool
+
+	// DisableTriggers drops the triggers of the main database after the
+	// Prologue and recreates them before the Epilogue, so that triggers in
+	// the target, such as those of a replica, do not apply the effects of
+	// the changes a second time. SQLite cannot disable a trigger, so the
+	// triggers are read from sqlite_master of the connection, which must
+	// have the same triggers as the target. It applies to the SQL written
+	// by WriteSQL and the functions built on it.
+	DisableTriggers bool
+
+	// ConflictResolver, if not nil, chooses the Resolution of each
+	// conflict resolved by ConflictResolutionSQL and ConflictHandler, in
+	// place of always resolving it in favor of the changeset. It is called
+	// with the table and op of the conflicting change, the values of the
+	// conflicting row of the target, and the values of the row as the
+	// change leaves it, keyed by column name as for a ChangeEvent. local
+	// is nil if there is no conflicting row, and incoming is nil for a
+	// DELETE. For an UPDATE, incoming holds only the primary key and the
+	// updated columns. Foreign key conflicts, which have no change, are
+	// not passed to it.
+	ConflictResolver func(table string, op sqlite.OpType,
+		local, incoming map[string]interface{}) Resolution
+
+	// DeferForeignKeys applies the statements within a SAVEPOINT with
+	// PRAGMA defer_foreign_keys=ON, so that foreign keys are only checked
+	// once all of the changes are applied, and a changeset with circular
+	// or forward references can be applied with foreign_keys=ON.
+	// Releasing the SAVEPOINT commits the changes unless a transaction is
+	// already open, and any violation then fails the RELEASE or the COMMIT
+	// of the open transaction. SQLite resets the pragma when the
+	// transaction ends; it is not reset by the SQL, as resetting it would
+	// discard the pending violations of an open transaction. With
+	// OrderByDependencies, the tables are still ordered by their foreign
+	// keys, and those of a cycle are ordered as they first appear.
+	DeferForeignKeys bool
+
+	// DumpCompatible frames the SQL as the .dump command of the sqlite3
+	// CLI does, beginning it with
+	//
+	//	PRAGMA foreign_keys=OFF;
+	//	BEGIN TRANSACTION;
+	//
+	// after any Attach statements and before the Prologue, and ending it
+	// with "COMMIT;" after the Epilogue, so that it applies as a single
+	// transaction and may be mixed with the output of .dump. The
+	// statements themselves are rendered as otherwise. As BEGIN is not
+	// allowed within a transaction, DumpCompatible may not be used with
+	// ConvertAndApply.
+	DumpCompatible bool
+
+	// SavepointEvery, if greater than zero, wraps every SavepointEvery
+	// statements in a SAVEPOINT named "batch_N", numbered from 1, and a
+	// matching RELEASE, so that a huge script may be resumed rather than
+	// restarted. Outside of a transaction, releasing each SAVEPOINT
+	// commits its batch, so if applying the SQL fails, the batches
+	// already released remain applied, and once the failed batch is
+	// rolled back the SQL may be applied again from its SAVEPOINT. It has
+	// no effect with TransactionPerTable, unless NoGrouping is set, as the
+	// savepoints of each would overlap, nor on the files of ToSQLFiles.
+	SavepointEvery int
+
+	// columns caches the columns of each table across conversions when
+	// set by a Converter.
+	columns map[string][]ColumnInfo
+	// foreignKeys and generated cache the foreign keys and generated
+	// columns of each table likewise.
+	foreignKeys map[string][]ForeignKey
+	generated   map[string][]GeneratedColumn
+	// pks caches the PK flags of each table, as declared by the
+	// changesets converted.
+	pks map[string][]bool
+	// header is written before the Attach statements and Prologue.
+	header string
+	// schema holds the CREATE TABLE statements of SchemaAndDataSQL,
+	// which are written after the Prologue.
+	schema string
+	// insertColumns holds, for UniformInsertColumns, the union of the
+	// columns defined by the INSERTs into each table.
+	insertColumns map[string][]bool
+	// triggers holds the triggers of the database for DisableTriggers,
+	// if loaded in advance.
+	triggers *triggerSQL
+	// cachedOnly prevents columns missing from the cache being queried,
+	// while the connection is in use by a session.
+	cachedOnly bool
+}
+
+// DeclaredJSON reports whether the declared type of col is JSON, for use as
+// Options.JSONColumns.
+func DeclaredJSON(table string, col ColumnInfo) bool {
+	return strings.EqualFold(col.Type, "JSON")
+}
+
+// AttachDatabase is a database attached by an ATTACH DATABASE statement.
+type AttachDatabase struct {
+	// Name is the schema name of the database.
+	Name string
+	// Path is the file name or URI of the database.
+	Path string
+}
+
+// prologue returns the header, the ATTACH DATABASE statements of the Attach
+// databases, the beginning of the transaction of DumpCompatible, and the
+// Prologue, followed by the CREATE TABLE statements of SchemaAndDataSQL.
+func (opts Options) prologue() string {
+	sql := opts.header
+	for _, db := range opts.Attach {
+		sql += fmt.Sprintf("ATTACH DATABASE %s AS %s;\n",
+			QuoteText(db.Path), quoteIdentifier(db.Name))
+	}
+	if opts.DumpCompatible {
+		sql += "PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n"
+	}
+	return sql + opts.Prologue + opts.schema
+}
+
+// epilogue returns the Epilogue, followed by the end of the transaction of
+// DumpCompatible.
+func (opts Options) epilogue() string {
+	if opts.DumpCompatible {
+		return opts.Epilogue + "COMMIT;\n"
+	}
+	return opts.Epilogue
+}
+
+// usesForeignKeys returns true if the Options need the foreign keys of the
+// tables in a changeset.
+func (opts Options) usesForeignKeys() bool {
+	return opts.RecursiveDeletes || opts.OrderByDependencies
+}
+
+// logf calls the Logger, if any.
+func (opts Options) logf(format string, args ...interface{}) {
+	if opts.Logger != nil {
+		opts.Logger("sqlitechangeset: "+format, args...)
+	}
+}
+
+// DefaultProgressInterval is the number of changes between calls to
+// Options.Progress when Options.ProgressInterval is zero.
+const DefaultProgressInterval = 1000
+
+func (opts Options) progressInterval() int {
+	if opts.ProgressInterval > 0 {
+		return opts.ProgressInterval
+	}
+	return DefaultProgressInterval
+}
@@ -0,0 +1,219 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// SchemaAndDataSQL returns the CREATE TABLE statements of the tables changed
+// by changeset followed by the SQL statements which apply it, using the
+// default Options.
+func SchemaAndDataSQL(conn *sqlite.Conn, changeset io.Reader) (string, error) {
+	return Options{}.SchemaAndDataSQL(conn, changeset)
+}
+
+// SchemaAndDataSQL returns the CREATE TABLE statements of the tables changed
+// by changeset, as they are defined in the main database of conn, followed by
+// the SQL statements which apply it. The result is a self-contained script
+// which replays the changeset into an empty database. The CREATE TABLE
+// statements follow the Prologue and any hash comment of HashComment.
+//
+// A table is created after any other changed tables referenced by its
+// foreign keys, and otherwise in the order the tables first appear in the
+// changeset. Tables referenced but not changed are not created, nor are
+// indexes, triggers or views.
+func (opts Options) SchemaAndDataSQL(conn *sqlite.Conn,
+	changeset io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(changeset)
+	if err != nil {
+		return "", err
+	}
+	tables, err := changesetTables(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	if opts.foreignKeys == nil {
+		// Share the foreign keys with the conversion.
+		opts.foreignKeys = make(map[string][]ForeignKey)
+	}
+	// Tables in a cycle of references keep their order.
+	order, err := dependencyOrder(tables, opts.newConn(conn).GetForeignKeys,
+		true)
+	if err != nil {
+		return "", err
+	}
+	var schema strings.Builder
+	for _, tblID := range order {
+		create, err := createTableSQL(conn, tables[tblID])
+		if err != nil {
+			return "", err
+		}
+		schema.WriteString(create + ";\n")
+	}
+	opts.schema = schema.String()
+	return opts.ToSQL(conn, bytes.NewReader(data))
+}
+
+// changesetTables returns the names of the tables in changeset, in the order
+// they first appear.
+func changesetTables(changeset io.Reader) ([]string, error) {
+	var tables []string
+	seen := make(map[string]bool)
+	_, err := withChangesetIter(changeset, func(iter sqlite.ChangesetIter) error {
+		for {
+			hasRow, err := iter.Next()
+			if err != nil {
+				return err
+			}
+			if !hasRow {
+				return nil
+			}
+			tbl, _, _, _, err := iter.Op()
+			if err != nil {
+				return err
+			}
+			if !seen[tbl] {
+				seen[tbl] = true
+				tables = append(tables, tbl)
+			}
+		}
+	})
+	return tables, err
+}
+
+// createTableSQL returns the CREATE TABLE statement of tbl in the main
+// database, without a trailing semicolon.
+func createTableSQL(conn *sqlite.Conn, tbl string) (string, error) {
+	const CREATEQ = `SELECT sql FROM sqlite_master
+                WHERE type = 'table' AND name = ?1 COLLATE NOCASE;`
+	var create string
+	err := sqlitex.Exec(conn, CREATEQ, func(stmt *sqlite.Stmt) error {
+		create = stmt.ColumnText(0)
+		return nil
+	}, tbl)
+	if err != nil {
+		return "", err
+	}
+	if create == "" {
+		return "", fmt.Errorf("sqlitechangeset: no schema for table %q", tbl)
+	}
+	return create, nil
+}
+
+// SchemaMismatchError is returned by ValidateSchema, listing every way in
+// which a changeset does not match the schema of its tables.
+type SchemaMismatchError struct {
+	Mismatches []string
+}
+
+func (err *SchemaMismatchError) Error() string {
+	return "sqlitechangeset: changeset does not match schema:\n\t" +
+		strings.Join(err.Mismatches, "\n\t")
+}
+
+// ValidateSchema checks that every table of changeset exists in the database
+// of conn, with the columns and PRIMARY KEY that the changeset has, using the
+// default Options.
+func ValidateSchema(conn *sqlite.Conn, changeset io.Reader) error {
+	return Options{}.ValidateSchema(conn, changeset)
+}
+
+// ValidateSchema checks that every table of changeset exists in the database
+// of conn, with the columns and PRIMARY KEY that the changeset has. If not, a
+// *SchemaMismatchError lists all of the mismatches.
+//
+// A rowid-keyed changeset of a table without a PRIMARY KEY matches the
+// table, and with AllowMissingColumns a change may have fewer columns than
+// its table.
+func (opts Options) ValidateSchema(conn *sqlite.Conn, changeset io.Reader) error {
+	Conn := opts.newConn(conn)
+	var mismatches []string
+	seen := make(map[string]bool)
+	mismatch := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		if !seen[msg] {
+			seen[msg] = true
+			mismatches = append(mismatches, msg)
+		}
+	}
+	_, err := withChangesetIter(changeset, func(iter sqlite.ChangesetIter) error {
+		for {
+			hasRow, err := iter.Next()
+			if err != nil || !hasRow {
+				return err
+			}
+			tbl, nCol, _, _, err := iter.Op()
+			if err != nil {
+				return err
+			}
+			cols, err := Conn.GetColumns(tbl)
+			if err != nil {
+				mismatch("%v", err)
+				continue
+			}
+			if len(cols) == 0 {
+				mismatch("table %q does not exist", tbl)
+				continue
+			}
+			pk, err := changesetPK(iter, nCol, cols)
+			if err != nil {
+				return err
+			}
+			if nCol == len(cols)+1 && pk[0] && !hasPK(cols) {
+				// A rowid-keyed changeset.
+				continue
+			}
+			if nCol > len(cols) || nCol < len(cols) &&
+				!opts.AllowMissingColumns {
+				mismatch("table %q has %d columns but the changeset has %d",
+					tbl, len(cols), nCol)
+			}
+			var want, got []string
+			for i, col := range cols {
+				if col.PK > 0 {
+					want = append(want, quoteIdentifier(col.Name))
+				}
+				if i < nCol && pk[i] {
+					got = append(got, quoteIdentifier(col.Name))
+				}
+			}
+			if strings.Join(want, _COMMA) != strings.Join(got, _COMMA) {
+				mismatch("table %q has PRIMARY KEY (%s) but the changeset has (%s)",
+					tbl, strings.Join(want, _COMMA), strings.Join(got, _COMMA))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(mismatches) > 0 {
+		return &SchemaMismatchError{Mismatches: mismatches}
+	}
+	return nil
+}
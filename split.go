@@ -0,0 +1,157 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"strings"
+
+	"crawshaw.io/sqlite"
+)
+
+// splitStatement returns the SQL of c, whose statement is longer than
+// MaxStatementLength, as several statements which are each no longer. The
+// columns set by an UPDATE are set by successive UPDATEs, any new PK last,
+// while an INSERT inserts its PK and NOT NULL columns with as many others as
+// fit, and its remaining columns are set by UPDATEs of the inserted row. ok
+// is false if c cannot be split so, as a single column does not fit, or as
+// its statements must apply as a whole, such as guarded UPDATEs.
+func (conn _Conn) splitStatement(c change) (sql string, ok bool, err error) {
+	opts := conn.Options
+	if c.Conflict != nil || conn.params != nil || opts.History != nil ||
+		opts.UpdateAsUpsert || opts.GuardWithOldValues ||
+		opts.GuardWithOldRow {
+		return "", false, nil
+	}
+	var first, rest []int
+	switch c.Op {
+	case sqlite.SQLITE_INSERT:
+		if c.Rowid && !opts.IncludeRowid {
+			// The rowid of the inserted row is not known.
+			return "", false, nil
+		}
+		for i, col := range c.Columns {
+			switch {
+			case c.New[i].IsNil():
+			case c.PK[i] || col.NotNull:
+				first = append(first, i)
+			default:
+				rest = append(rest, i)
+			}
+		}
+	case sqlite.SQLITE_UPDATE:
+		var pk []int
+		for i := range c.Columns {
+			switch {
+			case c.New[i].IsNil():
+			case c.PK[i]:
+				if sameValue(c.Old[i], c.New[i]) {
+					continue
+				}
+				if opts.PKUpdateAsDeleteInsert {
+					return "", false, nil
+				}
+				// The later UPDATEs would not find the row by
+				// its old PK.
+				pk = append(pk, i)
+			default:
+				rest = append(rest, i)
+			}
+		}
+		rest = append(rest, pk...)
+	default:
+		return "", false, nil
+	}
+
+	max := opts.MaxStatementLength
+	// Add the columns to the current statement while it fits, and else
+	// start another.
+	var stmts []string
+	part := first
+	var cur string
+	if len(part) > 0 {
+		if cur, err = conn.buildWrapped(splitPart(c, part, true)); err != nil {
+			return "", false, err
+		}
+		if len(cur) > max {
+			return "", false, nil
+		}
+	}
+	for _, i := range rest {
+		next := append(part[:len(part):len(part)], i)
+		s, err := conn.buildWrapped(splitPart(c, next, len(stmts) == 0))
+		if err != nil {
+			return "", false, err
+		}
+		if len(s) <= max {
+			part, cur = next, s
+			continue
+		}
+		if cur == "" {
+			return "", false, nil
+		}
+		stmts = append(stmts, cur)
+		part = []int{i}
+		if cur, err = conn.buildWrapped(splitPart(c, part, false)); err != nil {
+			return "", false, err
+		}
+		if len(cur) > max {
+			return "", false, nil
+		}
+	}
+	if cur == "" {
+		return "", false, nil
+	}
+	return strings.Join(append(stmts, cur), ""), true, nil
+}
+
+// splitPart returns the part of c which sets the columns cols, for
+// splitStatement. The first part of an INSERT is an INSERT, while any other
+// part is an UPDATE of the row by its PK.
+func splitPart(c change, cols []int, first bool) change {
+	part := c
+	part.Old = make([]sqlite.Value, len(c.Columns))
+	part.New = make([]sqlite.Value, len(c.Columns))
+	for _, i := range cols {
+		part.New[i] = c.New[i]
+	}
+	if c.Op == sqlite.SQLITE_INSERT {
+		if first {
+			return part
+		}
+		// Find the inserted row by its new PK.
+		part.Op = sqlite.SQLITE_UPDATE
+		for i := range c.Columns {
+			if c.PK[i] {
+				part.Old[i], part.New[i] = c.New[i], sqlite.Value{}
+			}
+		}
+		return part
+	}
+	for i := range c.Columns {
+		if c.PK[i] {
+			part.Old[i] = c.Old[i]
+		}
+	}
+	for _, i := range cols {
+		part.Old[i] = c.Old[i]
+	}
+	return part
+}
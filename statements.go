@@ -0,0 +1,85 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"io"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// Statement is the SQL of a change with numbered parameters in place of its
+// values, and the Args to bind to them, in the form taken by sqlitex.Exec.
+type Statement struct {
+	SQL  string
+	Args []interface{}
+}
+
+// Exec executes st on conn with sqlitex.Exec.
+func (st Statement) Exec(conn *sqlite.Conn) error {
+	return sqlitex.Exec(conn, st.SQL, nil, st.Args...)
+}
+
+// ToStatements converts changeset into Statements using the default Options.
+// See Options.ToStatements.
+func ToStatements(conn *sqlite.Conn, changeset io.Reader) ([]Statement, error) {
+	return Options{}.ToStatements(conn, changeset)
+}
+
+// ToStatements converts changeset into a Statement for each change, in
+// changeset order, which may be executed directly with sqlitex.Exec:
+//
+//	for _, st := range statements {
+//		if err := sqlitex.Exec(conn, st.SQL, nil, st.Args...); err != nil {
+//			return err
+//		}
+//	}
+//
+// Binding the values avoids escaping them as literals, except for BLOBs,
+// which are always rendered as literals because sqlite.Stmt.BindBytes binds
+// them as TEXT. As with ToGoCode, the options which add statements to the
+// SQL script do not apply, and PKUpdateAsDeleteInsert is ignored as each
+// change must be a single statement.
+func (opts Options) ToStatements(conn *sqlite.Conn,
+	changeset io.Reader) ([]Statement, error) {
+	opts.PKUpdateAsDeleteInsert = false
+	var statements []Statement
+	_, err := withChangesetIter(changeset, func(iter sqlite.ChangesetIter) error {
+		var args []interface{}
+		return opts.forEachChange(conn, iter,
+			func(conn _Conn, c change) (string, error) {
+				args = nil
+				conn.params = &args
+				return conn.BuildSQL(c)
+			},
+			func(_ change, sql string) error {
+				statements = append(statements, Statement{
+					SQL: strings.TrimSuffix(sql, "\n"), Args: args})
+				return nil
+			})
+	})
+	if fatal(err) != nil {
+		return nil, err
+	}
+	return statements, err
+}
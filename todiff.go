@@ -0,0 +1,119 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"crawshaw.io/sqlite"
+)
+
+// ToDiff renders changeset as a unified diff of row values using the default
+// Options.
+func ToDiff(conn *sqlite.Conn, changeset io.Reader) (string, error) {
+	return Options{}.ToDiff(conn, changeset)
+}
+
+// ToDiff renders changeset as a unified diff of row values, for reviewing
+// changes rather than applying them. The changes are grouped by table, in the
+// order the tables first appear in the changeset. Each change starts with a
+// "@@" line naming the operation and primary key of the row, followed by a
+// "-" line for each old value and a "+" line for each new value:
+//
+//	--- "t"
+//	+++ "t"
+//	@@ UPDATE ("a", "b") = (1, 1) @@
+//	-"c" = 'hello'
+//	+"c" = 'hello world'
+//
+// An INSERT has only new values, a DELETE only old values, and an UPDATE only
+// the values of the columns it changes.
+func (opts Options) ToDiff(conn *sqlite.Conn, changeset io.Reader) (string, error) {
+	var tables []string
+	diffs := make(map[string]string)
+	_, err := withChangesetIter(changeset, func(iter sqlite.ChangesetIter) error {
+		return opts.forEachChange(conn, iter, _Conn.buildDiff,
+			func(c change, diff string) error {
+				if _, ok := diffs[c.Table]; !ok {
+					tables = append(tables, c.Table)
+				}
+				diffs[c.Table] += diff
+				return nil
+			})
+	})
+	if fatal(err) != nil {
+		return "", err
+	}
+	var out string
+	for _, tbl := range tables {
+		out += fmt.Sprintf("--- %s\n+++ %[1]s\n", quoteIdentifier(tbl)) +
+			diffs[tbl]
+	}
+	return out, err
+}
+
+// buildDiff renders c as a hunk of the unified diff produced by ToDiff.
+func (conn _Conn) buildDiff(c change) (string, error) {
+	const LINEF = "%c%s = %s\n"
+	conn.table = c.Table
+	var pkCols, pkVals, minus, plus string
+	for i, col := range c.Columns {
+		vOld, vNew := c.Old[i], c.New[i]
+		if c.PK[i] {
+			v := vOld
+			if c.Op == sqlite.SQLITE_INSERT {
+				v = vNew
+			}
+			pkCols += quoteIdentifier(col.Name) + _COMMA
+			pkVals += conn.previewString(col, v) + _COMMA
+		}
+		if c.Op == sqlite.SQLITE_UPDATE && vNew.IsNil() {
+			// The column is unchanged.
+			continue
+		}
+		if !vOld.IsNil() {
+			minus += fmt.Sprintf(LINEF, '-', quoteIdentifier(col.Name),
+				conn.previewString(col, vOld))
+		}
+		if !vNew.IsNil() {
+			plus += fmt.Sprintf(LINEF, '+', quoteIdentifier(col.Name),
+				conn.previewString(col, vNew))
+		}
+	}
+	pkCols = strings.TrimSuffix(pkCols, _COMMA)
+	pkVals = strings.TrimSuffix(pkVals, _COMMA)
+	op := strings.TrimPrefix(c.Op.String(), "SQLITE_")
+	return fmt.Sprintf("@@ %s (%s) = (%s) @@\n", op, pkCols, pkVals) +
+		minus + plus, nil
+}
+
+// previewString returns the representation of val, a value of col, for
+// output which is reviewed rather than executed.
+func (conn _Conn) previewString(col ColumnInfo, val sqlite.Value) string {
+	max := conn.Options.PreviewBlobBytes
+	if max > 0 && !val.IsNil() && val.Type() == sqlite.SQLITE_BLOB &&
+		val.Len() > max {
+		return fmt.Sprintf("X'%X…(%d bytes)'", val.Blob()[:max], val.Len())
+	}
+	return conn.valueString(col, val)
+}
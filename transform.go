@@ -0,0 +1,148 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+
+	"crawshaw.io/sqlite"
+)
+
+// ValueTransform transforms v, a value of column of table, such as to mask,
+// normalize or encrypt it, before it is rendered. If stop is true, out is
+// used without applying any later ValueTransforms.
+type ValueTransform func(table, column string, v Value) (out Value, stop bool)
+
+// transform applies the ValueTransforms to val, a value of col, in order, and
+// returns the transformed value, converted by convertTransformed, and whether
+// it differs from val.
+func (conn _Conn) transform(col ColumnInfo,
+	val sqlite.Value) (Value, bool, error) {
+	in := Value{Type: val.Type(), V: goValue(val)}
+	v := in
+	for _, t := range conn.Options.ValueTransforms {
+		var stop bool
+		if v, stop = t(conn.table, col.Name, v); stop {
+			break
+		}
+	}
+	v, err := convertTransformed(v)
+	if err != nil {
+		return Value{}, false, fmt.Errorf("%w, returned by the "+
+			"ValueTransforms for column %q of table %q",
+			err, col.Name, conn.table)
+	}
+	return v, !v.equal(in), nil
+}
+
+// convertTransformed returns v with a V of any Go integer type or bool
+// converted to an int64, and a float32 to a float64, so that its V is one of
+// the types of goValue. Any other type is an ErrUnsupportedValueType.
+func convertTransformed(v Value) (Value, error) {
+	switch x := v.V.(type) {
+	case nil, int64, float64, string, []byte:
+	case int:
+		v.V = int64(x)
+	case int8:
+		v.V = int64(x)
+	case int16:
+		v.V = int64(x)
+	case int32:
+		v.V = int64(x)
+	case uint:
+		if uint64(x) > math.MaxInt64 {
+			return v, fmt.Errorf("%w: %T %v overflows int64",
+				ErrUnsupportedValueType, x, x)
+		}
+		v.V = int64(x)
+	case uint8:
+		v.V = int64(x)
+	case uint16:
+		v.V = int64(x)
+	case uint32:
+		v.V = int64(x)
+	case uint64:
+		if x > math.MaxInt64 {
+			return v, fmt.Errorf("%w: %T %v overflows int64",
+				ErrUnsupportedValueType, x, x)
+		}
+		v.V = int64(x)
+	case bool:
+		v.V = int64(0)
+		if x {
+			v.V = int64(1)
+		}
+	case float32:
+		v.V = float64(x)
+	default:
+		return v, fmt.Errorf("%w: %T", ErrUnsupportedValueType, x)
+	}
+	return v, nil
+}
+
+// equal returns true if v and w have the same type and value. Their Vs must
+// be of the types of goValue.
+func (v Value) equal(w Value) bool {
+	if b, ok := v.V.([]byte); ok {
+		c, ok := w.V.([]byte)
+		return ok && v.Type == w.Type && bytes.Equal(b, c)
+	}
+	if _, ok := w.V.([]byte); ok {
+		return false
+	}
+	return v.Type == w.Type && v.V == w.V
+}
+
+// transformedLiteral returns the SQL literal of v, a value of col returned by
+// transform, formatted as literal formats the values of a changeset. The type
+// of v.V, rather than v.Type, selects the literal.
+func (conn _Conn) transformedLiteral(col ColumnInfo, v Value) string {
+	switch x := v.V.(type) {
+	case nil:
+		return conn.nullString(col)
+	case int64:
+		if conn.Options.BooleanLiterals && col.IsBoolean() {
+			switch x {
+			case 0:
+				return "FALSE"
+			case 1:
+				return "TRUE"
+			}
+		}
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return conn.formatFloat(x)
+	case string:
+		if AlwaysUseBlob {
+			return fmt.Sprintf("X'%X'", x)
+		}
+		if conn.Options.EscapeText != nil {
+			return conn.Options.EscapeText(x)
+		}
+		return QuoteText(x)
+	default:
+		// A []byte, as convertTransformed returns no other type.
+		return fmt.Sprintf("X'%X'", x)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"fmt"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// triggerSQL holds the statements which drop and recreate the triggers of a
+// database, for DisableTriggers.
+type triggerSQL struct {
+	drop, create string
+}
+
+// triggers returns the statements which drop and recreate the triggers of
+// the main database of conn, recreating them in the order they were created.
+func triggers(conn *sqlite.Conn) (*triggerSQL, error) {
+	const TRIGGERS = `SELECT name, sql FROM main.sqlite_master
+                WHERE type = 'trigger' ORDER BY rowid;`
+	const DROPF = "DROP TRIGGER IF EXISTS %s;\n"
+	var sql triggerSQL
+	err := sqlitex.Exec(conn, TRIGGERS, func(stmt *sqlite.Stmt) error {
+		sql.drop += fmt.Sprintf(DROPF, quoteIdentifier(stmt.ColumnText(0)))
+		sql.create += stmt.ColumnText(1) + ";\n"
+		return nil
+	})
+	return &sql, err
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// VerifyRoundTrip checks that the SQL generated from changeset reproduces it.
+// The SQL is applied to conn, which must be in the state prior to the
+// changeset, while a new session records the resulting changes. An error is
+// returned if the recorded changes differ from those in changeset. All
+// changes made to conn are rolled back before returning.
+//
+// The changes are compared regardless of their order, so changeset must not
+// be a patchset.
+func VerifyRoundTrip(conn *sqlite.Conn, changeset io.Reader) (err error) {
+	want, err := ioutil.ReadAll(changeset)
+	if err != nil {
+		return err
+	}
+	sql, err := ToSQL(conn, bytes.NewReader(want))
+	if err != nil {
+		return err
+	}
+
+	const SAVEPOINT = `"sqlitechangeset.VerifyRoundTrip"`
+	if err := sqlitex.Exec(conn, `SAVEPOINT `+SAVEPOINT+`;`, nil); err != nil {
+		return err
+	}
+	defer func() {
+		rbErr := sqlitex.Exec(conn, `ROLLBACK TO `+SAVEPOINT+`;`, nil)
+		if rbErr == nil {
+			rbErr = sqlitex.Exec(conn, `RELEASE `+SAVEPOINT+`;`, nil)
+		}
+		if err == nil {
+			err = rbErr
+		}
+	}()
+
+	sess, err := conn.CreateSession("")
+	if err != nil {
+		return err
+	}
+	defer sess.Delete()
+	if err := sess.Attach(""); err != nil {
+		return err
+	}
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		return err
+	}
+	got := &bytes.Buffer{}
+	if err := sess.Changeset(got); err != nil {
+		return err
+	}
+
+	wantHunks, err := changeHunks(conn, want)
+	if err != nil {
+		return err
+	}
+	gotHunks, err := changeHunks(conn, got.Bytes())
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(wantHunks) || i < len(gotHunks); i++ {
+		if i >= len(gotHunks) || i < len(wantHunks) &&
+			wantHunks[i] < gotHunks[i] {
+			return fmt.Errorf("sqlitechangeset: round trip is missing change:\n%s",
+				wantHunks[i])
+		}
+		if i >= len(wantHunks) || wantHunks[i] != gotHunks[i] {
+			return fmt.Errorf("sqlitechangeset: round trip has unexpected change:\n%s",
+				gotHunks[i])
+		}
+	}
+	return nil
+}
+
+// changeHunks returns the sorted ToDiff hunks of each change in changeset,
+// each prefixed with its table name.
+func changeHunks(conn *sqlite.Conn, changeset []byte) ([]string, error) {
+	var hunks []string
+	_, err := withChangesetIter(bytes.NewReader(changeset),
+		func(iter sqlite.ChangesetIter) error {
+			return Options{}.forEachChange(conn, iter, _Conn.buildDiff,
+				func(c change, hunk string) error {
+					hunks = append(hunks,
+						fmt.Sprintf("%q ", c.Table)+hunk)
+					return nil
+				})
+		})
+	sort.Strings(hunks)
+	return hunks, err
+}
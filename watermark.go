@@ -0,0 +1,164 @@
+// Copyright 2019 Adam S Levy <adam@aslevy.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package sqlitechangeset
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"crawshaw.io/sqlite"
+)
+
+// afterWatermark returns true if c is of a row whose primary key is greater
+// than the PKWatermark of its table, or if its table has none.
+func (conn _Conn) afterWatermark(c change) (bool, error) {
+	mark, ok := conn.Options.PKWatermark[c.Table]
+	if !ok {
+		return true, nil
+	}
+	pk := c.pkTuple()
+	if len(mark) != len(pk) {
+		return false, fmt.Errorf("sqlitechangeset: PKWatermark of "+
+			"table %q has %d values but its primary key has %d columns",
+			c.Table, len(mark), len(pk))
+	}
+	for i := range pk {
+		cmp, err := compareValues(pk[i], mark[i])
+		if err != nil {
+			return false, fmt.Errorf("sqlitechangeset: "+
+				"PKWatermark of table %q: %w",
+				c.Table, err)
+		}
+		if cmp != 0 {
+			return cmp > 0, nil
+		}
+	}
+	return false, nil
+}
+
+// pkTuple returns the primary key values of c, as by PKValues, in the order
+// of the columns of the PRIMARY KEY.
+func (c change) pkTuple() []interface{} {
+	vals := c.Old
+	if c.Op == sqlite.SQLITE_INSERT {
+		vals = c.New
+	}
+	var cols []int
+	for i := range c.Columns {
+		if c.PK[i] {
+			cols = append(cols, i)
+		}
+	}
+	sort.SliceStable(cols, func(i, j int) bool {
+		return c.Columns[cols[i]].PK < c.Columns[cols[j]].PK
+	})
+	pk := make([]interface{}, len(cols))
+	for i, col := range cols {
+		pk[i] = goValue(vals[col])
+	}
+	return pk
+}
+
+// compareValues compares a and b, values as returned by goValue, in the
+// order of SQLite: NULL, then INTEGER and REAL by numeric value, then TEXT
+// and BLOB by their bytes. It returns -1, 0 or 1 as a is less than, equal
+// to, or greater than b. An int is accepted as an int64.
+func compareValues(a, b interface{}) (int, error) {
+	rank := func(v interface{}) (int, error) {
+		switch v.(type) {
+		case nil:
+			return 0, nil
+		case int, int64, float64:
+			return 1, nil
+		case string:
+			return 2, nil
+		case []byte:
+			return 3, nil
+		default:
+			return 0, fmt.Errorf("unsupported value type %T", v)
+		}
+	}
+	rankA, err := rank(a)
+	if err != nil {
+		return 0, err
+	}
+	rankB, err := rank(b)
+	if err != nil {
+		return 0, err
+	}
+	if rankA != rankB {
+		return compareInts(int64(rankA), int64(rankB)), nil
+	}
+	switch a := a.(type) {
+	case nil:
+		return 0, nil
+	case string:
+		return strings.Compare(a, b.(string)), nil
+	case []byte:
+		return bytes.Compare(a, b.([]byte)), nil
+	}
+	// Integers are compared exactly, unless either value is a REAL.
+	intA, isIntA := toInt64(a)
+	intB, isIntB := toInt64(b)
+	if isIntA && isIntB {
+		return compareInts(intA, intB), nil
+	}
+	return compareFloats(toFloat64(a), toFloat64(b)), nil
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+func toFloat64(v interface{}) float64 {
+	if i, ok := toInt64(v); ok {
+		return float64(i)
+	}
+	return v.(float64)
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}